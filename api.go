@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces configuration values that may hold credentials.
+const redacted = "<redacted>"
+
+// sensitiveWords are found in the names of settings holding credentials.
+const sensitiveWords = `passw(?:or)?d|pwd|token|secret|api[_-]?key|auth|credential`
+
+var (
+	// sensitiveAssignment matches key=value and key:value pairs in
+	// commands whose key names a credential.
+	sensitiveAssignment = regexp.MustCompile(`(?i)([\w.-]*(?:` + sensitiveWords + `)[\w.-]*[=:])([^\s'"&]+)`)
+
+	// sensitiveFlag matches command line flags whose value, in the next
+	// argument, is a credential.
+	sensitiveFlag = regexp.MustCompile(`(?i)^--?[\w.-]*(?:` + sensitiveWords + `)[\w.-]*$`)
+
+	// sensitiveFlagValue matches such flags followed by their value in a
+	// command string.
+	sensitiveFlagValue = regexp.MustCompile(`(?i)(\s--?[\w.-]*(?:` + sensitiveWords + `)[\w.-]*\s+)([^\s-]\S*)`)
+
+	// authHeader matches Authorization headers, whose value holds a space
+	authHeader = regexp.MustCompile(`(?i)(authorization:\s*)[^\s'"][^'"\n]*`)
+
+	// urlPattern matches URLs in commands
+	urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s'"]+`)
+)
+
+// configInfo is the JSON representation of the active configuration served
+// by /api/v1/config.
+type configInfo struct {
+	Handlers        map[string]handlerConfig `json:"handlers"`
+	SpecialHandlers specialHandlersConfig    `json:"special_handlers"`
+	Defaults        defaultsConfig           `json:"defaults"`
+	HandlerSource   []string                 `json:"handler_source,omitempty"`
+	Receivers       map[string]string        `json:"receivers,omitempty"`
+	Pools           map[string]int           `json:"pools,omitempty"`
+	Include         []string                 `json:"include,omitempty"`
+	TemplateFiles   []string                 `json:"template_files,omitempty"`
+}
+
+type specialHandlersConfig struct {
+	Default  string `json:"default"`
+	All      string `json:"all"`
+	Flapping string `json:"flapping"`
+}
+
+type defaultsConfig struct {
+	Timeout string            `json:"timeout,omitempty"`
+	Status  string            `json:"status,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Workdir string            `json:"workdir,omitempty"`
+	Shell   *bool             `json:"shell,omitempty"`
+
+	StrictTemplates *bool `json:"strict_templates,omitempty"`
+}
+
+// handlerConfig is a handler after defaults have been applied.
+type handlerConfig struct {
+	Command interface{}       `json:"command,omitempty"`
+	Group   []string          `json:"group,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Workdir string            `json:"workdir,omitempty"`
+	Stdin   string            `json:"stdin,omitempty"`
+	Payload string            `json:"payload,omitempty"`
+	Scope   string            `json:"scope"`
+	Runner  string            `json:"runner"`
+	Docker  *DockerRunner     `json:"docker,omitempty"`
+	SSH     *SSHRunner        `json:"ssh,omitempty"`
+	Systemd *SystemdRunner    `json:"systemd,omitempty"`
+	Sandbox *Sandbox          `json:"sandbox,omitempty"`
+	Shell   bool              `json:"shell"`
+	Enabled bool              `json:"enabled"`
+	Status  string            `json:"status"`
+	Timeout string            `json:"timeout"`
+	Overlap string            `json:"overlap"`
+	Windows []Window          `json:"windows,omitempty"`
+
+	Pipeline []string `json:"pipeline,omitempty"`
+
+	KillGrace string `json:"kill_grace"`
+
+	SerializeOn string `json:"serialize_on,omitempty"`
+	Lockfile    string `json:"lockfile,omitempty"`
+
+	MaxOutputBytes int    `json:"max_output_bytes,omitempty"`
+	MaxMemory      uint64 `json:"max_memory,omitempty"`
+	MaxCPU         string `json:"max_cpu,omitempty"`
+	MaxOpenFiles   uint64 `json:"max_open_files,omitempty"`
+	Nice           int    `json:"nice,omitempty"`
+	MaxConcurrent  int    `json:"max_concurrent,omitempty"`
+	Pool           string `json:"pool,omitempty"`
+	Retries        int    `json:"retries,omitempty"`
+	RetryOn        []int  `json:"retry_on,omitempty"`
+	Ignore         []int  `json:"ignore,omitempty"`
+
+	CgroupMemory uint64  `json:"cgroup_memory,omitempty"`
+	CgroupCPU    float64 `json:"cgroup_cpu,omitempty"`
+
+	CircuitFailures int    `json:"circuit_failures,omitempty"`
+	CircuitCooldown string `json:"circuit_cooldown,omitempty"`
+	Cooldown        string `json:"cooldown,omitempty"`
+	WaitFor         string `json:"wait_for,omitempty"`
+	CancelOnResolve bool   `json:"cancel_on_resolve,omitempty"`
+
+	Callback string `json:"callback,omitempty"`
+
+	StdinTemplate string `json:"stdin_template,omitempty"`
+
+	StrictTemplates bool `json:"strict_templates"`
+}
+
+// redactEnv copies env replacing every value other than secret references
+// as those are only pointers to the secret.
+func redactEnv(env map[string]string) map[string]string {
+	if len(env) == 0 {
+		return nil
+	}
+	result := make(map[string]string)
+	for k, v := range env {
+		if secretRef.ReplaceAllString(v, "") != "" {
+			v = redacted
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// isSecretRef returns true if v only holds secret references, which are
+// pointers to secrets rather than their values.
+func isSecretRef(v string) bool {
+	return secretRef.ReplaceAllString(v, "") == ""
+}
+
+// redactURL returns u with everything but its scheme and host redacted as
+// paths, queries, and user info often hold tokens.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return redacted
+	}
+	if parsed.User == nil && strings.Trim(parsed.Path, "/") == "" &&
+		parsed.RawQuery == "" && parsed.Fragment == "" {
+		return u
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/" + redacted
+}
+
+// redactSecrets replaces what looks like credentials in the command s:
+// the values of sensitive flags and key=value pairs and URLs beyond their
+// host.  Secret references are kept.
+func redactSecrets(s string) string {
+	keep := func(v string) bool {
+		return strings.HasPrefix(v, "//") || isSecretRef(v)
+	}
+	s = authHeader.ReplaceAllString(s, "${1}"+redacted)
+	s = sensitiveAssignment.ReplaceAllStringFunc(s, func(m string) string {
+		parts := sensitiveAssignment.FindStringSubmatch(m)
+		if keep(parts[2]) || parts[2] == redacted {
+			return m
+		}
+		return parts[1] + redacted
+	})
+	s = sensitiveFlagValue.ReplaceAllStringFunc(s, func(m string) string {
+		parts := sensitiveFlagValue.FindStringSubmatch(m)
+		if isSecretRef(parts[2]) {
+			return m
+		}
+		return parts[1] + redacted
+	})
+	return urlPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if isSecretRef(m) || strings.Contains(m, redacted) {
+			return m
+		}
+		return redactURL(m)
+	})
+}
+
+// redactArgs applies redactSecrets to each of args and also redacts the
+// values following sensitive flags and, as with env, the values of
+// variables passed with -e or --env.
+func redactArgs(args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+	result := make([]string, len(args))
+	for i, a := range args {
+		var prev string
+		if i > 0 {
+			prev = args[i-1]
+		}
+		switch {
+		case isSecretRef(a):
+			result[i] = a
+		case sensitiveFlag.MatchString(prev):
+			result[i] = redacted
+		case prev == "-e" || prev == "--env":
+			result[i] = redactVariable(a)
+		case strings.HasPrefix(a, "--env="):
+			result[i] = "--env=" + redactVariable(strings.TrimPrefix(a, "--env="))
+		default:
+			result[i] = redactSecrets(a)
+		}
+	}
+	return result
+}
+
+// redactVariable redacts the value of the NAME=value assignment v.
+func redactVariable(v string) string {
+	i := strings.Index(v, "=")
+	if i < 0 || isSecretRef(v[i+1:]) {
+		return v
+	}
+	return v[:i+1] + redacted
+}
+
+// newConfigInfo builds the JSON representation of cfg.
+func newConfigInfo(cfg *Configuration) configInfo {
+	info := configInfo{
+		Handlers: make(map[string]handlerConfig),
+		SpecialHandlers: specialHandlersConfig{
+			Default:  cfg.defaultHandler(),
+			All:      cfg.allHandler(),
+			Flapping: cfg.flappingHandler(),
+		},
+		Defaults: defaultsConfig{
+			Status:  string(cfg.Defaults.Status),
+			Env:     redactEnv(cfg.Defaults.Env),
+			Workdir: cfg.Defaults.Workdir,
+			Shell:   cfg.Defaults.Shell,
+
+			StrictTemplates: cfg.Defaults.StrictTemplates,
+		},
+		HandlerSource: cfg.HandlerSource,
+		Receivers:     cfg.Receivers,
+		Pools:         cfg.Pools,
+		Include:       cfg.Include,
+		TemplateFiles: cfg.templateFiles,
+	}
+	if cfg.Defaults.Timeout > 0 {
+		info.Defaults.Timeout = cfg.Defaults.Timeout.String()
+	}
+
+	for name, h := range cfg.Handlers {
+		hc := handlerConfig{
+			Group:   h.Group,
+			Env:     redactEnv(h.Env),
+			Workdir: h.Workdir,
+			Stdin:   h.Stdin,
+			Payload: h.Payload,
+			Scope:   h.Scope,
+			Runner:  h.Runner,
+			Docker:  redactDocker(h.Docker),
+			SSH:     redactSSH(h.SSH),
+			Systemd: h.Systemd,
+			Sandbox: h.Sandbox,
+			Shell:   h.shell(),
+			Enabled: h.enabled(),
+			Status:  string(h.status()),
+			Timeout: h.timeout().String(),
+			Overlap: h.Overlap,
+			Windows: h.Windows,
+
+			Pipeline: h.Pipeline,
+
+			CancelOnResolve: h.CancelOnResolve,
+
+			Callback: redactCallback(h.Callback),
+
+			StdinTemplate: h.StdinTemplate,
+
+			StrictTemplates: h.strict(),
+
+			KillGrace: h.killGrace().String(),
+
+			SerializeOn: h.SerializeOn,
+			Lockfile:    h.Lockfile,
+
+			MaxOutputBytes: h.MaxOutputBytes,
+			MaxMemory:      h.MaxMemory,
+			MaxOpenFiles:   h.MaxOpenFiles,
+			Nice:           h.Nice,
+			MaxConcurrent:  h.MaxConcurrent,
+			Pool:           h.Pool,
+			Retries:        h.Retries,
+			RetryOn:        h.RetryOn,
+			Ignore:         h.Ignore,
+
+			CgroupMemory: h.CgroupMemory,
+			CgroupCPU:    h.CgroupCPU,
+
+			CircuitFailures: h.CircuitFailures,
+		}
+		if len(h.Args) > 0 {
+			hc.Command = redactArgs(h.Args)
+		} else if h.Command != "" {
+			hc.Command = redactSecrets(h.Command)
+		}
+		if hc.Overlap == "" {
+			hc.Overlap = "queue"
+		}
+		if hc.Scope == "" {
+			hc.Scope = "alert"
+		}
+		if hc.Runner == "" {
+			hc.Runner = "local"
+		}
+		if h.MaxCPU > 0 {
+			hc.MaxCPU = h.MaxCPU.String()
+		}
+		if h.CircuitFailures > 0 {
+			hc.CircuitCooldown = h.circuitCooldown().String()
+		}
+		if h.Cooldown > 0 {
+			hc.Cooldown = h.Cooldown.String()
+		}
+		if h.WaitFor > 0 {
+			hc.WaitFor = h.WaitFor.String()
+		}
+		info.Handlers[name] = hc
+	}
+
+	return info
+}
+
+// redactDocker returns a copy of d with its options redacted.
+func redactDocker(d *DockerRunner) *DockerRunner {
+	if d == nil {
+		return nil
+	}
+	c := *d
+	c.Options = redactArgs(d.Options)
+	return &c
+}
+
+// redactSSH returns a copy of s with its options redacted.
+func redactSSH(s *SSHRunner) *SSHRunner {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.Options = redactArgs(s.Options)
+	return &c
+}
+
+// redactCallback returns the callback URL u redacted.
+func redactCallback(u string) string {
+	if u == "" {
+		return ""
+	}
+	return redactURL(u)
+}
+
+// effectiveConfig returns the active configuration as JSON with values that
+// may be credentials redacted.
+func effectiveConfig(writer http.ResponseWriter, r *http.Request) {
+	w := NewStatusResponseWriter(writer)
+	defer logRequest(w, r)
+
+	if r.Method != "GET" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+
+	blob, err := json.Marshal(newConfigInfo(getConfig()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
+
+// logLevelInfo is the JSON representation of the log level served by
+// /api/v1/loglevel.
+type logLevelInfo struct {
+	Level string `json:"level"`
+}
+
+// logLevelHandler returns the log level on GET and changes it on PUT.
+func logLevelHandler(writer http.ResponseWriter, r *http.Request) {
+	w := NewStatusResponseWriter(writer)
+	defer logRequest(w, r)
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		info := logLevelInfo{}
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			http.Error(w, "Error parsing JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		level, err := parseLogLevel(info.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Changing log level from %s to %s", getLogLevel(), info.Level)
+		setLogLevel(level)
+	default:
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+
+	blob, err := json.Marshal(logLevelInfo{Level: getLogLevel()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
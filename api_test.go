@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	orig := getConfig()
+	defer setConfig(orig)
+
+	cfg, err := loadConfiguration("testdata/defaults.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Handlers["secret"] = Handler{
+		Args: []string{"/usr/local/bin/page", "{{ .Labels.team }}"},
+		Env:  map[string]string{"TOKEN": "secret://env/PAGER_TOKEN"},
+
+		Callback: "https://hooks.example.com/services/T0/B0/XYZ",
+		Runner:   "docker",
+		Docker:   &DockerRunner{Image: "pager", Options: []string{"-e", "API_KEY=abc"}},
+	}
+	setConfig(cfg)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/v1/config", bind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Bad Status from /api/v1/config: %d", resp.StatusCode)
+	}
+
+	var info struct {
+		Handlers map[string]struct {
+			Command interface{}
+			Env     map[string]string
+			Timeout string
+			Status  string
+
+			Callback string
+			Docker   struct {
+				Options []string
+			}
+		}
+		Defaults struct {
+			Env map[string]string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	h := info.Handlers["inherit"]
+	if h.Timeout != "30s" || h.Status != "*" {
+		t.Errorf("Defaults not applied to handler: %#v", h)
+	}
+	if h.Env["TEAM"] != redacted || info.Defaults.Env["TEAM"] != redacted {
+		t.Errorf("Environment values should be redacted: %#v %#v", h.Env, info.Defaults.Env)
+	}
+	h = info.Handlers["secret"]
+	if h.Env["TOKEN"] != "secret://env/PAGER_TOKEN" {
+		t.Errorf("Secret references should not be redacted: %#v", h.Env)
+	}
+	if h.Callback != "https://hooks.example.com/"+redacted {
+		t.Errorf("Callback URL should be redacted: %s", h.Callback)
+	}
+	if len(h.Docker.Options) != 2 || h.Docker.Options[1] != "API_KEY="+redacted {
+		t.Errorf("Docker options should be redacted: %q", h.Docker.Options)
+	}
+	if args, ok := h.Command.([]interface{}); !ok || len(args) != 2 {
+		t.Errorf("Command list not returned as a list: %#v", h.Command)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	tests := map[string]string{
+		"/usr/bin/page {{ .Labels.team }}":                      "/usr/bin/page {{ .Labels.team }}",
+		"curl -H 'Authorization: Bearer abc' https://x.io/hook": "curl -H 'Authorization: <redacted>' https://x.io/<redacted>",
+		"deploy --token=abc123 --host db1":                      "deploy --token=<redacted> --host db1",
+		"deploy --password hunter2 --host db1":                  "deploy --password <redacted> --host db1",
+		"notify https://user:pw@chat.example.com/":              "notify https://chat.example.com/<redacted>",
+		"notify https://chat.example.com/":                      "notify https://chat.example.com/",
+		"page TOKEN=secret://env/PAGER_TOKEN":                   "page TOKEN=secret://env/PAGER_TOKEN",
+	}
+	for command, expect := range tests {
+		if got := redactSecrets(command); got != expect {
+			t.Errorf("redactSecrets(%q) = %q, expected %q", command, got, expect)
+		}
+	}
+
+	args := redactArgs([]string{"-e", "API_KEY=abc", "-e", "TOKEN=secret://env/T", "--env=REGION=eu",
+		"--api-key", "abc", "--host", "db1"})
+	expect := []string{"-e", "API_KEY=<redacted>", "-e", "TOKEN=secret://env/T", "--env=REGION=<redacted>",
+		"--api-key", "<redacted>", "--host", "db1"}
+	if !reflect.DeepEqual(args, expect) {
+		t.Errorf("Unexpected redacted arguments: %q", args)
+	}
+}
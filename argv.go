@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"unicode"
 )
 
@@ -84,3 +85,43 @@ func Tokenize(s string) ([]string, error) {
 	chunk()
 	return result, nil
 }
+
+// SplitHandlers splits a handler annotation into the individual handler
+// invocations separated by sep and then splits each invocation around
+// white space.  An occurrence of sep preceded by a backslash does not split
+// the annotation and is replaced by sep alone.  Empty invocations are
+// dropped unless the entire annotation is empty.
+func SplitHandlers(s, sep string) [][]string {
+	var (
+		result  [][]string
+		current []byte
+	)
+
+	chunk := func() {
+		if fields := strings.Fields(string(current)); len(fields) > 0 {
+			result = append(result, fields)
+		}
+		current = nil
+	}
+
+	for i := 0; i < len(s); {
+		switch {
+		case sep != "" && strings.HasPrefix(s[i:], "\\"+sep):
+			current = append(current, sep...)
+			i += len(sep) + 1
+		case sep != "" && strings.HasPrefix(s[i:], sep):
+			chunk()
+			i += len(sep)
+		default:
+			current = append(current, s[i])
+			i++
+		}
+	}
+	chunk()
+
+	if len(result) == 0 {
+		// Preserve the empty handler so it is reported
+		return [][]string{{}}
+	}
+	return result
+}
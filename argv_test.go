@@ -45,7 +45,7 @@ func TestTokenize(t *testing.T) {
 		}
 		t.Logf("%s => %s", k, tokens)
 		if !equal(v, tokens) {
-			t.Errorf("%t != computed: %t", v, tokens)
+			t.Errorf("%v != computed: %v", v, tokens)
 		}
 	}
 }
@@ -66,3 +66,36 @@ func TestTokenizeError(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitHandlers(t *testing.T) {
+	var tests = []struct {
+		annotation string
+		sep        string
+		expected   [][]string
+	}{
+		{"restart host1", ";", [][]string{{"restart", "host1"}}},
+		{"restart host1; page sre", ";", [][]string{{"restart", "host1"}, {"page", "sre"}}},
+		{"restart host1;page sre;", ";", [][]string{{"restart", "host1"}, {"page", "sre"}}},
+		{"restart host1 | page sre;oncall", "|", [][]string{{"restart", "host1"}, {"page", "sre;oncall"}}},
+		{"restart host1 && page sre", "&&", [][]string{{"restart", "host1"}, {"page", "sre"}}},
+		{"echo a\\;b; page sre", ";", [][]string{{"echo", "a;b"}, {"page", "sre"}}},
+		{"echo a\\|b | page", "|", [][]string{{"echo", "a|b"}, {"page"}}},
+		{"", ";", [][]string{{}}},
+	}
+
+	for _, test := range tests {
+		result := SplitHandlers(test.annotation, test.sep)
+		t.Logf("%s => %v", test.annotation, result)
+		if len(result) != len(test.expected) {
+			t.Errorf("%q split on %q: %v != computed: %v", test.annotation,
+				test.sep, test.expected, result)
+			continue
+		}
+		for i := range result {
+			if !equal(result[i], test.expected[i]) {
+				t.Errorf("%q split on %q: %v != computed: %v", test.annotation,
+					test.sep, test.expected, result)
+			}
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// audit is the global audit sink.  It is nil when auditing is disabled.
+var audit *AuditSink
+
+// AuditOutcome records the result of running a single handler for a
+// single alert.
+type AuditOutcome struct {
+	Alertname string `json:"alertname"`
+	Status    string `json:"status"`
+	Handler   string `json:"handler"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+// AuditRecord is the JSON document POST'd to the audit endpoint for every
+// processed AlertManagerEvent.
+type AuditRecord struct {
+	Timestamp string         `json:"timestamp"`
+	Instance  string         `json:"instance,omitempty"`
+	Receiver  string         `json:"receiver"`
+	Status    string         `json:"status"`
+	Outcomes  []AuditOutcome `json:"outcomes"`
+}
+
+// newAuditRecord builds an empty AuditRecord for the given event.
+func newAuditRecord(e *AlertManagerEvent) *AuditRecord {
+	return &AuditRecord{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Instance:  instanceLabel,
+		Receiver:  e.Receiver,
+		Status:    e.Status,
+	}
+}
+
+// add appends the outcome of running handler against alert to the record.
+func (r *AuditRecord) add(alert Alert, handler []string, err error) {
+	o := AuditOutcome{
+		Alertname: alert.name(),
+		Status:    alert.Status,
+		Success:   err == nil,
+	}
+	if len(handler) > 0 {
+		o.Handler = handler[0]
+	}
+	if err != nil {
+		o.Error = err.Error()
+	}
+	r.Outcomes = append(r.Outcomes, o)
+}
+
+// AuditSink asynchronously delivers AuditRecords to an HTTP endpoint.
+// Records that cannot be delivered after the configured number of retries
+// are written to a spool directory and re-sent once the endpoint recovers.
+type AuditSink struct {
+	// URL is the endpoint audit records are POST'd to
+	URL string
+
+	// Spool is the directory undeliverable records are written to.  An
+	// empty string disables spooling and such records are dropped.
+	Spool string
+
+	// Retries is the number of delivery attempts made for each record
+	Retries int
+
+	// Backoff is the delay before the first retry.  It doubles after each
+	// failed attempt.
+	Backoff time.Duration
+
+	// DrainInterval is how often the spool is checked for records to
+	// re-send.
+	DrainInterval time.Duration
+
+	client   *http.Client
+	queue    chan []byte
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewAuditSink returns an AuditSink for url spooling to the spool directory.
+// Call Start() to begin delivering records.
+func NewAuditSink(url, spool string) *AuditSink {
+	return &AuditSink{
+		URL:           url,
+		Spool:         spool,
+		Retries:       5,
+		Backoff:       time.Second,
+		DrainInterval: time.Minute,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		queue:         make(chan []byte, 1024),
+		stop:          make(chan struct{}),
+	}
+}
+
+// Start launches the goroutine that delivers queued records.
+func (s *AuditSink) Start() error {
+	if s.Spool != "" {
+		if err := os.MkdirAll(s.Spool, 0700); err != nil {
+			return err
+		}
+	}
+	s.done = make(chan struct{})
+	go s.run()
+	return nil
+}
+
+// Stop delivers the records still queued, spooling those that cannot be
+// delivered at once, and waits for the delivery goroutine to exit.
+// Records sent afterwards are spooled.
+func (s *AuditSink) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	if s.done != nil {
+		<-s.done
+	}
+}
+
+// Send queues record for delivery.  It never blocks: if the queue is full
+// the record is written directly to the spool.
+func (s *AuditSink) Send(record *AuditRecord) {
+	blob, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error: Could not marshal audit record: %s", err)
+		return
+	}
+
+	select {
+	case <-s.stop:
+		// Nothing delivers queued records any more
+		s.spool(blob)
+		return
+	default:
+	}
+
+	select {
+	case s.queue <- blob:
+	default:
+		log.Printf("Audit queue is full, spooling record")
+		s.spool(blob)
+	}
+}
+
+// run is the delivery loop.
+func (s *AuditSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.DrainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case blob := <-s.queue:
+			if s.deliver(blob) {
+				s.drain()
+			} else {
+				s.spool(blob)
+			}
+		case <-ticker.C:
+			s.drain()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush makes a single delivery attempt for each record still queued.
+// After the first failure the remaining records are spooled.
+func (s *AuditSink) flush() {
+	failed := false
+	for {
+		select {
+		case blob := <-s.queue:
+			if failed || s.post(blob) != nil {
+				failed = true
+				s.spool(blob)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// deliver attempts to POST blob to the audit endpoint with bounded retries
+// and exponential backoff.  It returns true on success and gives up early
+// when the sink is stopped.
+func (s *AuditSink) deliver(blob []byte) bool {
+	backoff := s.Backoff
+	for i := 0; i < s.Retries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				return false
+			}
+			backoff *= 2
+		}
+		err := s.post(blob)
+		if err == nil {
+			return true
+		}
+		log.Printf("Audit delivery attempt %d/%d failed: %s", i+1, s.Retries, err)
+	}
+
+	return false
+}
+
+// post makes a single delivery attempt.
+func (s *AuditSink) post(blob []byte) error {
+	resp, err := s.client.Post(s.URL, "application/json", bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Audit endpoint returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// spool writes blob to the spool directory.
+func (s *AuditSink) spool(blob []byte) {
+	if s.Spool == "" {
+		log.Printf("Error: Dropping undeliverable audit record: %s", string(blob))
+		return
+	}
+
+	name := filepath.Join(s.Spool, fmt.Sprintf("%d.json", time.Now().UnixNano()))
+	// Write to a temporary file and rename so drain() never sees a
+	// partially written record.
+	if err := ioutil.WriteFile(name+".tmp", blob, 0600); err != nil {
+		log.Printf("Error: Could not spool audit record: %s", err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		log.Printf("Error: Could not spool audit record: %s", err)
+	}
+}
+
+// drain re-sends spooled records in the order they were written.  It stops
+// at the first record that cannot be delivered.
+func (s *AuditSink) drain() {
+	if s.Spool == "" {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.Spool, "*.json"))
+	if err != nil {
+		log.Printf("Error: Could not read audit spool: %s", err)
+		return
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		blob, err := ioutil.ReadFile(f)
+		if err != nil {
+			log.Printf("Error: Could not read spooled audit record %s: %s", f, err)
+			continue
+		}
+		if err := s.post(blob); err != nil {
+			return
+		}
+		if err := os.Remove(f); err != nil {
+			log.Printf("Error: Could not remove spooled audit record %s: %s", f, err)
+		}
+	}
+}
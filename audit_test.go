@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuditDelivery(t *testing.T) {
+	var lock sync.Mutex
+	var failures int
+	var records []AuditRecord
+
+	// The first 3 requests fail which exhausts the retries and forces the
+	// record through the spool.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures < 3 {
+			failures++
+			http.Error(w, "Flaky", http.StatusServiceUnavailable)
+			return
+		}
+		record := AuditRecord{}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &record); err != nil {
+			t.Errorf("Audit record is not valid JSON: %s", err)
+		}
+		records = append(records, record)
+	}))
+	defer server.Close()
+
+	spool, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	sink := NewAuditSink(server.URL, spool)
+	sink.Retries = 2
+	sink.Backoff = 10 * time.Millisecond
+	sink.DrainInterval = 50 * time.Millisecond
+	if err := sink.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Holodeck safeties are on
+	debug = true
+	audit = sink
+	defer func() { audit = nil }()
+
+	buf, err := ioutil.ReadFile("testdata/test3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := unmarshalBody(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handleEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		lock.Lock()
+		n := len(records)
+		lock.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 delivered audit record, got %d", len(records))
+	}
+	if len(records[0].Outcomes) != 1 {
+		t.Fatalf("Expected 1 outcome in audit record: %#v", records[0])
+	}
+	o := records[0].Outcomes[0]
+	if o.Handler != "restartprometheus" || !o.Success {
+		t.Errorf("Unexpected audit outcome: %#v", o)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(spool, "*.json"))
+	if len(files) != 0 {
+		t.Errorf("Audit spool was not drained: %v", files)
+	}
+}
+
+func TestAuditStop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Down", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	spool, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	sink := NewAuditSink(server.URL, spool)
+	sink.Retries = 3
+	sink.Backoff = time.Hour
+	if err := sink.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// One record waits to be retried and another in the queue
+	sink.Send(&AuditRecord{Receiver: "retrying"})
+	time.Sleep(100 * time.Millisecond)
+	sink.Send(&AuditRecord{Receiver: "queued"})
+
+	start := time.Now()
+	sink.Stop()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Stop waited for the retry, took %s", elapsed)
+	}
+	sink.Send(&AuditRecord{Receiver: "late"})
+
+	files, _ := filepath.Glob(filepath.Join(spool, "*.json"))
+	if len(files) != 3 {
+		t.Errorf("Expected 3 spooled audit records, got %v", files)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// basicAuthUser and basicAuthPasswordFile configure a single user
+	// allowed to make requests
+	basicAuthUser         string
+	basicAuthPasswordFile string
+
+	// htpasswdFile is an Apache htpasswd file of the users allowed to make
+	// requests
+	htpasswdFile string
+
+	// auth holds the users allowed to make requests.  It is nil when
+	// authentication is disabled.
+	auth *basicAuth
+)
+
+// basicAuth verifies HTTP Basic authentication credentials.
+type basicAuth struct {
+	// users maps a user name to a function checking their password
+	users map[string]func(password string) bool
+}
+
+// loadBasicAuth builds the users allowed to make requests from the
+// -basic-auth-* and -htpasswd flags.  It returns nil when none are set.
+func loadBasicAuth() (*basicAuth, error) {
+	if basicAuthUser == "" && htpasswdFile == "" {
+		return nil, nil
+	}
+	b := &basicAuth{users: make(map[string]func(string) bool)}
+
+	if basicAuthUser != "" {
+		if basicAuthPasswordFile == "" {
+			return nil, fmt.Errorf("-basic-auth-user requires -basic-auth-password-file")
+		}
+		buf, err := ioutil.ReadFile(basicAuthPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		want := sha256.Sum256([]byte(strings.TrimRight(string(buf), "\r\n")))
+		b.users[basicAuthUser] = func(password string) bool {
+			got := sha256.Sum256([]byte(password))
+			return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+		}
+	}
+
+	if htpasswdFile != "" {
+		if err := b.loadHtpasswd(htpasswdFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// loadHtpasswd adds the users in an htpasswd file.  Passwords must be
+// hashed with bcrypt (htpasswd -B) or SHA1 (htpasswd -s).
+func (b *basicAuth) loadHtpasswd(file string) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: expected user:hash", file, n)
+		}
+		user, hash := line[:i], line[i+1:]
+
+		switch {
+		case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"),
+			strings.HasPrefix(hash, "$2y$"):
+			b.users[user] = func(password string) bool {
+				return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+			}
+		case strings.HasPrefix(hash, "{SHA}"):
+			want := hash[len("{SHA}"):]
+			b.users[user] = func(password string) bool {
+				sum := sha1.Sum([]byte(password))
+				got := base64.StdEncoding.EncodeToString(sum[:])
+				return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+			}
+		default:
+			return fmt.Errorf("%s:%d: unsupported password hash for user %s, use bcrypt",
+				file, n, user)
+		}
+	}
+	return scanner.Err()
+}
+
+// check returns true if user and password are valid credentials.
+func (b *basicAuth) check(user, password string) bool {
+	verify, ok := b.users[user]
+	return ok && verify(password)
+}
+
+// requireAuth wraps handler so that requests must carry valid Basic
+// authentication credentials when authentication is enabled.  With rate
+// limiting, each failed attempt takes a token from the bucket of the
+// client's IP address and once that is empty its requests are refused
+// without checking their credentials.
+func requireAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if auth != nil {
+			l, key := limiter, authFailureKey(r)
+			if l != nil {
+				if ok, wait := l.check(key, time.Now()); !ok {
+					tooManyRequests(writer, r, wait)
+					return
+				}
+			}
+			user, password, ok := r.BasicAuth()
+			if !ok || !auth.check(user, password) {
+				if l != nil {
+					l.allow(key, time.Now())
+				}
+				w := NewStatusResponseWriter(writer)
+				defer logRequest(w, r)
+				w.Header().Set("WWW-Authenticate", `Basic realm="am-event-handler"`)
+				http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(writer, r)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The SHA1 entry is "htpasswd -nbs sha sha"
+	htpasswd := "# Alertmanager\nalertmanager:" + string(hash) + "\n" +
+		"sha:{SHA}2PRZAyDhNDqRW2OUFwZQqPNdaSY=\n"
+	htpasswdFile = filepath.Join(dir, "htpasswd")
+	basicAuthUser = "admin"
+	basicAuthPasswordFile = filepath.Join(dir, "password")
+	defer func() { htpasswdFile, basicAuthUser, basicAuthPasswordFile = "", "", "" }()
+	if err := ioutil.WriteFile(htpasswdFile, []byte(htpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(basicAuthPasswordFile, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err = loadBasicAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auth = nil }()
+
+	ts := httptest.NewServer(requireAuth(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	var tests = []struct {
+		user, password string
+		code           int
+	}{
+		{"alertmanager", "secret", 200},
+		{"sha", "sha", 200},
+		{"admin", "hunter2", 200},
+		{"alertmanager", "wrong", 401},
+		{"nobody", "secret", 401},
+		{"", "", 401},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", ts.URL, nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("User %q: expected status %d, got %d", test.user, test.code, resp.StatusCode)
+		}
+	}
+
+	if err := ioutil.WriteFile(htpasswdFile, []byte("md5:$apr1$abc$def\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBasicAuth(); err == nil {
+		t.Errorf("Unsupported password hash should be an error")
+	}
+}
+
+func TestAuthFailuresRateLimited(t *testing.T) {
+	auth = &basicAuth{users: map[string]func(string) bool{
+		"alertmanager": func(password string) bool { return password == "secret" },
+	}}
+	defer func() { auth = nil }()
+	limiter = newRateLimiter(0.5, 2)
+	defer func() { limiter = nil }()
+
+	handler := requireAuth(rateLimit(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(remote, password string) int {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = remote
+		r.SetBasicAuth("alertmanager", password)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := request("10.0.0.1:1234", "guess"); code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for a wrong password, got %d", code)
+		}
+	}
+	if code := request("10.0.0.1:1234", "guess"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 after repeated failed attempts, got %d", code)
+	}
+	if code := request("10.0.0.1:1234", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("Credentials checked for a client over the failure limit: %d", code)
+	}
+	if code := request("10.0.0.2:1234", "secret"); code != http.StatusOK {
+		t.Errorf("Request from another client was limited: %d", code)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// callbackAttempts is the number of times delivery of a callback is tried.
+const callbackAttempts = 3
+
+var (
+	// callbackURL receives the results of handlers that do not set their
+	// own callback.  Empty disables such callbacks.
+	callbackURL string
+
+	// callbackClient POSTs callbacks
+	callbackClient = &http.Client{Timeout: 10 * time.Second}
+
+	// callbackBackoff is the delay before retrying a failed callback.  It
+	// doubles after each failed attempt.
+	callbackBackoff = time.Second
+)
+
+// callbackResult is the JSON document POST'd to a handler's callback URL
+// after it has run for an alert.
+type callbackResult struct {
+	Timestamp string `json:"timestamp"`
+	Instance  string `json:"instance,omitempty"`
+	Receiver  string `json:"receiver"`
+	RequestID string `json:"request_id,omitempty"`
+	Alert     Alert  `json:"alert"`
+	handlerResult
+}
+
+// callback returns the URL the handler's results are POST'd to, if any.
+func (h Handler) callback() string {
+	if h.Callback != "" {
+		return h.Callback
+	}
+	return callbackURL
+}
+
+// checkCallbackURL returns an error unless u is an absolute HTTP URL.
+func checkCallbackURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%s is not an http or https URL", u)
+	}
+	return nil
+}
+
+// sendCallback POSTs result, the outcome of running a handler for alert,
+// to u in the background.  Failed deliveries are retried and then logged.
+func (e *AlertManagerEvent) sendCallback(u string, alert Alert, result handlerResult) {
+	blob, err := json.Marshal(callbackResult{
+		Timestamp:     time.Now().UTC().Format(time.RFC3339),
+		Instance:      instanceLabel,
+		Receiver:      e.Receiver,
+		RequestID:     alert.requestID,
+		Alert:         alert,
+		handlerResult: result,
+	})
+	if err != nil {
+		log.Printf("Error: Could not marshal callback of handler %s: %s", result.Handler, err)
+		return
+	}
+
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		backoff := callbackBackoff
+		for attempt := 1; ; attempt++ {
+			err := postCallback(u, blob)
+			if err == nil {
+				return
+			}
+			if attempt == callbackAttempts {
+				log.Printf("Error: Could not deliver callback of handler %s to %s: %s",
+					result.Handler, u, err)
+				return
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}()
+}
+
+// postCallback makes a single delivery attempt of blob to u.
+func postCallback(u string, blob []byte) error {
+	resp, err := callbackClient.Post(u, "application/json", bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Callback endpoint returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCallback(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	results := make(chan callbackResult, 4)
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var result callbackResult
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			t.Errorf("Invalid callback: %s", err)
+		}
+		results <- result
+	}))
+	defer server.Close()
+
+	backoff := callbackBackoff
+	callbackBackoff = time.Millisecond
+	defer func() { callbackBackoff = backoff }()
+
+	config.Handlers["called-back"] = Handler{Command: "echo remediated", Callback: server.URL}
+	defer delete(config.Handlers, "called-back")
+
+	e := &AlertManagerEvent{Receiver: "callbacks"}
+	alert := Alert{
+		Status:      "firing",
+		Labels:      map[string]string{"alertname": "CallMeBack"},
+		Annotations: map[string]string{"handler": "called-back"},
+	}
+	e.handleAlert(context.Background(), config, alert, newAuditRecord(e))
+
+	select {
+	case result := <-results:
+		if result.Handler != "called-back" || result.ExitCode != 0 || result.Output != "remediated\n" {
+			t.Errorf("Unexpected callback result: %#v", result)
+		}
+		if result.Receiver != "callbacks" || result.Alert.name() != "CallMeBack" {
+			t.Errorf("Callback is missing the alert: %#v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No callback received")
+	}
+
+	// Dry runs send no callback
+	e.handleAlert(withDryRun(context.Background()), config, alert, newAuditRecord(e))
+	pending.Wait()
+	if len(results) != 0 {
+		t.Errorf("Dry run sent a callback")
+	}
+
+	if err := checkCallbackURL("ftp://example.com/"); err == nil {
+		t.Errorf("Non-HTTP callback URL accepted")
+	}
+}
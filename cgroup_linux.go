@@ -0,0 +1,153 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cgroupSeq numbers the cgroups created for commands.
+var cgroupSeq uint64
+
+// cpuPeriod is the cpu.max period in microseconds.
+const cpuPeriod = 100000
+
+// cgroup is the transient cgroup v2 a single command runs in.
+type cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// setupCgroups checks that -cgroup-root is a cgroup v2 directory and
+// enables the memory and cpu controllers, where available, for the
+// cgroups created below it.
+func setupCgroups() error {
+	if cgroupRoot == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory: %s", cgroupRoot, err)
+	}
+
+	var enable []string
+	for _, c := range strings.Fields(string(buf)) {
+		if c == "memory" || c == "cpu" {
+			enable = append(enable, "+"+c)
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"),
+		[]byte(strings.Join(enable, " ")), 0644)
+}
+
+// newCgroup creates the cgroup for a command of handler command with its
+// memory.max and cpu.max set.  It returns nil when -cgroup-root is not
+// set.
+func newCgroup(command Handler) (*cgroup, error) {
+	if cgroupRoot == "" {
+		if command.CgroupMemory > 0 || command.CgroupCPU > 0 {
+			return nil, fmt.Errorf("Handler sets cgroup limits but -cgroup-root is not set")
+		}
+		return nil, nil
+	}
+
+	name := fmt.Sprintf("cmd-%d-%d", os.Getpid(), atomic.AddUint64(&cgroupSeq, 1))
+	c := &cgroup{path: filepath.Join(cgroupRoot, name)}
+	if err := os.Mkdir(c.path, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create cgroup: %s", err)
+	}
+
+	var err error
+	if command.CgroupMemory > 0 {
+		err = c.write("memory.max", strconv.FormatUint(command.CgroupMemory, 10))
+	}
+	if err == nil && command.CgroupCPU > 0 {
+		err = c.write("cpu.max", fmt.Sprintf("%d %d",
+			int(command.CgroupCPU*cpuPeriod), cpuPeriod))
+	}
+	if err == nil {
+		c.dir, err = os.Open(c.path)
+	}
+	if err != nil {
+		c.remove()
+		return nil, err
+	}
+	return c, nil
+}
+
+// write sets the cgroup interface file name to value.
+func (c *cgroup) write(name, value string) error {
+	err := ioutil.WriteFile(filepath.Join(c.path, name), []byte(value), 0644)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Could not set %s: controller is not enabled in %s", name, cgroupRoot)
+	} else if err != nil {
+		return fmt.Errorf("Could not set %s: %s", name, err)
+	}
+	return nil
+}
+
+// apply makes cmd start inside the cgroup.
+func (c *cgroup) apply(cmd *exec.Cmd) {
+	if c == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.dir.Fd())
+}
+
+// oomKilled returns true if the memory limit of the cgroup killed a
+// process.
+func (c *cgroup) oomKilled() bool {
+	if c == nil {
+		return false
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(c.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// remove kills any process left in the cgroup and removes it.
+func (c *cgroup) remove() {
+	if c == nil {
+		return
+	}
+	if c.dir != nil {
+		c.dir.Close()
+	}
+	_ = ioutil.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644)
+
+	// Killed processes leave the cgroup asynchronously
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = os.Remove(c.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Printf("Error: Could not remove cgroup %s: %s", c.path, err)
+}
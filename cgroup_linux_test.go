@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted.
+func cgroup2Mount() string {
+	buf, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && fields[2] == "cgroup2" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+func TestCgroup(t *testing.T) {
+	mount := cgroup2Mount()
+	if mount == "" {
+		t.Skip("No cgroup v2 hierarchy")
+	}
+	root, err := ioutil.TempDir(mount, "am-event-handler-test")
+	if err != nil {
+		t.Skipf("cgroup v2 hierarchy is not writable: %s", err)
+	}
+	defer os.Remove(root)
+
+	cgroupRoot = root
+	defer func() { cgroupRoot = "" }()
+	if err := setupCgroups(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	out, err := executeHandler(context.Background(), Handler{}, "/bin/cat", []string{"/proc/self/cgroup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "0::/"+strings.TrimPrefix(root, mount+"/")+"/cmd-") {
+		t.Errorf("Command did not run in a transient cgroup: %s", out.String())
+	}
+	if dirs, _ := filepath.Glob(filepath.Join(root, "cmd-*")); len(dirs) != 0 {
+		t.Errorf("Transient cgroups were not removed: %v", dirs)
+	}
+
+	controllers, _ := ioutil.ReadFile(filepath.Join(root, "cgroup.subtree_control"))
+	handler := Handler{CgroupMemory: 64 * 1024 * 1024, CgroupCPU: 0.5}
+	out, err = executeHandler(context.Background(), handler, "/bin/bash",
+		[]string{"-c", "cat $(sed 's/^0:://; s|^|" + mount + "|' /proc/self/cgroup)/{memory,cpu}.max"})
+	if !strings.Contains(string(controllers), "memory") || !strings.Contains(string(controllers), "cpu") {
+		if err == nil {
+			t.Errorf("cgroup limits without the controllers enabled should fail")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "67108864\n50000 100000\n" {
+		t.Errorf("Unexpected cgroup limits: %q", out.String())
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// cgroup is not supported outside of Linux.
+type cgroup struct{}
+
+// setupCgroups refuses -cgroup-root as cgroups are only supported on
+// Linux.
+func setupCgroups() error {
+	if cgroupRoot != "" {
+		return fmt.Errorf("cgroups are only supported on Linux")
+	}
+	return nil
+}
+
+// newCgroup refuses to run commands with cgroup limits configured.
+func newCgroup(command Handler) (*cgroup, error) {
+	if command.CgroupMemory > 0 || command.CgroupCPU > 0 {
+		return nil, fmt.Errorf("cgroup limits are only supported on Linux")
+	}
+	return nil, nil
+}
+
+func (c *cgroup) apply(cmd *exec.Cmd) {}
+
+func (c *cgroup) oomKilled() bool { return false }
+
+func (c *cgroup) remove() {}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultCircuitCooldown is how long a circuit stays open when the handler
+// does not set circuit_cooldown.
+const defaultCircuitCooldown = 5 * time.Minute
+
+// circuits tracks the consecutive failures of each handler.
+var circuits = newCircuitBreakers()
+
+// circuit is the failure state of a single handler.
+type circuit struct {
+	// failures is the number of consecutive failed executions
+	failures int
+
+	// openUntil is when the circuit lets an execution through again
+	openUntil time.Time
+}
+
+// circuitBreakers stops running handlers that keep failing.  Once a handler
+// fails threshold times in a row its circuit opens and executions are
+// skipped for the cooldown.  After that a single trial execution is let
+// through: success closes the circuit, failure opens it again.
+type circuitBreakers struct {
+	lock     sync.Mutex
+	circuits map[string]*circuit
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{circuits: make(map[string]*circuit)}
+}
+
+// allow returns true if handler name may run at now.  When a cooldown has
+// expired the caller becomes the trial execution and other callers are
+// refused until it reports its result.
+func (c *circuitBreakers) allow(name string, threshold int, cooldown time.Duration, now time.Time) bool {
+	if threshold <= 0 {
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s, ok := c.circuits[name]
+	if !ok || s.failures < threshold {
+		return true
+	}
+	if now.Before(s.openUntil) {
+		return false
+	}
+	s.openUntil = now.Add(cooldown)
+	return true
+}
+
+// record updates the circuit of handler name with the result of an
+// execution that finished at now.
+func (c *circuitBreakers) record(name string, threshold int, cooldown time.Duration, now time.Time, err error) {
+	if threshold <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err == nil {
+		if s, ok := c.circuits[name]; ok && s.failures >= threshold {
+			log.Printf("Circuit for handler %s closed", name)
+		}
+		delete(c.circuits, name)
+		return
+	}
+
+	s, ok := c.circuits[name]
+	if !ok {
+		s = &circuit{}
+		c.circuits[name] = s
+	}
+	s.failures++
+	if s.failures >= threshold {
+		s.openUntil = now.Add(cooldown)
+		log.Printf("Circuit for handler %s open for %s after %d consecutive failures",
+			name, cooldown, s.failures)
+	}
+}
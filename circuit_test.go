@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	c := newCircuitBreakers()
+	now := time.Now()
+	failed := fmt.Errorf("failed")
+
+	for i := 0; i < 2; i++ {
+		if !c.allow("h", 2, time.Minute, now) {
+			t.Fatalf("Circuit opened after %d failures", i)
+		}
+		c.record("h", 2, time.Minute, now, failed)
+	}
+	if c.allow("h", 2, time.Minute, now.Add(30*time.Second)) {
+		t.Errorf("Circuit should be open after 2 consecutive failures")
+	}
+
+	// The first execution after the cooldown is a trial, others wait on it
+	now = now.Add(time.Minute)
+	if !c.allow("h", 2, time.Minute, now) {
+		t.Errorf("Circuit should allow a trial execution after the cooldown")
+	}
+	if c.allow("h", 2, time.Minute, now) {
+		t.Errorf("Circuit should allow only one trial execution")
+	}
+	c.record("h", 2, time.Minute, now, failed)
+	if c.allow("h", 2, time.Minute, now.Add(30*time.Second)) {
+		t.Errorf("Circuit should open again when the trial fails")
+	}
+
+	now = now.Add(time.Minute)
+	if !c.allow("h", 2, time.Minute, now) {
+		t.Errorf("Circuit should allow a trial execution after the cooldown")
+	}
+	c.record("h", 2, time.Minute, now, nil)
+	if !c.allow("h", 2, time.Minute, now) || !c.allow("h", 2, time.Minute, now) {
+		t.Errorf("Circuit should close when the trial succeeds")
+	}
+
+	// A threshold of zero disables the circuit breaker
+	for i := 0; i < 5; i++ {
+		c.record("off", 0, time.Minute, now, failed)
+	}
+	if !c.allow("off", 0, time.Minute, now) {
+		t.Errorf("Disabled circuit breaker refused an execution")
+	}
+}
+
+func TestCircuitSkipsHandler(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["broken"] = Handler{Command: "/bin/false", CircuitFailures: 2}
+	defer delete(config.Handlers, "broken")
+	defer delete(circuits.circuits, "broken")
+
+	alert := Alert{Status: "firing"}
+	for i := 0; i < 2; i++ {
+		if _, err := parseHandler(context.Background(), []string{"broken"}, alert); err == nil {
+			t.Fatalf("Broken handler should fail")
+		}
+	}
+	if _, err := parseHandler(context.Background(), []string{"broken"}, alert); err != nil {
+		t.Errorf("Handler with an open circuit should be skipped, got: %s", err)
+	}
+}
+
+func TestCircuitIgnoresCancelled(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["abandoned"] = Handler{Command: "/bin/sleep 5", CircuitFailures: 1}
+	defer delete(config.Handlers, "abandoned")
+	defer delete(circuits.circuits, "abandoned")
+
+	// As when the client of a streaming request disconnects
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := parseHandler(ctx, []string{"abandoned"}, Alert{Status: "firing"}); err == nil {
+		t.Fatalf("Cancelled handler should fail")
+	}
+	if !circuits.allow("abandoned", 1, time.Minute, clock()) {
+		t.Errorf("Cancelled execution was counted as a failure")
+	}
+}
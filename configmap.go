@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// configMapGeneration returns the generation of the Kubernetes ConfigMap
+// mounted at the configuration path, or an empty string if the path is not
+// a ConfigMap mount.  The kubelet updates a ConfigMap mount by writing the
+// new contents to a timestamped directory and atomically swapping the
+// "..data" symlink to point at it.  The name of that directory is the
+// generation.
+func configMapGeneration(path string) string {
+	if isURL(path) || isConsul(path) {
+		return ""
+	}
+
+	dir := path
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		dir = filepath.Dir(path)
+	}
+	target, err := os.Readlink(filepath.Join(dir, "..data"))
+	if err != nil {
+		return ""
+	}
+	return target
+}
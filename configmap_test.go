@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to use as the log output while other
+// goroutines are logging.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// writeGeneration creates a ConfigMap generation directory holding a
+// config.yaml defining handler and points the ..data symlink at it the same
+// way the kubelet does.
+func writeGeneration(t *testing.T, dir, gen, handler string) {
+	if err := os.Mkdir(filepath.Join(dir, gen), 0755); err != nil {
+		t.Fatal(err)
+	}
+	body := "handlers:\n  " + handler + ":\n    command: /bin/true\n"
+	err := ioutil.WriteFile(filepath.Join(dir, gen, "config.yaml"), []byte(body), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(gen, filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigMapReload(t *testing.T) {
+	orig := getConfig()
+	defer setConfig(orig)
+
+	dir, err := ioutil.TempDir("", "configmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeGeneration(t, dir, "..2017_04_10_12_00_00.000000001", "first")
+	file := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink("..data/config.yaml", file); err != nil {
+		t.Fatal(err)
+	}
+	if gen := configMapGeneration(file); gen != "..2017_04_10_12_00_00.000000001" {
+		t.Fatalf("Wrong ConfigMap generation: %s", gen)
+	}
+	if gen := configMapGeneration("testdata/config.yaml"); gen != "" {
+		t.Errorf("Regular file detected as a ConfigMap: %s", gen)
+	}
+
+	logs := new(syncBuffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfiguration(file, 10*time.Millisecond, stop)
+	time.Sleep(50 * time.Millisecond)
+
+	writeGeneration(t, dir, "..2017_04_10_12_05_00.000000002", "second")
+	logged := func() bool {
+		return strings.Contains(logs.String(), "generation is ..2017_04_10_12_05_00.000000002")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !logged() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := getConfig().Handlers["second"]; !ok {
+		t.Fatalf("ConfigMap update was not reloaded")
+	}
+	if !logged() {
+		t.Errorf("Active ConfigMap generation not logged: %s", logs.String())
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// isConsul reports whether path refers to a configuration stored in Consul.
+func isConsul(path string) bool {
+	return strings.HasPrefix(path, "consul://")
+}
+
+// consulKV is a key as returned by Consul's KV HTTP API.  Value is base64
+// encoded in the JSON and decoded into the byte slice.
+type consulKV struct {
+	Key   string
+	Value []byte
+}
+
+// consulConfig reads handler definitions from a Consul KV prefix given as
+// consul://host:port/prefix.  Each key directly below the prefix is a
+// handler named after the key whose value is the YAML or JSON definition
+// of the handler.  The CONSUL_HTTP_TOKEN environment variable supplies an
+// ACL token.
+type consulConfig struct {
+	URL string
+
+	addr   string
+	prefix string
+	index  string
+	client *http.Client
+}
+
+func newConsulConfig(path string) (*consulConfig, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("No Consul address in %s", path)
+	}
+
+	return &consulConfig{
+		URL:    path,
+		addr:   u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		// Blocking queries wait up to 5 minutes for a change
+		client: &http.Client{Timeout: 6 * time.Minute},
+	}, nil
+}
+
+// fetch retrieves the handlers below the prefix.  When wait is true and a
+// previous fetch succeeded this is a blocking query that returns once the
+// prefix changes or Consul's wait time expires.  It returns a nil
+// Configuration and no error if nothing has changed.
+func (c *consulConfig) fetch(wait bool) (*Configuration, error) {
+	query := url.Values{"recurse": {"true"}}
+	if wait && c.index != "" {
+		query.Set("index", c.index)
+		query.Set("wait", "5m")
+	}
+	u := fmt.Sprintf("http://%s/v1/kv/%s?%s", c.addr, c.prefix, query.Encode())
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var keys []consulKV
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+			return nil, fmt.Errorf("%s: %s", c.URL, err)
+		}
+	case http.StatusNotFound:
+		// A deleted or misspelled prefix must not remove every handler
+		return nil, fmt.Errorf("No keys found below %s", c.URL)
+	default:
+		return nil, fmt.Errorf("Consul returned status %d for %s", resp.StatusCode, c.URL)
+	}
+
+	index := resp.Header.Get("X-Consul-Index")
+	if wait && index != "" && index == c.index {
+		return nil, nil
+	}
+
+	cfg := &Configuration{Handlers: make(map[string]Handler)}
+	for _, kv := range keys {
+		name := strings.TrimPrefix(strings.TrimPrefix(kv.Key, c.prefix), "/")
+		if name == "" || strings.Contains(name, "/") {
+			// Skip the prefix itself, folders, and nested keys
+			continue
+		}
+		h := Handler{}
+		if err := yaml.UnmarshalStrict(kv.Value, &h); err != nil {
+			return nil, fmt.Errorf("%s: handler %s: %s", c.URL, name, err)
+		}
+		cfg.Handlers[name] = h
+	}
+
+	c.index = index
+	return cfg, nil
+}
+
+// watchConsul activates the configuration stored in Consul whenever it
+// changes.  After an error it waits interval before trying again.  It
+// returns when stop is closed.
+func watchConsul(path string, interval time.Duration, stop <-chan struct{}) {
+	consul, err := newConsulConfig(path)
+	if err != nil {
+		log.Printf("Error: Cannot watch configuration: %s", err)
+		return
+	}
+
+	for {
+		cfg, err := consul.fetch(true)
+		if err == nil && cfg != nil {
+			err = finishRemoteConfiguration(path, cfg)
+		}
+		if err != nil {
+			log.Printf("Error: Configuration reload failed, keeping current configuration: %s", err)
+		} else if cfg != nil {
+			log.Printf("Configuration at %s changed, reloading", path)
+			activateConfiguration(cfg)
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		// Without an index Consul can't block so wait before asking again
+		if err != nil || consul.index == "" {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}
+}
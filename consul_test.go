@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul implements enough of Consul's KV HTTP API for tests.
+type fakeConsul struct {
+	lock    sync.Mutex
+	index   int
+	keys    []consulKV
+	changed chan struct{}
+}
+
+func (f *fakeConsul) set(keys []consulKV) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.index++
+	f.keys = keys
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/kv/am-event-handler/handlers") {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.lock.Lock()
+	index, changed := f.index, f.changed
+	f.lock.Unlock()
+	if r.URL.Query().Get("index") == strconv.Itoa(index) {
+		// Blocking query
+		select {
+		case <-changed:
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.Itoa(f.index))
+	if len(f.keys) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(f.keys)
+}
+
+func TestConsulConfiguration(t *testing.T) {
+	consul := &fakeConsul{changed: make(chan struct{})}
+	consul.set([]consulKV{
+		{Key: "am-event-handler/handlers/", Value: nil},
+		{Key: "am-event-handler/handlers/restart", Value: []byte("command: /bin/true\nstatus: \"*\"\n")},
+		{Key: "am-event-handler/handlers/page", Value: []byte(`["restart"]`)},
+		{Key: "am-event-handler/handlers/nested/ignored", Value: []byte("/bin/false")},
+	})
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	orig := getConfig()
+	defer setConfig(orig)
+
+	path := "consul://" + strings.TrimPrefix(server.URL, "http://") + "/am-event-handler/handlers"
+	cfg, err := loadConfiguration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Handlers) != 2 || cfg.Handlers["restart"].Status != "*" ||
+		len(cfg.Handlers["page"].Group) != 1 {
+		t.Fatalf("Unexpected configuration from Consul: %#v", cfg.Handlers)
+	}
+	setConfig(cfg)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfiguration(path, 10*time.Millisecond, stop)
+	time.Sleep(50 * time.Millisecond)
+
+	consul.set([]consulKV{
+		{Key: "am-event-handler/handlers/added", Value: []byte("/bin/true")},
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := getConfig().Handlers["added"]; ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := getConfig().Handlers["added"]; !ok {
+		t.Fatalf("Changed Consul configuration was not reloaded")
+	}
+
+	// Deleting the prefix keeps the current handlers
+	consul.set(nil)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := getConfig().Handlers["added"]; !ok {
+		t.Errorf("Missing Consul prefix removed the handlers: %v", getConfig().Handlers)
+	}
+	if _, err := loadConfiguration(path); err == nil {
+		t.Errorf("Loading a missing Consul prefix should fail")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cooldowns remembers when each handler last ran for each alert.
+var cooldowns = newCooldownTracker()
+
+// cooldownTracker holds the time until which each key is cooling down.
+type cooldownTracker struct {
+	lock      sync.Mutex
+	until     map[string]time.Time
+	lastSweep time.Time
+}
+
+func newCooldownTracker() *cooldownTracker {
+	return &cooldownTracker{until: make(map[string]time.Time)}
+}
+
+// cooldownKey identifies the runs of handler for alert.  Firing and
+// resolved notifications of the same alert cool down separately.
+func cooldownKey(handler string, alert Alert) string {
+	return handler + "\x00" + alert.fingerprint() + "\x00" + alert.Status
+}
+
+// allow returns true if key is not cooling down at now and starts a new
+// cooldown of length d.  A zero d always allows.
+func (c *cooldownTracker) allow(key string, d time.Duration, now time.Time) bool {
+	if d <= 0 {
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.sweep(now)
+	if now.Before(c.until[key]) {
+		return false
+	}
+	c.until[key] = now.Add(d)
+	return true
+}
+
+// reset ends the cooldown of key.
+func (c *cooldownTracker) reset(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.until, key)
+}
+
+// cancel ends the cooldown of key started by allow at now with length d,
+// unless another has started since.
+func (c *cooldownTracker) cancel(key string, d time.Duration, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.until[key].Equal(now.Add(d)) {
+		delete(c.until, key)
+	}
+}
+
+// sweep forgets keys whose cooldown has ended.  It runs at most once a
+// minute.
+func (c *cooldownTracker) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+
+	for key, until := range c.until {
+		if !now.Before(until) {
+			delete(c.until, key)
+		}
+	}
+}
+
+// startedKey is the context key of the flag set once a command is started.
+type startedKey struct{}
+
+// withStarted returns a context recording whether the execution run with it
+// started a command, rather than skipping it, in the returned flag.
+func withStarted(ctx context.Context) (context.Context, *int32) {
+	started := new(int32)
+	return context.WithValue(ctx, startedKey{}, started), started
+}
+
+// markStarted records that a command was started with ctx.
+func markStarted(ctx context.Context) {
+	if started, ok := ctx.Value(startedKey{}).(*int32); ok {
+		atomic.StoreInt32(started, 1)
+	}
+}
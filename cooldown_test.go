@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCooldown(t *testing.T) {
+	c := newCooldownTracker()
+	now := time.Now()
+
+	if !c.allow("a", time.Minute, now) {
+		t.Fatalf("First run should be allowed")
+	}
+	if c.allow("a", time.Minute, now.Add(30*time.Second)) {
+		t.Errorf("Run during the cooldown should be skipped")
+	}
+	if !c.allow("b", time.Minute, now) {
+		t.Errorf("Cooldown of one key applied to another")
+	}
+	if !c.allow("a", time.Minute, now.Add(time.Minute)) {
+		t.Errorf("Run after the cooldown should be allowed")
+	}
+	if !c.allow("a", 0, now.Add(time.Minute)) {
+		t.Errorf("Zero cooldown should always allow")
+	}
+
+	c.sweep(now.Add(10 * time.Minute))
+	if len(c.until) != 0 {
+		t.Errorf("Expired cooldowns were not swept: %v", c.until)
+	}
+}
+
+func TestCooldownSkipsHandler(t *testing.T) {
+	// Holodeck safeties are on
+	debug = true
+
+	config.Handlers["debounced"] = Handler{Command: "/bin/true", Cooldown: time.Hour}
+	defer delete(config.Handlers, "debounced")
+
+	firing := Alert{Status: "firing", Labels: map[string]string{"alertname": "Debounce"}}
+	resolved := Alert{Status: "resolved", Labels: firing.Labels}
+	defer delete(cooldowns.until, cooldownKey("debounced", firing))
+	defer delete(cooldowns.until, cooldownKey("debounced", resolved))
+
+	if _, attempts, _ := runHandler(context.Background(), config, []string{"debounced"}, firing); attempts != 1 {
+		t.Errorf("First alert should run the handler")
+	}
+	if _, attempts, _ := runHandler(context.Background(), config, []string{"debounced"}, firing); attempts != 0 {
+		t.Errorf("Repeated alert should be skipped during the cooldown")
+	}
+	if _, attempts, _ := runHandler(context.Background(), config, []string{"debounced"}, resolved); attempts != 1 {
+		t.Errorf("Resolved alert should not share the firing alert's cooldown")
+	}
+}
+
+func TestCooldownNotStartedBySkip(t *testing.T) {
+	// Holodeck safeties are on
+	debug = true
+
+	disabled := false
+	config.Handlers["dormant"] = Handler{Command: "/bin/true", Cooldown: time.Hour, Enabled: &disabled}
+	defer delete(config.Handlers, "dormant")
+
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Dormant"}}
+	key := cooldownKey("dormant", alert)
+	defer delete(cooldowns.until, key)
+
+	runHandler(context.Background(), config, []string{"dormant"}, alert)
+	if _, ok := cooldowns.until[key]; ok {
+		t.Errorf("Skipped handler started its cooldown")
+	}
+
+	config.Handlers["dormant"] = Handler{Command: "/bin/true", Cooldown: time.Hour}
+	runHandler(context.Background(), config, []string{"dormant"}, alert)
+	if _, ok := cooldowns.until[key]; !ok {
+		t.Errorf("Handler that ran did not start its cooldown")
+	}
+}
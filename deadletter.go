@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// retryBackoff is the delay before the first retry of a failed handler
+	retryBackoff = time.Second
+
+	// deadLetters stores handler executions that failed every attempt.  It
+	// is nil when -dead-letter-dir is not set.
+	deadLetters *deadLetterStore
+)
+
+// deadLetterID matches the IDs of dead letters.
+var deadLetterID = regexp.MustCompile(`^[0-9]+-[0-9]+$`)
+
+// deadLetter is a handler execution that failed every attempt along with
+// the alert it was run for.
+type deadLetter struct {
+	ID       string    `json:"id"`
+	Time     string    `json:"time"`
+	Handler  []string  `json:"handler"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Output   string    `json:"output,omitempty"`
+	Record   jobRecord `json:"record"`
+}
+
+// deadLetterStore keeps dead letters as JSON files in a directory.
+type deadLetterStore struct {
+	dir string
+	seq uint64
+}
+
+// newDeadLetterStore returns a store of dead letters in dir.
+func newDeadLetterStore(dir string) (*deadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &deadLetterStore{dir: dir}, nil
+}
+
+func (s *deadLetterStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// add stores the failed execution of handler for alert, one of the alerts
+// of e.
+func (s *deadLetterStore) add(e *AlertManagerEvent, alert Alert, handler []string,
+	attempts int, output *bytes.Buffer, err error) {
+	d := deadLetter{
+		ID: fmt.Sprintf("%d-%d", time.Now().UnixNano(),
+			atomic.AddUint64(&s.seq, 1)),
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Handler:  handler,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Record:   newJobRecord(job{event: e, alert: alert}),
+	}
+	if output != nil {
+		d.Output = output.String()
+	}
+	if err := s.write(d); err != nil {
+		log.Printf("Error: Could not store dead letter for handler %s: %s", handler[0], err)
+		return
+	}
+	log.Printf("Error: Handler %s failed %d time(s), stored as dead letter %s",
+		handler[0], attempts, d.ID)
+}
+
+// write saves d, replacing an existing dead letter with the same ID.
+func (s *deadLetterStore) write(d deadLetter) error {
+	blob, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	name := s.path(d.ID)
+	if err := ioutil.WriteFile(name+".tmp", blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// get returns the dead letter with id.
+func (s *deadLetterStore) get(id string) (deadLetter, error) {
+	d := deadLetter{}
+	if !deadLetterID.MatchString(id) {
+		return d, os.ErrNotExist
+	}
+	blob, err := ioutil.ReadFile(s.path(id))
+	if err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(blob, &d)
+	return d, err
+}
+
+// list returns every dead letter, oldest first.
+func (s *deadLetterStore) list() ([]deadLetter, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	letters := []deadLetter{}
+	for _, f := range files {
+		d, err := s.get(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			log.Printf("Error: Could not read dead letter %s: %s", f, err)
+			continue
+		}
+		letters = append(letters, d)
+	}
+	return letters, nil
+}
+
+// remove deletes the dead letter with id.
+func (s *deadLetterStore) remove(id string) error {
+	if !deadLetterID.MatchString(id) {
+		return os.ErrNotExist
+	}
+	return os.Remove(s.path(id))
+}
+
+// redrive runs the handler of a dead letter again.  The dead letter is
+// removed if it succeeds and updated otherwise.
+func (s *deadLetterStore) redrive(ctx context.Context, d deadLetter) (handlerResult, error) {
+	j := d.Record.job("")
+	alert, err := j.event.prepareAlert(j.alert)
+	if err != nil {
+		return handlerResult{}, err
+	}
+
+	log.Printf("Redriving dead letter %s for handler %s", d.ID, d.Handler[0])
+	start := time.Now()
+	output, err := parseHandler(ctx, d.Handler, alert)
+	result := newHandlerResult(d.Handler, start, output, err)
+	if err == nil {
+		return result, s.remove(d.ID)
+	}
+
+	d.Attempts++
+	d.Error = err.Error()
+	d.Output = result.Output
+	return result, s.write(d)
+}
+
+// deadLetterHandler serves the dead letter API:
+//
+//	GET    /api/v1/deadletters               lists dead letters
+//	GET    /api/v1/deadletters/<id>          returns a dead letter
+//	DELETE /api/v1/deadletters/<id>          discards a dead letter
+//	POST   /api/v1/deadletters/<id>/redrive  runs its handler again
+func deadLetterHandler(writer http.ResponseWriter, r *http.Request) {
+	w := NewStatusResponseWriter(writer)
+	defer logRequest(w, r)
+
+	if deadLetters == nil {
+		http.Error(w, "Dead letters are not enabled.", http.StatusNotFound)
+		return
+	}
+
+	var response interface{}
+	var err error
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/deadletters"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "" && r.Method == "GET":
+		response, err = deadLetters.list()
+	case len(parts) == 1 && r.Method == "GET":
+		response, err = deadLetters.get(parts[0])
+	case len(parts) == 1 && r.Method == "DELETE":
+		err = deadLetters.remove(parts[0])
+		response = map[string]string{"deleted": parts[0]}
+	case len(parts) == 2 && parts[1] == "redrive" && r.Method == "POST":
+		var d deadLetter
+		if d, err = deadLetters.get(parts[0]); err == nil {
+			var result handlerResult
+			result, err = deadLetters.redrive(r.Context(), d)
+			if err == nil && result.Error != "" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				blob, _ := json.Marshal(result)
+				w.Write(append(blob, '\n'))
+				return
+			}
+			response = result
+		}
+	default:
+		http.Error(w, "Bad request method or path.", http.StatusBadRequest)
+		return
+	}
+
+	if os.IsNotExist(err) {
+		http.Error(w, "No such dead letter.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(blob, '\n'))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLetters(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if deadLetters, err = newDeadLetterStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	retryBackoff = 10 * time.Millisecond
+	defer func() {
+		deadLetters = nil
+		retryBackoff = time.Second
+	}()
+
+	// The handler fails until testdata/flakyFixed exists
+	config.Handlers["flaky"] = Handler{
+		Command: "/bin/bash -c \"echo {{ index .Argv 0 }} >> testdata/flakyAttempts; test -e testdata/flakyFixed\"",
+		Retries: 2,
+	}
+	defer delete(config.Handlers, "flaky")
+	defer os.Remove("testdata/flakyAttempts")
+	defer os.Remove("testdata/flakyFixed")
+
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Flaky"}}
+	event := &AlertManagerEvent{Receiver: "test", Alerts: []Alert{alert}, handler: []string{"flaky", "db1"}}
+	if _, err := handleEvent(context.Background(), event); err == nil {
+		t.Fatalf("Failing handler did not fail")
+	}
+	buf, _ := ioutil.ReadFile("testdata/flakyAttempts")
+	if n := strings.Count(string(buf), "db1\n"); n != 3 {
+		t.Errorf("Expected 3 attempts, got %d", n)
+	}
+
+	url := "http://" + bind + "/api/v1/deadletters"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letters []deadLetter
+	err = json.NewDecoder(resp.Body).Decode(&letters)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %#v", letters)
+	}
+	d := letters[0]
+	if d.Handler[0] != "flaky" || d.Attempts != 3 || d.Record.Alert.name() != "Flaky" {
+		t.Errorf("Unexpected dead letter: %#v", d)
+	}
+
+	redrive := func() int {
+		resp, err := http.Post(url+"/"+d.ID+"/redrive", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := redrive(); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 when the redriven handler fails, got %d", code)
+	}
+	if d, err = deadLetters.get(d.ID); err != nil || d.Attempts != 4 {
+		t.Errorf("Dead letter not updated after a failed redrive: %#v %v", d, err)
+	}
+
+	ioutil.WriteFile("testdata/flakyFixed", nil, 0644)
+	if code := redrive(); code != http.StatusOK {
+		t.Errorf("Expected 200 when the redriven handler succeeds, got %d", code)
+	}
+	if _, err := deadLetters.get(d.ID); !os.IsNotExist(err) {
+		t.Errorf("Dead letter not removed after a successful redrive: %v", err)
+	}
+	if code := redrive(); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a removed dead letter, got %d", code)
+	}
+}
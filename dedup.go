@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// dedupWindow is how long a notification is remembered to recognize
+	// duplicate deliveries.  Zero disables deduplication.
+	dedupWindow time.Duration
+
+	// deliveries remembers the notifications received within dedupWindow
+	deliveries = newCooldownTracker()
+)
+
+// deliveryKey identifies a notification by its group key, status, alerts,
+// and handler.  The Alertmanager delivers the same notification again
+// when it did not get a response in time.  It returns "" for
+// notifications without a group key.
+func (e *AlertManagerEvent) deliveryKey() string {
+	if e.GroupKey == "" {
+		return ""
+	}
+
+	alerts := make([]string, len(e.Alerts))
+	for i, a := range e.Alerts {
+		alerts[i] = strings.Join([]string{a.fingerprint(), a.Status, a.StartsAt, a.EndsAt}, "\xff")
+	}
+	sort.Strings(alerts)
+	h := fnv.New64a()
+	for _, a := range alerts {
+		h.Write([]byte(a))
+		h.Write([]byte{0})
+	}
+
+	return fmt.Sprintf("%s\x00%s\x00%016x\x00%s", e.GroupKey, e.Status, h.Sum64(),
+		strings.Join(e.handler, " "))
+}
+
+// duplicate returns true if a notification with key was received within
+// dedupWindow, otherwise it remembers key.
+func duplicate(key string) bool {
+	if key == "" || dedupWindow <= 0 {
+		return false
+	}
+	return !deliveries.allow(key, dedupWindow, clock())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeliveryKey(t *testing.T) {
+	a := Alert{Status: "firing", Labels: map[string]string{"alertname": "A"}}
+	b := Alert{Status: "firing", Labels: map[string]string{"alertname": "B"}}
+	e := &AlertManagerEvent{GroupKey: "{}:{}", Status: "firing", Alerts: []Alert{a, b}}
+
+	if key := (&AlertManagerEvent{Alerts: e.Alerts}).deliveryKey(); key != "" {
+		t.Errorf("Notification without a group key has key %q", key)
+	}
+	reordered := &AlertManagerEvent{GroupKey: e.GroupKey, Status: "firing", Alerts: []Alert{b, a}}
+	if e.deliveryKey() != reordered.deliveryKey() {
+		t.Errorf("Order of the alerts changed the delivery key")
+	}
+	resolved := &AlertManagerEvent{GroupKey: e.GroupKey, Status: "resolved", Alerts: []Alert{a, b}}
+	if e.deliveryKey() == resolved.deliveryKey() {
+		t.Errorf("Status did not change the delivery key")
+	}
+	fewer := &AlertManagerEvent{GroupKey: e.GroupKey, Status: "firing", Alerts: []Alert{a}}
+	if e.deliveryKey() == fewer.deliveryKey() {
+		t.Errorf("Alerts did not change the delivery key")
+	}
+}
+
+func TestDuplicateDelivery(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	dedupWindow = time.Minute
+	defer func() { dedupWindow = 0 }()
+
+	config.Handlers["once"] = Handler{Command: "/bin/bash -c \"echo ran >> testdata/testOnce\""}
+	defer delete(config.Handlers, "once")
+	defer os.Remove("testdata/testOnce")
+
+	body := `{"receiver": "test", "status": "firing", "groupKey": "{}:{alertname=\"Once\"}", "alerts": [
+		{"status": "firing", "labels": {"alertname": "Once"}, "annotations": {"handler": "once"}}
+	]}`
+	e, err := unmarshalBody([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deliveries.reset(e.deliveryKey())
+
+	for i, want := range []bool{false, true} {
+		resp, err := http.Post("http://"+bind+"/", "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result eventResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || result.Duplicate != want {
+			t.Errorf("Delivery %d: status %d duplicate %v, want duplicate %v",
+				i+1, resp.StatusCode, result.Duplicate, want)
+		}
+	}
+
+	buf, err := ioutil.ReadFile("testdata/testOnce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ran\n" {
+		t.Errorf("Duplicate delivery ran the handler again: %q", buf)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// dryRunKey is the context key marking a dry run.
+type dryRunKey struct{}
+
+// withDryRun returns a context in which commands are rendered but not
+// executed.
+func withDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// isDryRun returns true if commands run with ctx must not be executed.
+func isDryRun(ctx context.Context) bool {
+	dry, _ := ctx.Value(dryRunKey{}).(bool)
+	return dry
+}
+
+// requestDryRun returns true if the request asks for a dry run with the
+// X-Dry-Run header or the dry_run query parameter.
+func requestDryRun(r *http.Request) bool {
+	value := r.Header.Get("X-Dry-Run")
+	if value == "" {
+		value = r.URL.Query().Get("dry_run")
+	}
+	dry, _ := strconv.ParseBool(value)
+	return dry
+}
+
+// dryRunOutput describes the command that would run exe with args.
+// Secret references are left unresolved.
+func dryRunOutput(exe string, args []string) *bytes.Buffer {
+	words := []string{shellQuote(unmarkSecrets(exe))}
+	for _, a := range args {
+		words = append(words, shellQuote(unmarkSecrets(a)))
+	}
+	out := new(bytes.Buffer)
+	fmt.Fprintf(out, "Would run: %s\n", strings.Join(words, " "))
+	return out
+}
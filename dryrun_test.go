@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	config.Handlers["dry"] = Handler{
+		Command: "/bin/bash -c \"echo {{ index .Argv 0 }} > testdata/testDryRun\"",
+	}
+	defer delete(config.Handlers, "dry")
+	defer os.Remove("testdata/testDryRun")
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	body, err := ioutil.ReadFile("testdata/test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{"", "?dry_run=1"} {
+		req, err := http.NewRequest("POST",
+			fmt.Sprintf("http://%s/api/v1/webhook/dry/nginx%s", bind, query),
+			bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query == "" {
+			req.Header.Set("X-Dry-Run", "true")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result eventResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != 200 || !result.DryRun {
+			t.Errorf("Bad dry run response: %d %+v", resp.StatusCode, result)
+		}
+		if _, err := os.Stat("testdata/testDryRun"); err == nil {
+			t.Fatalf("Dry run executed the command")
+		}
+		want := "Would run: /bin/bash -c 'echo nginx > testdata/testDryRun'"
+		if !strings.Contains(result.output(), want) {
+			t.Errorf("Dry run output %q does not contain %q", result.output(), want)
+		}
+	}
+}
+
+func TestRequestDryRun(t *testing.T) {
+	tests := map[string]bool{
+		"/":              false,
+		"/?dry_run=1":    true,
+		"/?dry_run=true": true,
+		"/?dry_run=0":    false,
+		"/?dry_run=bad":  false,
+	}
+	for url, want := range tests {
+		r, _ := http.NewRequest("POST", url, nil)
+		if got := requestDryRun(r); got != want {
+			t.Errorf("requestDryRun(%s) = %v, want %v", url, got, want)
+		}
+	}
+
+	r, _ := http.NewRequest("POST", "/?dry_run=1", nil)
+	r.Header.Set("X-Dry-Run", "false")
+	if requestDryRun(r) {
+		t.Errorf("X-Dry-Run header should take precedence over the query")
+	}
+}
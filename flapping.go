@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// flapThreshold is the number of firing/resolved transitions within
+	// flapWindow above which an alert is flapping.  Zero disables flapping
+	// detection.
+	flapThreshold int
+
+	// flapWindow is the period transitions are counted over
+	flapWindow time.Duration
+
+	// flaps tracks the transitions of each alert
+	flaps = newFlapTracker()
+)
+
+// flapState is the last status seen of an alert and the times it changed.
+type flapState struct {
+	status  string
+	seen    time.Time
+	changes []time.Time
+}
+
+// flapTracker counts the firing/resolved transitions of each alert
+// fingerprint.
+type flapTracker struct {
+	lock      sync.Mutex
+	alerts    map[string]*flapState
+	lastSweep time.Time
+}
+
+func newFlapTracker() *flapTracker {
+	return &flapTracker{alerts: make(map[string]*flapState)}
+}
+
+// observe records that the alert with fingerprint was seen with status at
+// now and returns true if it is flapping.
+func (f *flapTracker) observe(fingerprint, status string, now time.Time) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	s, ok := f.alerts[fingerprint]
+	if !ok {
+		s = &flapState{status: status}
+		f.alerts[fingerprint] = s
+	}
+	if s.status != status {
+		s.status = status
+		s.changes = append(s.changes, now)
+	}
+	s.seen = now
+	f.sweep(now)
+	return f.count(s, now) > flapThreshold
+}
+
+// flapping returns true if the alert with fingerprint is flapping at now
+// without recording a notification.
+func (f *flapTracker) flapping(fingerprint string, now time.Time) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	s, ok := f.alerts[fingerprint]
+	return ok && f.count(s, now) > flapThreshold
+}
+
+// count drops the transitions of s older than flapWindow and returns the
+// number left.  The caller must hold the lock.
+func (f *flapTracker) count(s *flapState, now time.Time) int {
+	i := 0
+	for i < len(s.changes) && now.Sub(s.changes[i]) >= flapWindow {
+		i++
+	}
+	s.changes = s.changes[i:]
+	return len(s.changes)
+}
+
+// sweep forgets alerts not seen for a day.  The caller must hold the lock.
+func (f *flapTracker) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < time.Minute {
+		return
+	}
+	f.lastSweep = now
+	for key, s := range f.alerts {
+		if now.Sub(s.seen) > resolutionMemory {
+			delete(f.alerts, key)
+		}
+	}
+}
+
+// isFlapping records alert, unless this is a dry run or test alert, and
+// returns true if its handlers should be suppressed as it is flapping.
+func isFlapping(dryRun bool, alert Alert) bool {
+	if flapThreshold <= 0 {
+		return false
+	}
+	if dryRun {
+		return flaps.flapping(alert.fingerprint(), clock())
+	}
+	return flaps.observe(alert.fingerprint(), alert.Status, clock())
+}
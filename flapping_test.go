@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFlapTracker(t *testing.T) {
+	defer func(n int, d time.Duration) { flapThreshold, flapWindow = n, d }(flapThreshold, flapWindow)
+	flapThreshold, flapWindow = 2, 10*time.Minute
+
+	f := newFlapTracker()
+	now := time.Now()
+	for i, status := range []string{"firing", "firing", "resolved", "firing"} {
+		if f.observe("a", status, now.Add(time.Duration(i)*time.Minute)) {
+			t.Fatalf("Alert flapping after %d notifications", i+1)
+		}
+	}
+	if !f.observe("a", "resolved", now.Add(4*time.Minute)) {
+		t.Errorf("Alert with 3 transitions should be flapping")
+	}
+	if f.flapping("b", now) {
+		t.Errorf("Unknown alert is flapping")
+	}
+
+	// The alert stabilizes once its transitions leave the window
+	if !f.flapping("a", now.Add(11*time.Minute)) {
+		t.Errorf("Alert stabilized while 3 transitions are within the window")
+	}
+	if f.observe("a", "resolved", now.Add(12*time.Minute)) {
+		t.Errorf("Alert should have stabilized")
+	}
+}
+
+func TestFlappingSuppressesHandlers(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	defer func(n int, d time.Duration) { flapThreshold, flapWindow = n, d }(flapThreshold, flapWindow)
+	flapThreshold, flapWindow = 1, time.Hour
+
+	marker := "testdata/flapping"
+	defer os.Remove(marker)
+	config.Handlers["flappy"] = Handler{Command: "/bin/true"}
+	config.Handlers["flapping"] = Handler{Command: "touch " + marker}
+	defer delete(config.Handlers, "flappy")
+	defer delete(config.Handlers, "flapping")
+
+	e := &AlertManagerEvent{}
+	alert := Alert{
+		Labels:      map[string]string{"alertname": "Flappy"},
+		Annotations: map[string]string{"handler": "flappy"},
+	}
+	defer delete(flaps.alerts, alert.fingerprint())
+
+	for i, status := range []string{"firing", "resolved", "firing"} {
+		alert.Status = status
+		result := e.handleAlert(context.Background(), config, alert, newAuditRecord(e))
+		flapping := i == 2
+		if len(result.Handlers) != 1 || (result.Handlers[0].Handler == "flapping") != flapping {
+			t.Errorf("Notification %d ran %#v", i+1, result.Handlers)
+		}
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Flapping handler did not run: %s", err)
+	}
+}
+
+func TestTestAlertsNotFlapping(t *testing.T) {
+	defer func(n int, d time.Duration) { flapThreshold, flapWindow = n, d }(flapThreshold, flapWindow)
+	flapThreshold, flapWindow = 1, time.Hour
+
+	e := &AlertManagerEvent{test: true}
+	alert := Alert{Labels: map[string]string{"alertname": "Injected"}}
+	defer delete(flaps.alerts, alert.fingerprint())
+
+	for _, status := range []string{"firing", "resolved", "firing"} {
+		alert.Status = status
+		e.handleAlert(context.Background(), config, alert, newAuditRecord(e))
+	}
+	if _, ok := flaps.alerts[alert.fingerprint()]; ok {
+		t.Errorf("Test alerts were recorded as state transitions")
+	}
+}
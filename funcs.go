@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// templateFuncs are the functions available to handler templates.  Apart
+// from replace and the regular expression and duration functions they
+// are a subset of the Sprig library with the same names and argument order, the string
+// being operated on coming last so that functions can be chained in
+// pipelines.
+var templateFuncs = template.FuncMap{
+	"replace": replace,
+
+	"trim":       strings.TrimSpace,
+	"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      title,
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"repeat":     func(count int, s string) string { return strings.Repeat(s, count) },
+	"trunc":      trunc,
+	"quote":      quote,
+	"squote":     squote,
+	"indent":     indent,
+	"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+	"split":      split,
+	"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       join,
+	"ternary":    ternary,
+	"list":       func(items ...interface{}) []interface{} { return items },
+	"dict":       dict,
+	"toJson":     toJSON,
+	"b64enc":     func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec":     b64dec,
+	"default":    defaultValue,
+
+	"reMatch":      reMatch,
+	"reFind":       reFind,
+	"reReplaceAll": reReplaceAll,
+
+	"now":              func() time.Time { return clock() },
+	"toDate":           time.Parse,
+	"date":             date,
+	"since":            since,
+	"ago":              ago,
+	"duration":         duration,
+	"humanizeDuration": humanizeDuration,
+}
+
+// title upper cases the first letter of every word of s.
+func title(s string) string {
+	prev := ' '
+	return strings.Map(func(r rune) rune {
+		word := unicode.IsSpace(prev)
+		prev = r
+		if word {
+			return unicode.ToTitle(r)
+		}
+		return r
+	}, s)
+}
+
+// trunc returns the first length characters of s.  A negative length
+// returns the last characters instead.
+func trunc(length int, s string) string {
+	runes := []rune(s)
+	if length < 0 && -length < len(runes) {
+		return string(runes[len(runes)+length:])
+	}
+	if length >= 0 && length < len(runes) {
+		return string(runes[:length])
+	}
+	return s
+}
+
+// quote wraps each of its arguments in double quotes, escaping them as Go
+// strings, and joins them with spaces.
+func quote(items ...interface{}) string {
+	quoted := make([]string, 0, len(items))
+	for _, item := range items {
+		if item != nil {
+			quoted = append(quoted, strconv.Quote(fmt.Sprint(item)))
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// squote wraps each of its arguments in single quotes and joins them with
+// spaces.
+func squote(items ...interface{}) string {
+	quoted := make([]string, 0, len(items))
+	for _, item := range items {
+		if item != nil {
+			quoted = append(quoted, "'"+fmt.Sprint(item)+"'")
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// indent prefixes every line of s with spaces.
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+// split splits s at sep into a map with keys "_0", "_1", and so on, so
+// that the parts can be used as fields.
+func split(sep, s string) map[string]string {
+	result := make(map[string]string)
+	for i, part := range strings.Split(s, sep) {
+		result["_"+strconv.Itoa(i)] = part
+	}
+	return result
+}
+
+// join joins the elements of list, a list of any type, with sep.
+func join(sep string, list interface{}) (string, error) {
+	switch l := list.(type) {
+	case []string:
+		return strings.Join(l, sep), nil
+	case []interface{}:
+		parts := make([]string, 0, len(l))
+		for _, item := range l {
+			if item != nil {
+				parts = append(parts, fmt.Sprint(item))
+			}
+		}
+		return strings.Join(parts, sep), nil
+	case string:
+		return l, nil
+	}
+	return "", fmt.Errorf("join: cannot join %T", list)
+}
+
+// ternary returns vt if condition is true and vf otherwise.
+func ternary(vt, vf interface{}, condition bool) interface{} {
+	if condition {
+		return vt
+	}
+	return vf
+}
+
+// dict builds a map from alternating keys and values.
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict: odd number of arguments")
+	}
+	result := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		result[fmt.Sprint(pairs[i])] = pairs[i+1]
+	}
+	return result, nil
+}
+
+// toJSON encodes v as JSON.
+func toJSON(v interface{}) (string, error) {
+	blob, err := json.Marshal(v)
+	return string(blob), err
+}
+
+// b64dec decodes the base64 string s.
+func b64dec(s string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(s)
+	return string(blob), err
+}
+
+// defaultValue returns given unless it is empty, such as a missing label,
+// in which case it returns d.
+func defaultValue(d interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || given[0] == nil {
+		return d
+	}
+	v := reflect.ValueOf(given[0])
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if v.Len() == 0 {
+			return d
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return d
+		}
+	default:
+		if v.IsZero() {
+			return d
+		}
+	}
+	return given[0]
+}
+
+// reMatch returns true if the regular expression pattern matches s.
+func reMatch(pattern, s string) (bool, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(s), nil
+}
+
+// reFind returns the first match of the regular expression pattern in s,
+// or its first group if it has groups.
+func reFind(pattern, s string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	match := re.FindStringSubmatch(s)
+	switch {
+	case match == nil:
+		return "", nil
+	case len(match) > 1:
+		return match[1], nil
+	}
+	return match[0], nil
+}
+
+// reReplaceAll replaces the matches of the regular expression pattern in s
+// with replacement, in which $1 expands to the first group.
+func reReplaceAll(pattern, replacement, s string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, replacement), nil
+}
+
+// toTime converts v, a time.Time, an RFC 3339 string such as StartsAt, or
+// seconds since the epoch, to a time.Time.
+func toTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		return time.Parse(time.RFC3339, t)
+	case int:
+		return time.Unix(int64(t), 0), nil
+	case int64:
+		return time.Unix(t, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("cannot use %T as a time", v)
+}
+
+// date formats t with the Go time layout.
+func date(layout string, t interface{}) (string, error) {
+	tm, err := toTime(t)
+	if err != nil {
+		return "", err
+	}
+	return tm.Format(layout), nil
+}
+
+// since returns the time elapsed since t.
+func since(t interface{}) (time.Duration, error) {
+	tm, err := toTime(t)
+	if err != nil {
+		return 0, err
+	}
+	return clock().Sub(tm), nil
+}
+
+// ago returns the time elapsed since t rounded to the second, such as
+// "12m34s".
+func ago(t interface{}) (string, error) {
+	d, err := since(t)
+	if err != nil {
+		return "", err
+	}
+	return humanizeDuration(d), nil
+}
+
+// duration returns the time elapsed between start and end.
+func duration(start, end interface{}) (time.Duration, error) {
+	from, err := toTime(start)
+	if err != nil {
+		return 0, err
+	}
+	to, err := toTime(end)
+	if err != nil {
+		return 0, err
+	}
+	return to.Sub(from), nil
+}
+
+// humanizeDuration formats d rounded to the second, or to the millisecond
+// below a second, such as "1h2m3s".
+func humanizeDuration(d time.Duration) string {
+	if d > -time.Second && d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	alert := Alert{Labels: map[string]string{
+		"alertname": "DiskFull",
+		"instance":  "db1.example.com:9100",
+		"severity":  "critical",
+		"note":      "  padded  ",
+	}}
+
+	for command, want := range map[string]string{
+		`{{ .Labels.note | trim }}`:                                                  "padded",
+		`{{ .Labels.instance | trimSuffix ":9100" | upper }}`:                        "DB1.EXAMPLE.COM",
+		`{{ trimPrefix "db" "db1" }} {{ trimAll "-" "--x--" }}`:                      "1 x",
+		`{{ title "disk is full" }} {{ lower .Labels.alertname }}`:                   "Disk Is Full diskfull",
+		`{{ if hasPrefix "db" .Labels.instance }}db{{ end }}`:                        "db",
+		`{{ contains "example" .Labels.instance }} {{ hasSuffix "x" "y" }}`:          "true false",
+		`{{ repeat 3 "ab" }} {{ trunc 3 "abcdef" }} {{ trunc -2 "abcdef" }}`:         "ababab abc ef",
+		`{{ quote .Labels.alertname "it's" }} {{ squote "x" }}`:                      `"DiskFull" "it's" 'x'`,
+		`{{ indent 2 "a\nb" }}{{ nindent 1 "c" }}`:                                   "  a\n  b\n c",
+		`{{ (split ":" .Labels.instance)._1 }}`:                                      "9100",
+		`{{ splitList "." .Labels.instance | join "/" }}`:                            "db1/example/com:9100",
+		`{{ list 1 "a" 2 | join "," }}`:                                              "1,a,2",
+		`{{ ternary "page" "ticket" (eq .Labels.severity "critical") }}`:             "page",
+		`{{ dict "name" .Labels.alertname "n" 1 | toJson }}`:                         `{"n":1,"name":"DiskFull"}`,
+		`{{ b64enc "secret" }} {{ b64dec "c2VjcmV0" }}`:                              "c2VjcmV0 secret",
+		`{{ replace .Labels.instance ":9100" "" }}`:                                  "db1.example.com",
+		`{{ reMatch "^db[0-9]+\\." .Labels.instance }}`:                              "true",
+		`{{ reFind "^([^:.]+)" .Labels.instance }}`:                                  "db1",
+		`{{ reFind "[0-9]+$" .Labels.instance }} {{ reFind "x" "y" }}`:               "9100 ",
+		`{{ .Labels.instance | reReplaceAll "^(.*):[0-9]+$" "$1" }}`:                 "db1.example.com",
+		`{{ .Labels.team | default "sre" }} {{ .Labels.severity | default "info" }}`: "sre critical",
+		`{{ default 5 0 }} {{ default "x" (list) }} {{ default "x" true }}`:          "5 x true",
+	} {
+		got, err := renderHandler([]string{"test"}, command, alert)
+		if err != nil {
+			t.Errorf("%s failed: %s", command, err)
+		} else if got != want {
+			t.Errorf("%s rendered %q, want %q", command, got, want)
+		}
+	}
+
+	for _, command := range []string{`{{ dict "odd" }}`, `{{ join "," 1 }}`, `{{ b64dec "!" }}`, `{{ reMatch "(" "x" }}`} {
+		if _, err := renderHandler([]string{"test"}, command, alert); err == nil {
+			t.Errorf("%s should fail", command)
+		}
+	}
+}
+
+func TestDefaultStrictTemplates(t *testing.T) {
+	defer func() { strictTemplates = false }()
+	strictTemplates = true
+
+	alert := Alert{Labels: map[string]string{"alertname": "DiskFull"}}
+	got, err := renderHandler([]string{"test"}, `{{ index .Labels "team" | default "sre" }}`, alert)
+	if err != nil || got != "sre" {
+		t.Errorf("Default of a missing label with strict templates rendered %q: %v", got, err)
+	}
+}
+
+func TestTimeFuncs(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	defer func() { clock = time.Now }()
+
+	alert := Alert{
+		StartsAt: "2024-03-04T11:47:26.123Z",
+		EndsAt:   "2024-03-04T13:02:03Z",
+	}
+	for command, want := range map[string]string{
+		`firing for {{ ago .StartsAt }}`:                          "firing for 12m34s",
+		`{{ since .StartsAt }}`:                                   "12m33.877s",
+		`{{ duration .StartsAt .EndsAt | humanizeDuration }}`:     "1h14m37s",
+		`{{ date "15:04 MST" .StartsAt }} {{ date "2006" now }}`:  "11:47 UTC 2024",
+		`{{ toDate "2006-01-02" "2024-03-01" | ago }}`:            "84h0m0s",
+		`{{ ago 1709553600 }} {{ humanizeDuration (since now) }}`: "0s 0s",
+		`{{ duration .StartsAt .StartsAt | humanizeDuration }}`:   "0s",
+	} {
+		got, err := renderHandler([]string{"test"}, command, alert)
+		if err != nil {
+			t.Errorf("%s failed: %s", command, err)
+		} else if got != want {
+			t.Errorf("%s rendered %q, want %q", command, got, want)
+		}
+	}
+
+	for _, command := range []string{`{{ ago "yesterday" }}`, `{{ since 1.5 }}`} {
+		if _, err := renderHandler([]string{"test"}, command, alert); err == nil {
+			t.Errorf("%s should fail", command)
+		}
+	}
+}
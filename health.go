@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	// reloading counts configuration reloads in progress
+	reloading int32
+
+	// shuttingDown is set to 1 once the server begins shutting down
+	shuttingDown int32
+)
+
+// healthz is the liveness endpoint.  It is not authenticated or logged so
+// frequent probes do not fill the logs.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK\n"))
+}
+
+// notReady returns why new webhooks should not be sent to this instance or
+// an empty string when it is ready.
+func notReady() string {
+	switch {
+	case atomic.LoadInt32(&shuttingDown) != 0:
+		return "Shutting down"
+	case getConfig() == nil:
+		return "No configuration loaded"
+	case atomic.LoadInt32(&reloading) != 0:
+		return "Configuration is reloading"
+	}
+	if slots := globalSlots; slots != nil && len(slots) == cap(slots) {
+		return "Execution slots are saturated"
+	}
+	return ""
+}
+
+// ready is the readiness endpoint.  It returns 503 while the instance
+// should not receive new webhooks.  Like healthz it is not authenticated
+// or logged.
+func ready(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+	if reason := notReady(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK\n"))
+}
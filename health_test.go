@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/healthz", bind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "OK\n" {
+		t.Errorf("Unexpected /healthz response: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestReady(t *testing.T) {
+	get := func() int {
+		resp, err := http.Get(fmt.Sprintf("http://%s/ready", bind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(); code != 200 {
+		t.Errorf("Expected ready, got %d", code)
+	}
+
+	atomic.StoreInt32(&reloading, 1)
+	if code := get(); code != 503 {
+		t.Errorf("Expected not ready while reloading, got %d", code)
+	}
+	atomic.StoreInt32(&reloading, 0)
+
+	globalSlots = make(chan struct{}, 1)
+	globalSlots <- struct{}{}
+	if code := get(); code != 503 {
+		t.Errorf("Expected not ready while saturated, got %d", code)
+	}
+	globalSlots = nil
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	if code := get(); code != 503 {
+		t.Errorf("Expected not ready while shutting down, got %d", code)
+	}
+	atomic.StoreInt32(&shuttingDown, 0)
+}
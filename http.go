@@ -1,13 +1,18 @@
 package main
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type StatusResponseWriter struct {
 	http.ResponseWriter
 	Status int
+	start  time.Time
 }
 
 func (w *StatusResponseWriter) WriteHeader(code int) {
@@ -16,10 +21,34 @@ func (w *StatusResponseWriter) WriteHeader(code int) {
 }
 
 func NewStatusResponseWriter(w http.ResponseWriter) *StatusResponseWriter {
-	return &StatusResponseWriter{w, 200}
+	return &StatusResponseWriter{ResponseWriter: w, Status: 200, start: time.Now()}
+}
+
+// requestID returns the ID of the request from its X-Request-Id header or
+// generates a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
 }
 
 func logRequest(w *StatusResponseWriter, r *http.Request) {
-	log.Printf("%s %s \"%s %s %s\" %d",
-		r.RemoteAddr, "-", r.Method, r.RequestURI, r.Proto, w.Status)
+	httpRequests.inc(strconv.Itoa(w.Status))
+	remote := remoteAddr(r)
+	fields := logFields{
+		"remote_addr": remote,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"status":      w.Status,
+		"duration":    time.Since(w.start).Seconds(),
+		"request_id":  w.Header().Get("X-Request-Id"),
+	}
+	if trace := parseTraceContext(r); trace != nil {
+		fields["trace_id"] = trace.traceID
+	}
+	logRecord("info", fmt.Sprintf("%s %s \"%s %s %s\" %d",
+		remote, "-", r.Method, r.RequestURI, r.Proto, w.Status), fields)
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// inflight tracks the handlers running for firing alerts that are
+	// cancelled when the alert resolves
+	inflight = newInflightTracker()
+
+	// errAlertResolved is the cause of handlers cancelled by inflight
+	errAlertResolved = errors.New("Alert resolved")
+)
+
+// inflightTracker holds the cancel functions of running handlers by alert
+// fingerprint.
+type inflightTracker struct {
+	lock    sync.Mutex
+	seq     uint64
+	running map[string]map[uint64]context.CancelCauseFunc
+}
+
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{running: make(map[string]map[uint64]context.CancelCauseFunc)}
+}
+
+// track returns a context derived from ctx that is cancelled when the
+// alert with fingerprint resolves.  The returned function must be called
+// once the handler has finished.
+func (t *inflightTracker) track(ctx context.Context, fingerprint string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.seq++
+	id := t.seq
+	if t.running[fingerprint] == nil {
+		t.running[fingerprint] = make(map[uint64]context.CancelCauseFunc)
+	}
+	t.running[fingerprint][id] = cancel
+
+	return ctx, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.running[fingerprint], id)
+		if len(t.running[fingerprint]) == 0 {
+			delete(t.running, fingerprint)
+		}
+		cancel(nil)
+	}
+}
+
+// cancel cancels the handlers running for the alert with fingerprint and
+// returns how many there were.
+func (t *inflightTracker) cancel(fingerprint string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, cancel := range t.running[fingerprint] {
+		cancel(errAlertResolved)
+	}
+	return len(t.running[fingerprint])
+}
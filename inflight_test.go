@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInflightTracker(t *testing.T) {
+	tracker := newInflightTracker()
+	ctx, done := tracker.track(context.Background(), "a")
+	other, otherDone := tracker.track(context.Background(), "b")
+	defer otherDone()
+
+	if n := tracker.cancel("a"); n != 1 {
+		t.Errorf("Expected to cancel 1 handler, cancelled %d", n)
+	}
+	if context.Cause(ctx) != errAlertResolved {
+		t.Errorf("Handler not cancelled by resolution: %v", context.Cause(ctx))
+	}
+	if other.Err() != nil {
+		t.Errorf("Handler of another alert was cancelled")
+	}
+
+	done()
+	if _, ok := tracker.running["a"]; ok {
+		t.Errorf("Finished handler is still tracked")
+	}
+}
+
+func TestCancelOnResolve(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["remediate"] = Handler{Command: "/bin/sleep 30", CancelOnResolve: true,
+		CircuitFailures: 1}
+	defer delete(config.Handlers, "remediate")
+	defer delete(circuits.circuits, "remediate")
+
+	firing := Alert{Status: "firing", Labels: map[string]string{"alertname": "Recovered"}}
+	resolved := Alert{Status: "resolved", Labels: firing.Labels}
+	defer delete(resolutions.resolved, firing.fingerprint())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(100 * time.Millisecond)
+		e := &AlertManagerEvent{Alerts: []Alert{resolved}}
+		e.handleAlert(context.Background(), config, resolved, newAuditRecord(e))
+	}()
+
+	start := time.Now()
+	_, _, err := runHandler(context.Background(), config, []string{"remediate"}, firing)
+	<-done
+	if err != nil {
+		t.Errorf("Handler cancelled by resolution should not fail: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Handler was not cancelled when the alert resolved, took %s", elapsed)
+	}
+	if !circuits.allow("remediate", 1, time.Minute, clock()) {
+		t.Errorf("Handler cancelled by resolution counted as a failure")
+	}
+}
+
+func TestDryRunResolutionKeepsHandlers(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["remediate"] = Handler{Command: "/bin/sleep 0.5", CancelOnResolve: true}
+	defer delete(config.Handlers, "remediate")
+
+	firing := Alert{Status: "firing", Labels: map[string]string{"alertname": "DryResolved"}}
+	resolved := Alert{Status: "resolved", Labels: firing.Labels}
+	defer delete(resolutions.resolved, firing.fingerprint())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(100 * time.Millisecond)
+		e := &AlertManagerEvent{Alerts: []Alert{resolved}}
+		e.handleAlert(withDryRun(context.Background()), config, resolved, newAuditRecord(e))
+	}()
+
+	start := time.Now()
+	_, _, err := runHandler(context.Background(), config, []string{"remediate"}, firing)
+	<-done
+	if err != nil {
+		t.Errorf("Handler failed: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Dry run resolution cancelled a real handler after %s", elapsed)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// journalCompactLines is the number of records written to the journal
+// after which it is rewritten with only the incomplete executions.
+const journalCompactLines = 1000
+
+var (
+	// journal records the handler executions in progress so that those
+	// interrupted by a crash are not silently dropped.  It is nil when
+	// -journal is not set.
+	journal *executionJournal
+
+	// journalReplay runs the executions a previous run left incomplete
+	// again on start.  Otherwise they are only logged.
+	journalReplay bool
+)
+
+// journalEntry is a line of the journal.  An "intent" entry is written
+// before a handler runs for an alert and a "done" entry with the same ID
+// once it has finished.
+type journalEntry struct {
+	ID      string     `json:"id"`
+	Type    string     `json:"type"`
+	Time    string     `json:"time"`
+	Handler []string   `json:"handler,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Record  *jobRecord `json:"record,omitempty"`
+
+	// Queued is the file of the alert in the queue directory, if any
+	Queued string `json:"queued,omitempty"`
+}
+
+// queuedFileKey is the context key of the queue directory file of the
+// alert being handled.
+type queuedFileKey struct{}
+
+// withQueuedFile returns a context handling the alert queued in file.
+func withQueuedFile(ctx context.Context, file string) context.Context {
+	return context.WithValue(ctx, queuedFileKey{}, file)
+}
+
+// queuedFileOf returns the queue directory file of the alert handled with
+// ctx, if any.
+func queuedFileOf(ctx context.Context) string {
+	file, _ := ctx.Value(queuedFileKey{}).(string)
+	return file
+}
+
+// executionJournal is an append only file of journalEntry lines.
+type executionJournal struct {
+	path string
+	seq  uint64
+
+	lock  sync.Mutex
+	file  *os.File
+	lines int
+	open  map[string]journalEntry
+}
+
+// openJournal opens the journal at path and returns it along with the
+// executions left incomplete in it, oldest first.
+func openJournal(path string) (*executionJournal, []journalEntry, error) {
+	j := &executionJournal{path: path, open: make(map[string]journalEntry)}
+
+	var order []string
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			var e journalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// A crash may leave the last line partially written
+				log.Printf("Error: Skipping unreadable journal entry: %s", err)
+				continue
+			}
+			switch e.Type {
+			case "intent":
+				if _, ok := j.open[e.ID]; !ok {
+					order = append(order, e.ID)
+				}
+				j.open[e.ID] = e
+			case "done":
+				delete(j.open, e.ID)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var incomplete []journalEntry
+	for _, id := range order {
+		if e, ok := j.open[id]; ok {
+			incomplete = append(incomplete, e)
+		}
+	}
+	// Incomplete executions are written again when they are replayed
+	j.open = make(map[string]journalEntry)
+	if err := j.compact(); err != nil {
+		return nil, nil, err
+	}
+	return j, incomplete, nil
+}
+
+// compact rewrites the journal with only the incomplete executions.  The
+// caller must hold the lock unless the journal is not yet shared.
+func (j *executionJournal) compact() error {
+	ids := make([]string, 0, len(j.open))
+	for id := range j.open {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	buf := new(bytes.Buffer)
+	for _, id := range ids {
+		blob, err := json.Marshal(j.open[id])
+		if err != nil {
+			return err
+		}
+		buf.Write(append(blob, '\n'))
+	}
+
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, j.lines = f, len(j.open)
+	return nil
+}
+
+// write appends e to the journal and waits for it to reach the disk.
+func (j *executionJournal) write(e journalEntry) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if e.Type == "intent" {
+		j.open[e.ID] = e
+	} else {
+		delete(j.open, e.ID)
+	}
+	if j.lines >= journalCompactLines {
+		// The new journal already reflects e
+		err := j.compact()
+		if err == nil {
+			return
+		}
+		log.Printf("Error: Could not compact journal %s: %s", j.path, err)
+	}
+
+	blob, err := json.Marshal(e)
+	if err == nil {
+		_, err = j.file.Write(append(blob, '\n'))
+	}
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		log.Printf("Error: Could not write journal %s: %s", j.path, err)
+		return
+	}
+	j.lines++
+}
+
+// begin records that handler is about to run for alert, one of the alerts
+// of e, and returns the ID of the execution.  queued is the alert's file in
+// the queue directory, if any.
+func (j *executionJournal) begin(e *AlertManagerEvent, alert Alert, handler []string, queued string) string {
+	record := newJobRecord(job{event: e, alert: alert})
+	entry := journalEntry{
+		ID: fmt.Sprintf("%d-%d", time.Now().UnixNano(),
+			atomic.AddUint64(&j.seq, 1)),
+		Type:    "intent",
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Handler: handler,
+		Record:  &record,
+		Queued:  queued,
+	}
+	j.write(entry)
+	return entry.ID
+}
+
+// finish records that the execution id has finished with err.
+func (j *executionJournal) finish(id string, err error) {
+	entry := journalEntry{
+		ID:   id,
+		Type: "done",
+		Time: time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	j.write(entry)
+}
+
+// runJournaled runs handler for alert like runHandler, recording the
+// execution in the journal.  Executions killed by shutdown are left
+// incomplete so that they are run again by the next start.
+func (e *AlertManagerEvent) runJournaled(ctx context.Context, cfg *Configuration, handler []string,
+	alert Alert) (*bytes.Buffer, int, error) {
+	if journal == nil || isDryRun(ctx) {
+		return runHandler(ctx, cfg, handler, alert)
+	}
+
+	id := journal.begin(e, alert, handler, queuedFileOf(ctx))
+	output, attempts, err := runHandler(ctx, cfg, handler, alert)
+	if runContext.Err() == nil {
+		journal.finish(id, err)
+	}
+	return output, attempts, err
+}
+
+// replayJournal runs the incomplete executions of a previous run again,
+// or only logs them without -journal-replay.
+func replayJournal(entries []journalEntry) {
+	for _, entry := range entries {
+		if entry.Record == nil || len(entry.Handler) == 0 {
+			continue
+		}
+		if entry.Queued != "" && queueDir != "" {
+			if _, err := os.Stat(entry.Queued); err == nil {
+				// recoverQueue runs the whole alert again
+				log.Printf("Handler %s for alert %s was interrupted by a crash and runs again from the queue directory",
+					entry.Handler[0], entry.Record.Alert.name())
+				continue
+			}
+		}
+		if !journalReplay {
+			log.Printf("Error: Handler %s for alert %s was interrupted by a crash and is not run again",
+				entry.Handler[0], entry.Record.Alert.name())
+			continue
+		}
+
+		pending.Add(1)
+		go func(entry journalEntry) {
+			defer pending.Done()
+			j := entry.Record.job("")
+			alert, err := j.event.prepareAlert(j.alert)
+			if err != nil {
+				log.Printf("Error: Could not replay handler %s: %s", entry.Handler[0], err)
+				return
+			}
+			log.Printf("Replaying handler %s for alert %s interrupted by a crash",
+				entry.Handler[0], alert.name())
+			_, _, err = j.event.runJournaled(runContext, getConfig(), entry.Handler, alert)
+			if err != nil {
+				log.Printf("Error: Replayed handler %s failed: %s", entry.Handler[0], err)
+			}
+		}(entry)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	// An execution that finished, one interrupted, and a partial line
+	record := `{"alert": {"status": "firing", "labels": {"alertname": "Crash"}}}`
+	lines := []string{
+		`{"id": "1-1", "type": "intent", "handler": ["done"], "record": ` + record + `}`,
+		`{"id": "1-2", "type": "intent", "handler": ["crashed", "x"], "record": ` + record + `}`,
+		`{"id": "1-1", "type": "done"}`,
+		`{"id": "1-3", "type": "int`,
+	}
+	if err = ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	j, incomplete, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incomplete) != 1 || incomplete[0].ID != "1-2" {
+		t.Fatalf("Unexpected incomplete executions: %+v", incomplete)
+	}
+	if incomplete[0].Handler[1] != "x" || incomplete[0].Record.Alert.name() != "Crash" {
+		t.Errorf("Incomplete execution not read correctly: %+v", incomplete[0])
+	}
+	if blob, _ := ioutil.ReadFile(path); len(blob) != 0 {
+		t.Errorf("Journal was not compacted on open: %s", blob)
+	}
+
+	// Every execution writes an intent and a completion
+	e := &AlertManagerEvent{}
+	id := j.begin(e, Alert{Status: "firing"}, []string{"h"}, "")
+	if len(j.open) != 1 {
+		t.Errorf("Intent not recorded: %v", j.open)
+	}
+	j.finish(id, nil)
+	if _, incomplete, err = openJournal(path); err != nil || len(incomplete) != 0 {
+		t.Errorf("Finished execution is incomplete: %v %+v", err, incomplete)
+	}
+
+	// Compaction keeps the executions still running
+	j, _, err = openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := j.begin(e, Alert{Status: "firing"}, []string{"running"}, "")
+	for i := 0; i < journalCompactLines; i++ {
+		j.finish(j.begin(e, Alert{Status: "firing"}, []string{"h"}, ""), nil)
+	}
+	if j.lines >= journalCompactLines {
+		t.Errorf("Journal of %d lines was not compacted", j.lines)
+	}
+	if _, incomplete, err = openJournal(path); err != nil || len(incomplete) != 1 ||
+		incomplete[0].ID != running {
+		t.Errorf("Compaction lost the running execution: %v %+v", err, incomplete)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.Handlers["journaled"] = Handler{Command: "/bin/bash -c \"touch " + dir + "/{{ index .Argv 0 }}\""}
+	defer delete(config.Handlers, "journaled")
+
+	journal, _, err = openJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { journal = nil }()
+
+	// An execution interrupted by a crash
+	e := &AlertManagerEvent{}
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Crash"}}
+	journal.begin(e, alert, []string{"journaled", "replayed"}, "")
+
+	// The next start replays it
+	var incomplete []journalEntry
+	journal, incomplete, err = openJournal(filepath.Join(dir, "journal"))
+	if err != nil || len(incomplete) != 1 {
+		t.Fatalf("Interrupted execution not found: %v %+v", err, incomplete)
+	}
+	journalReplay = true
+	defer func() { journalReplay = false }()
+	replayJournal(incomplete)
+	if !waitPending(5 * time.Second) {
+		t.Fatalf("Replayed execution did not finish")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "replayed")); err != nil {
+		t.Errorf("Interrupted execution was not replayed: %s", err)
+	}
+
+	if _, _, err := e.runJournaled(context.Background(), config, []string{"journaled", "direct"}, alert); err != nil {
+		t.Fatal(err)
+	}
+	if _, incomplete, err = openJournal(filepath.Join(dir, "journal")); err != nil || len(incomplete) != 0 {
+		t.Errorf("Journaled executions left incomplete: %v %+v", err, incomplete)
+	}
+}
+
+func TestJournalReplaySkipsQueued(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queueDir = dir
+	defer func() { queueDir = "" }()
+
+	config.Handlers["journaled"] = Handler{Command: "/bin/bash -c \"touch " + dir + "/{{ index .Argv 0 }}\""}
+	defer delete(config.Handlers, "journaled")
+
+	journal, _, err = openJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { journal = nil }()
+
+	// Executions of queued alerts interrupted by a crash
+	e := &AlertManagerEvent{}
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Crash"}}
+	queued := filepath.Join(dir, "queued.json")
+	if err := ioutil.WriteFile(queued, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	journal.begin(e, alert, []string{"journaled", "requeued"}, queued)
+	journal.begin(e, alert, []string{"journaled", "dequeued"}, filepath.Join(dir, "done.json"))
+
+	var incomplete []journalEntry
+	journal, incomplete, err = openJournal(filepath.Join(dir, "journal"))
+	if err != nil || len(incomplete) != 2 {
+		t.Fatalf("Interrupted executions not found: %v %+v", err, incomplete)
+	}
+	journalReplay = true
+	defer func() { journalReplay = false }()
+	replayJournal(incomplete)
+	if !waitPending(5 * time.Second) {
+		t.Fatalf("Replayed execution did not finish")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "requeued")); err == nil {
+		t.Errorf("Execution of an alert still in the queue directory was replayed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dequeued")); err != nil {
+		t.Errorf("Execution of an alert no longer queued was not replayed: %s", err)
+	}
+}
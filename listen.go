@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// socketMode is the octal permissions of Unix domain sockets
+var socketMode = "0660"
+
+// bindList collects the addresses of repeated -bind flags.
+type bindList []string
+
+func (b *bindList) String() string {
+	return strings.Join(*b, ",")
+}
+
+func (b *bindList) Set(address string) error {
+	*b = append(*b, address)
+	return nil
+}
+
+// splitBind removes an http:// or https:// prefix from a -bind address and
+// reports whether the listener uses TLS.  Other addresses use TLS when
+// tlsDefault is true.
+func splitBind(address string, tlsDefault bool) (string, bool) {
+	switch {
+	case strings.HasPrefix(address, "https://"):
+		return strings.TrimPrefix(address, "https://"), true
+	case strings.HasPrefix(address, "http://"):
+		return strings.TrimPrefix(address, "http://"), false
+	}
+	return address, tlsDefault
+}
+
+// listen opens the listener for a -bind address which is either IP:PORT or
+// unix:///path/to/socket.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, "unix://")
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid socket mode \"%s\": %s", socketMode, err)
+	}
+
+	// Remove a socket left behind by a previous run that did not exit
+	// cleanly, but never any other kind of file
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "am-event-handler.sock")
+
+	// A stale socket is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	socketMode = "0600"
+	defer func() { socketMode = "0660" }()
+	ln, err := listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(healthz)}
+	go server.Serve(ln)
+	defer server.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Socket has mode %o, expected 600", info.Mode().Perm())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Unexpected status over Unix socket: %d", resp.StatusCode)
+	}
+
+	regular := filepath.Join(dir, "regular")
+	ioutil.WriteFile(regular, nil, 0600)
+	if _, err := listen("unix://" + regular); err == nil {
+		t.Errorf("A regular file should not be replaced by a socket")
+	}
+}
+
+func TestSplitBind(t *testing.T) {
+	var tests = []struct {
+		bind       string
+		tlsDefault bool
+		address    string
+		secure     bool
+	}{
+		{"127.0.0.1:4242", false, "127.0.0.1:4242", false},
+		{"127.0.0.1:4242", true, "127.0.0.1:4242", true},
+		{"http://127.0.0.1:4242", true, "127.0.0.1:4242", false},
+		{"https://0.0.0.0:4443", false, "0.0.0.0:4443", true},
+		{"unix:///run/am.sock", false, "unix:///run/am.sock", false},
+	}
+	for _, test := range tests {
+		address, secure := splitBind(test.bind, test.tlsDefault)
+		if address != test.address || secure != test.secure {
+			t.Errorf("%s: expected %s %v, got %s %v", test.bind,
+				test.address, test.secure, address, secure)
+		}
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	// The shared test server is already running on bind
+	second := "127.0.0.1:4243"
+	go run(second)
+
+	var err error
+	for i := 0; i < 50; i++ {
+		var resp *http.Response
+		if resp, err = http.Get("http://" + second + "/healthz"); err == nil {
+			resp.Body.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("Second listener is not serving: %s", err)
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	readHeaderTimeout = 100 * time.Millisecond
+	defer func() { readHeaderTimeout = 0 }()
+
+	address := "127.0.0.1:4244"
+	go run(address)
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", address); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Listener is not serving: %s", err)
+	}
+	defer conn.Close()
+
+	// Send a partial request and stall.  The server should hang up.
+	if _, err := conn.Write([]byte("POST / HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Stalled connection was not closed by the server: %s", err)
+	}
+}
+
+func TestAdminBind(t *testing.T) {
+	admin, webhook := "127.0.0.1:4245", "127.0.0.1:4246"
+	adminBind = admin
+	defer func() { adminBind = "" }()
+	go runAdmin(admin)
+	go run(webhook)
+
+	get := func(url string) int {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get(url); err == nil {
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("Listener is not serving: %s", err)
+		return 0
+	}
+
+	for _, path := range []string{"/healthz", "/metrics"} {
+		if code := get("http://" + admin + path); code != http.StatusOK {
+			t.Errorf("Admin listener returned %d for %s", code, path)
+		}
+		if code := get("http://" + webhook + path); code == http.StatusOK {
+			t.Errorf("Webhook listener served %s with -admin-bind set", path)
+		}
+	}
+	if code := get("http://" + admin + "/handlers"); code != http.StatusNotFound {
+		t.Errorf("Admin listener returned %d for /handlers", code)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	get := func(mux *http.ServeMux) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+		return w.Code
+	}
+
+	if code := get(adminRoutes()); code != http.StatusNotFound {
+		t.Errorf("pprof served without -pprof: %d", code)
+	}
+
+	enablePprof = true
+	defer func() { enablePprof = false }()
+	if code := get(adminRoutes()); code != http.StatusOK {
+		t.Errorf("pprof not served on the admin listener with -pprof: %d", code)
+	}
+	if code := get(webhookRoutes()); code == http.StatusOK {
+		t.Errorf("pprof served on the webhook listener")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// locks serializes executions of identical commands.
+var locks = newKeyedLocks()
+
+// keyedLock is a mutex for a single key along with a count of the
+// goroutines holding or waiting on it.
+type keyedLock struct {
+	sem  chan struct{}
+	refs int
+}
+
+// keyedLocks is a set of mutexes indexed by an arbitrary string.  Mutexes
+// are created on demand and discarded once no one is using them.
+type keyedLocks struct {
+	lock  sync.Mutex
+	locks map[string]*keyedLock
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: make(map[string]*keyedLock)}
+}
+
+// lockKey builds the key identifying an execution of handler that would
+// run exe with args.
+func lockKey(handler, exe string, args []string) string {
+	h := sha256.New()
+	h.Write([]byte(handler))
+	h.Write([]byte{0})
+	h.Write([]byte(exe))
+	for _, a := range args {
+		h.Write([]byte{0})
+		h.Write([]byte(a))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tryAcquire locks key if it is available and returns false immediately
+// when the lock is held.
+func (k *keyedLocks) tryAcquire(key string) bool {
+	l := k.ref(key)
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		k.unref(key, l)
+		return false
+	}
+}
+
+// acquireContext locks key, blocking until the lock is available.  If ctx
+// is done first it gives up and returns the cause.
+func (k *keyedLocks) acquireContext(ctx context.Context, key string) error {
+	l := k.ref(key)
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		k.unref(key, l)
+		return context.Cause(ctx)
+	}
+}
+
+// ref returns the lock of key, creating it if needed, and adds a reference
+// to it.
+func (k *keyedLocks) ref(key string) *keyedLock {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{sem: make(chan struct{}, 1)}
+		k.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// release unlocks key which must have been locked by tryAcquire or
+// acquireContext.
+func (k *keyedLocks) release(key string) {
+	k.lock.Lock()
+	l := k.locks[key]
+	k.lock.Unlock()
+
+	<-l.sem
+	k.unref(key, l)
+}
+
+// unref drops a reference to l and forgets about it when unused.
+func (k *keyedLocks) unref(key string, l *keyedLock) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// globalSlots limits the number of commands running at once.  It is nil
+// when there is no limit.
+var globalSlots chan struct{}
+
+// handlerSlots limits the number of copies of each handler running at once.
+var handlerSlots = newSemaphores()
+
+// poolSlots limits the number of commands of each pool running at once.
+var poolSlots = newSemaphores()
+
+// semaphores is a set of counting semaphores indexed by handler or pool
+// name.
+type semaphores struct {
+	lock sync.Mutex
+	sems map[string]chan struct{}
+}
+
+func newSemaphores() *semaphores {
+	return &semaphores{sems: make(map[string]chan struct{})}
+}
+
+// get returns the semaphore for name with size slots.  If the size has
+// changed, for example after a configuration reload, a new semaphore
+// replaces the old one.  Executions holding the old semaphore release
+// their slot to it.
+func (s *semaphores) get(name string, size int) chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sem, ok := s.sems[name]
+	if !ok || cap(sem) != size {
+		sem = make(chan struct{}, size)
+		s.sems[name] = sem
+	}
+	return sem
+}
+
+// acquireSlots blocks until the handler name may run another copy of its
+// command within its limit of max copies, the size of its pool, if any,
+// and the global limit.  Slots are always acquired in this order so
+// executions never deadlock.  Call the returned function to release the
+// slots.  If ctx is done first the slots already acquired are released
+// and an error is returned.
+func acquireSlots(ctx context.Context, name string, max int, pool string, size int) (func(), error) {
+	var held []chan struct{}
+	release := func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			<-held[i]
+		}
+	}
+
+	var sems []chan struct{}
+	if max > 0 {
+		sems = append(sems, handlerSlots.get(name, max))
+	}
+	if pool != "" && size > 0 {
+		sems = append(sems, poolSlots.get(pool, size))
+	}
+	if global := globalSlots; global != nil {
+		sems = append(sems, global)
+	}
+	for _, sem := range sems {
+		select {
+		case sem <- struct{}{}:
+			held = append(held, sem)
+		case <-ctx.Done():
+			release()
+			return nil, fmt.Errorf("Cancelled while waiting to run handler %s: %s",
+				name, context.Cause(ctx))
+		}
+	}
+	return release, nil
+}
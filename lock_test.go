@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runConcurrently runs the "restart" handler targeting the same host twice
+// at the same time and returns how long both took to complete.
+func runConcurrently(t *testing.T) time.Duration {
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "HostDown"}}
+	handler := []string{"restart", "host1"}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := parseHandler(context.Background(), handler, alert); err != nil {
+				t.Errorf("Handler failed: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return time.Since(start)
+}
+
+func TestOverlap(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	// The mkdir fails if another copy of the command is still running
+	defer delete(config.Handlers, "restart")
+	defer os.Remove("testdata/overlap")
+
+	for _, overlap := range []string{"queue", "skip"} {
+		_ = os.Remove("testdata/overlap")
+		config.Handlers["restart"] = Handler{
+			Command: "/bin/bash -c \"mkdir testdata/running-{{ index .Argv 0 }} || touch testdata/overlap; sleep 0.5; rmdir testdata/running-{{ index .Argv 0 }}\"",
+			Overlap: overlap,
+		}
+
+		elapsed := runConcurrently(t)
+		if _, err := os.Stat("testdata/overlap"); err == nil {
+			t.Errorf("Overlap %s: handler ran concurrently for the same target", overlap)
+		}
+
+		switch overlap {
+		case "queue":
+			if elapsed < time.Second {
+				t.Errorf("Overlap queue: both executions should run one after the other, took %s", elapsed)
+			}
+		case "skip":
+			if elapsed >= time.Second {
+				t.Errorf("Overlap skip: second execution should be skipped, took %s", elapsed)
+			}
+		}
+	}
+}
+
+func TestOverlapCancelled(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["restart"] = Handler{Command: "/bin/sleep 1"}
+	defer delete(config.Handlers, "restart")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		parseHandler(context.Background(), []string{"restart"}, Alert{Status: "firing"})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// The second copy waits for the first until it is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := parseHandler(ctx, []string{"restart"}, Alert{Status: "firing"})
+	elapsed := time.Since(start)
+	<-done
+	if err == nil || elapsed > 500*time.Millisecond {
+		t.Errorf("Waiting for the same command should end when cancelled, took %s: %v", elapsed, err)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	// The mkdir fails if another copy of a handler is still running.  The
+	// argument differs for each execution so the overlap lock never applies.
+	command := "/bin/bash -c \"mkdir testdata/running || touch testdata/overlap; sleep 0.2; rmdir testdata/running; echo {{ index .Argv 0 }}\""
+	config.Handlers["one"] = Handler{Command: command, MaxConcurrent: 1}
+	config.Handlers["two"] = Handler{Command: command}
+	defer delete(config.Handlers, "one")
+	defer delete(config.Handlers, "two")
+	defer os.Remove("testdata/overlap")
+
+	run := func(handlers ...string) {
+		alert := Alert{Status: "firing"}
+		var wg sync.WaitGroup
+		for i, h := range handlers {
+			wg.Add(1)
+			go func(h string, i int) {
+				defer wg.Done()
+				if _, err := parseHandler(context.Background(), []string{h, strconv.Itoa(i)}, alert); err != nil {
+					t.Errorf("Handler failed: %s", err)
+				}
+			}(h, i)
+		}
+		wg.Wait()
+	}
+
+	_ = os.Remove("testdata/overlap")
+	run("one", "one", "one")
+	if _, err := os.Stat("testdata/overlap"); err == nil {
+		t.Errorf("Handler with max_concurrent 1 ran concurrently")
+	}
+
+	globalSlots = make(chan struct{}, 1)
+	defer func() { globalSlots = nil }()
+	_ = os.Remove("testdata/overlap")
+	run("one", "two", "two")
+	if _, err := os.Stat("testdata/overlap"); err == nil {
+		t.Errorf("Handlers ran concurrently despite a global limit of 1")
+	}
+}
+
+func TestSerializeOn(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	// The mkdir fails if another execution for the same instance is
+	// still running
+	config.Handlers["restart"] = Handler{
+		Command:     "/bin/bash -c \"mkdir testdata/serial-{{ .Labels.instance }} || touch testdata/serial-overlap; sleep 0.3; rmdir testdata/serial-{{ .Labels.instance }}; echo {{ index .Argv 0 }}\"",
+		SerializeOn: "{{ .Labels.instance }}",
+	}
+	defer delete(config.Handlers, "restart")
+	defer os.Remove("testdata/serial-overlap")
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, instance := range []string{"a", "a", "b"} {
+		wg.Add(1)
+		go func(i int, instance string) {
+			defer wg.Done()
+			alert := Alert{Status: "firing", Labels: map[string]string{"instance": instance}}
+			if _, err := parseHandler(context.Background(), []string{"restart", strconv.Itoa(i)}, alert); err != nil {
+				t.Errorf("Handler failed: %s", err)
+			}
+		}(i, instance)
+	}
+	wg.Wait()
+
+	if _, err := os.Stat("testdata/serial-overlap"); err == nil {
+		t.Errorf("Executions with the same serialization key ran concurrently")
+	}
+	if elapsed := time.Since(start); elapsed >= 900*time.Millisecond {
+		t.Errorf("Executions with different serialization keys did not run in parallel, took %s", elapsed)
+	}
+}
+
+func TestPools(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	// The mkdir fails if a command of another handler in the pool is
+	// still running
+	command := "/bin/bash -c \"mkdir testdata/pool || touch testdata/pool-overlap; sleep 0.2; rmdir testdata/pool; echo {{ index .Argv 0 }}\""
+	config.Pools = map[string]int{"db-maintenance": 1}
+	config.Handlers["vacuum"] = Handler{Command: command, Pool: "db-maintenance"}
+	config.Handlers["reindex"] = Handler{Command: command, Pool: "db-maintenance"}
+	defer func() { config.Pools = nil }()
+	defer delete(config.Handlers, "vacuum")
+	defer delete(config.Handlers, "reindex")
+	defer os.Remove("testdata/pool-overlap")
+
+	var wg sync.WaitGroup
+	for i, h := range []string{"vacuum", "reindex", "vacuum"} {
+		wg.Add(1)
+		go func(h string, i int) {
+			defer wg.Done()
+			if _, err := parseHandler(context.Background(), []string{h, strconv.Itoa(i)}, Alert{Status: "firing"}); err != nil {
+				t.Errorf("Handler failed: %s", err)
+			}
+		}(h, i)
+	}
+	wg.Wait()
+	if _, err := os.Stat("testdata/pool-overlap"); err == nil {
+		t.Errorf("Handlers in a pool of size 1 ran concurrently")
+	}
+
+	cfg := &Configuration{Handlers: map[string]Handler{
+		"vacuum": {Command: "/bin/true", Pool: "undefined"},
+	}}
+	if err := validateConfiguration(cfg); err == nil {
+		t.Errorf("Handler in an undefined pool should be rejected")
+	}
+	cfg.Pools = map[string]int{"undefined": 0}
+	if err := validateConfiguration(cfg); err == nil {
+		t.Errorf("Pool of size 0 should be rejected")
+	}
+}
+
+func TestAcquireSlotsCancelled(t *testing.T) {
+	release, err := acquireSlots(context.Background(), "busy", 1, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := acquireSlots(ctx, "busy", 1, "", 0); err == nil {
+		t.Errorf("Waiting for a slot should end when the context is done")
+	}
+}
+
+func TestAcquireContext(t *testing.T) {
+	l := newKeyedLocks()
+	if err := l.acquireContext(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquireContext(ctx, "key"); err == nil {
+		t.Errorf("Waiting for a held lock should end when the context is done")
+	}
+	l.release("key")
+	if len(l.locks) != 0 {
+		t.Errorf("Cancelled wait left the lock referenced: %v", l.locks)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockFilePoll is how often a held lock file is tried again.
+var lockFilePoll = 250 * time.Millisecond
+
+// lockFile takes an exclusive lock on the file at path, creating it if it
+// does not exist, and returns the open file holding the lock.  Closing the
+// file releases the lock.  If wait is true lockFile waits until the lock is
+// available or ctx is done, otherwise it returns nil when the lock is
+// held.
+func lockFile(ctx context.Context, path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(lockFilePoll)
+	defer ticker.Stop()
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			return f, nil
+		}
+		if !wait {
+			f.Close()
+			return nil, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("Cancelled while waiting for lock file %s: %s", path, ctx.Err())
+		}
+	}
+}
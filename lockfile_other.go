@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// tryLockFile fails as flock is not supported.
+func tryLockFile(f *os.File) (bool, error) {
+	return false, fmt.Errorf("Lock files are not supported on Windows")
+}
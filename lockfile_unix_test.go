@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	path, marker := "testdata/lockfile.lock", "testdata/lockfile"
+	defer os.Remove(path)
+	defer os.Remove(marker)
+	config.Handlers["locked"] = Handler{
+		Command:  "touch " + marker,
+		Lockfile: "testdata/{{ .Labels.alertname }}.lock",
+		Overlap:  "skip",
+	}
+	defer delete(config.Handlers, "locked")
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "lockfile"}}
+
+	held, err := lockFile(context.Background(), path, false)
+	if err != nil || held == nil {
+		t.Fatalf("Could not lock %s: %s", path, err)
+	}
+	if _, err := parseHandler(context.Background(), []string{"locked"}, alert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("Handler ran while its lock file was held")
+	}
+
+	// Without overlap: skip the execution waits for the lock
+	h := config.Handlers["locked"]
+	h.Overlap = ""
+	config.Handlers["locked"] = h
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if f, err := lockFile(ctx, path, true); err == nil || f != nil {
+		t.Errorf("Waiting on a held lock file should stop with the context")
+	}
+	time.AfterFunc(300*time.Millisecond, func() { held.Close() })
+	if _, err := parseHandler(context.Background(), []string{"locked"}, alert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Handler did not run once its lock file was released: %s", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// instanceLabel identifies this deployment in logs and audit records
+	instanceLabel string
+
+	// logFormat is "text" for plain log lines or "json" for one JSON
+	// record per line
+	logFormat = "text"
+
+	// logLevel is the current log level which may be changed at runtime
+	logLevel int32 = levelInfo
+)
+
+// Log levels from least to most verbose.
+const (
+	levelError int32 = iota
+	levelInfo
+	levelVerbose
+)
+
+// levelNames are the names of the log levels.
+var levelNames = []string{"error", "info", "verbose"}
+
+// parseLogLevel returns the log level called name.
+func parseLogLevel(name string) (int32, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level \"%s\", use error, info, or verbose", name)
+}
+
+// setLogLevel changes the log level.
+func setLogLevel(level int32) {
+	atomic.StoreInt32(&logLevel, level)
+}
+
+// getLogLevel returns the name of the current log level.
+func getLogLevel() string {
+	return levelNames[atomic.LoadInt32(&logLevel)]
+}
+
+// logEnabled returns true if records of level are logged.
+func logEnabled(level string) bool {
+	l, err := parseLogLevel(level)
+	return err != nil || l <= atomic.LoadInt32(&logLevel)
+}
+
+// verboseLogging returns true if request bodies, responses, and other
+// details are logged.
+func verboseLogging() bool {
+	return atomic.LoadInt32(&logLevel) >= levelVerbose
+}
+
+// logFields are the structured fields of a log record.
+type logFields map[string]interface{}
+
+// logWriter receives the lines written by the standard logger, drops those
+// below the log level, and writes them as text or JSON records.
+type logWriter struct {
+	lock sync.Mutex
+	out  io.Writer
+	json bool
+}
+
+// Write receives a single log line from the standard logger.
+func (w *logWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	level := "info"
+	if strings.HasPrefix(msg, "Error") {
+		level = "error"
+	}
+	w.writeRecord(level, msg, nil)
+	return len(p), nil
+}
+
+// writeRecord writes a log record if level is enabled.
+func (w *logWriter) writeRecord(level, msg string, fields logFields) {
+	if !logEnabled(level) {
+		return
+	}
+
+	var line []byte
+	if w.json {
+		record := logFields{}
+		for k, v := range fields {
+			record[k] = v
+		}
+		record["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+		record["level"] = level
+		record["msg"] = msg
+		if instanceLabel != "" {
+			record["instance"] = instanceLabel
+		}
+
+		var err error
+		if line, err = json.Marshal(record); err != nil {
+			line, _ = json.Marshal(logFields{"level": "error", "msg": err.Error()})
+		}
+	} else {
+		line = []byte(time.Now().Format("2006/01/02 15:04:05 "))
+		if instanceLabel != "" {
+			line = append(line, "instance="+instanceLabel+" "...)
+		}
+		line = append(line, msg...)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.out.Write(append(line, '\n'))
+}
+
+// logRecord logs msg at level with structured fields.  Plain text logs only
+// include msg.
+func logRecord(level, msg string, fields logFields) {
+	if w, ok := log.Writer().(*logWriter); ok {
+		w.writeRecord(level, msg, fields)
+		return
+	}
+	if logEnabled(level) {
+		log.Print(msg)
+	}
+}
+
+// configureLogging sets up the standard logger for the -log-format.  When
+// an instance label is set every log line is tagged with it.
+func configureLogging() {
+	out := log.Writer()
+	if w, ok := out.(*logWriter); ok {
+		out = w.out
+	}
+
+	log.SetPrefix("")
+	log.SetFlags(0)
+	log.SetOutput(&logWriter{out: out, json: logFormat == "json"})
+}
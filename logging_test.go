@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInstanceLabel(t *testing.T) {
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	instanceLabel = "dal09"
+	configureLogging()
+	defer func() {
+		instanceLabel = ""
+		configureLogging()
+	}()
+
+	log.Printf("Processing Alert: %s", "TestAlert")
+	if !strings.Contains(logs.String(), "instance=dal09 Processing Alert: TestAlert") {
+		t.Errorf("Log line not tagged with instance label: %s", logs.String())
+	}
+
+	record := newAuditRecord(&AlertManagerEvent{})
+	if record.Instance != "dal09" {
+		t.Errorf("Audit record not tagged with instance label: %#v", record)
+	}
+}
+
+func TestJSONLogging(t *testing.T) {
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	logFormat = "json"
+	instanceLabel = "dal09"
+	configureLogging()
+	defer func() {
+		logFormat = "text"
+		instanceLabel = ""
+		configureLogging()
+	}()
+
+	log.Printf("Error: Something broke")
+	logRecord("info", "Command ran", logFields{"request_id": "abc123", "exit_code": 0})
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log records, got: %s", logs.String())
+	}
+
+	records := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &records[i]); err != nil {
+			t.Fatalf("Log record is not valid JSON: %s: %s", err, line)
+		}
+		if records[i]["instance"] != "dal09" || records[i]["timestamp"] == nil {
+			t.Errorf("Log record missing instance or timestamp: %s", line)
+		}
+	}
+
+	if records[0]["level"] != "error" || records[0]["msg"] != "Error: Something broke" {
+		t.Errorf("Unexpected record for log line: %v", records[0])
+	}
+	if records[1]["level"] != "info" || records[1]["request_id"] != "abc123" ||
+		records[1]["exit_code"] != float64(0) {
+		t.Errorf("Unexpected structured record: %v", records[1])
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	configureLogging()
+	defer setLogLevel(levelVerbose)
+
+	setLogLevel(levelError)
+	log.Printf("Processing Alert: %s", "TestAlert")
+	log.Printf("Error: Something broke")
+	logRecord("info", "Command ran", nil)
+	logRecord("error", "Command failed", nil)
+	if strings.Contains(logs.String(), "Processing Alert") || strings.Contains(logs.String(), "Command ran") {
+		t.Errorf("Info records logged at level error: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "Error: Something broke") || !strings.Contains(logs.String(), "Command failed") {
+		t.Errorf("Error records not logged: %s", logs.String())
+	}
+	if verboseLogging() {
+		t.Errorf("Verbose logging enabled at level error")
+	}
+
+	url := "http://" + bind + "/api/v1/loglevel"
+	req, _ := http.NewRequest("PUT", url, strings.NewReader(`{"level": "verbose"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !verboseLogging() {
+		t.Errorf("PUT /api/v1/loglevel did not enable verbose logging: %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("PUT", url, strings.NewReader(`{"level": "chatty"}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown log level, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	info := logLevelInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil || info.Level != "verbose" {
+		t.Errorf("Unexpected log level from GET: %#v %v", info, err)
+	}
+}
@@ -2,18 +2,34 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v2"
 )
 
@@ -31,15 +47,72 @@ var (
 	// debug can be set to true to disable running of external commands
 	debug bool
 
-	// verbose can be set to true to enable more verbose logging
-	verbose bool
-
 	// timeout is the time we wait for each command run to complete before
 	// canceling it.
 	timeout time.Duration
 
-	// config is a pointer to the global configuration object
+	// waitDelay is how long to wait for the output of a command to be
+	// closed after it exits or is killed.  Processes that escaped the
+	// command's process group may hold it open indefinitely.
+	waitDelay = 5 * time.Second
+
+	// killGrace is how long a command has to exit after SIGTERM before it
+	// is killed with SIGKILL.  Zero kills it immediately.
+	killGrace time.Duration
+
+	// cgroupRoot is a delegated cgroup v2 directory.  When set every
+	// command runs in a transient cgroup created below it.
+	cgroupRoot string
+
+	// alertConcurrency is how many alerts of a webhook request have their
+	// handlers run at once
+	alertConcurrency = 1
+
+	// config is a pointer to the global configuration object.  Use
+	// getConfig() and setConfig() to access it safely.
 	config *Configuration
+
+	// configLock protects config
+	configLock sync.RWMutex
+
+	// nameLabel is the label used to identify alerts in logs
+	nameLabel string
+
+	// handlerSeparator separates multiple handlers in the handler annotation
+	handlerSeparator string
+
+	// configFormat forces the format of configuration files.  When empty
+	// the format is chosen by the file extension.
+	configFormat string
+
+	// strictTemplates causes templates referencing missing map keys to
+	// fail rather than render an empty string
+	strictTemplates bool
+
+	// maxBody is the largest request body in bytes accepted by the
+	// webhook.  Zero means unlimited.
+	maxBody int64
+
+	// adminBind is the address of a separate listener for the health
+	// checks and metrics.  When empty they are served on every -bind
+	// listener.
+	adminBind string
+
+	// enablePprof serves the net/http/pprof endpoints on the -admin-bind
+	// listener
+	enablePprof bool
+
+	// readTimeout, readHeaderTimeout, writeTimeout, and idleTimeout
+	// configure the HTTP servers.  Zero means no timeout.
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	// http2 enables HTTP/2 on TLS listeners and h2c enables HTTP/2 without
+	// TLS on the other listeners
+	http2 = true
+	h2c   bool
 )
 
 // Alert represents an individual alert from Prometheus and included in the
@@ -51,6 +124,7 @@ type Alert struct {
 	StartsAt     string            `json:"startsAt"`
 	EndsAt       string            `json:"endsAt"`
 	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint,omitempty"`
 
 	// Timestamp is a string representing the time Alertmanager hit this
 	// API.  Useful for logging.
@@ -60,9 +134,26 @@ type Alert struct {
 	// can be exposed to the template.
 	Argv []string `json:"-"`
 
+	// Result is the JSON standard output of the previous step of a
+	// pipeline, if any, available to the templates of the next step.
+	Result interface{} `json:"-"`
+
 	// Json is not from the alert JSON but holds a JSON formatted string
 	// of this alert.  It is not the same JSON as originally passed in.
 	Json string `json:"-"`
+
+	// Group is not in the alert JSON and holds the fields of the
+	// notification the alert arrived in for the templates.
+	Group Group `json:"-"`
+
+	// requestID identifies the webhook request the alert arrived in
+	requestID string
+
+	// trace is the trace context of the webhook request, if any
+	trace *traceContext
+
+	// event is the notification the alert arrived in
+	event *AlertManagerEvent
 }
 
 // AlertManagerEvent represents the JSON struct that is POST'd to a web_hook
@@ -73,7 +164,94 @@ type AlertManagerEvent struct {
 	Status      string
 	Receiver    string
 	ExternalURL string
+	GroupKey    GroupKey
 	Alerts      []Alert
+
+	GroupLabels       map[string]string
+	CommonLabels      map[string]string
+	CommonAnnotations map[string]string
+
+	// handler, when set, is run for every alert instead of the handler
+	// named by the alert
+	handler []string
+
+	// requestID identifies the webhook request in logs
+	requestID string
+
+	// trace is the trace context of the webhook request, if any
+	trace *traceContext
+
+	// test is set for synthetic alerts of the test API, which must not
+	// affect the handlers of real alerts
+	test bool
+
+	// ran holds the event scoped handlers already run for this event.  It
+	// is guarded by ranLock.
+	ran map[string]bool
+}
+
+// Group holds the fields of an AlertManagerEvent common to all of its
+// alerts.
+type Group struct {
+	Key               string
+	Status            string
+	Receiver          string
+	ExternalURL       string
+	Labels            map[string]string
+	CommonLabels      map[string]string
+	CommonAnnotations map[string]string
+}
+
+// group returns the group fields of e.
+func (e *AlertManagerEvent) group() Group {
+	return Group{
+		Key:               string(e.GroupKey),
+		Status:            e.Status,
+		Receiver:          e.Receiver,
+		ExternalURL:       e.ExternalURL,
+		Labels:            e.GroupLabels,
+		CommonLabels:      e.CommonLabels,
+		CommonAnnotations: e.CommonAnnotations,
+	}
+}
+
+// GroupKey identifies the alert group of a notification.  Old
+// Alertmanagers send it as a number.
+type GroupKey string
+
+// UnmarshalJSON accepts a number as well as a string.
+func (g *GroupKey) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*g = GroupKey(str)
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("groupKey must be a string or a number")
+	}
+	*g = GroupKey(number)
+	return nil
+}
+
+// ranLock guards the ran field of every AlertManagerEvent.
+var ranLock sync.Mutex
+
+// claim returns true the first time it is called with handler for e, which
+// is when an event scoped handler should run.
+func (e *AlertManagerEvent) claim(handler []string) bool {
+	ranLock.Lock()
+	defer ranLock.Unlock()
+
+	key := strings.Join(handler, " ")
+	if e.ran[key] {
+		return false
+	}
+	if e.ran == nil {
+		e.ran = make(map[string]bool)
+	}
+	e.ran[key] = true
+	return true
 }
 
 // Configuration is the Golang type that represents the YAML structure of
@@ -81,222 +259,1959 @@ type AlertManagerEvent struct {
 type Configuration struct {
 	// Handlers is a hash of handler name to the definition of what will
 	// be executed.
-	Handlers map[string]struct {
+	Handlers map[string]Handler
+
+	// SpecialHandlers renames the meta handlers
+	SpecialHandlers SpecialHandlers `yaml:"special_handlers" toml:"special_handlers"`
+
+	// Defaults are inherited by every handler that does not set its own
+	Defaults Defaults
+
+	// HandlerSource lists where the handler of an alert is found
+	HandlerSource HandlerSource `yaml:"handler_source" toml:"handler_source"`
+
+	// Receivers maps Alertmanager receiver names to the handler run for
+	// alerts without a handler annotation in place of the default handler
+	Receivers map[string]string
+
+	// Pools maps the names of resource pools to their size, the number of
+	// commands of all handlers in the pool that may run at once
+	Pools map[string]int
+
+	// Include lists further configuration files, which may be glob
+	// patterns, to load.  Relative paths are relative to the including
+	// file.
+	Include []string
+
+	// TemplateFiles lists files, which may be glob patterns, defining
+	// named templates that handler templates may use.  Relative paths are
+	// relative to the file listing them.
+	TemplateFiles []string `yaml:"template_files" toml:"template_files"`
+
+	// included holds the files loaded through Include
+	included []string
+
+	// templateFiles holds the files loaded through TemplateFiles
+	templateFiles []string
+
+	// templates holds the named templates defined in templateFiles
+	templates *template.Template
+}
+
+// HandlerSource is an ordered list of places to look for an alert's
+// handler.  Each is "annotation:NAME" or "label:NAME" and a bare NAME is an
+// annotation.  It may be written in the configuration as a list or a comma
+// separated string.
+type HandlerSource []string
+
+// UnmarshalYAML accepts a comma separated string as well as a list.
+func (h *HandlerSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*h = list
+		return nil
+	}
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+	*h = strings.Split(str, ",")
+	return nil
+}
+
+// UnmarshalTOML accepts a comma separated string as well as a list.
+func (h *HandlerSource) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*h = strings.Split(v, ",")
+	case []interface{}:
+		*h = make(HandlerSource, len(v))
+		for i, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("Handler source must be a string or list of strings")
+			}
+			(*h)[i] = str
+		}
+	default:
+		return fmt.Errorf("Handler source must be a string or list of strings")
+	}
+	return nil
+}
+
+// parse splits each source into its kind, "annotation" or "label", and
+// name.
+func (h HandlerSource) parse() ([][2]string, error) {
+	sources := make([][2]string, 0, len(h))
+	for _, src := range h {
+		src = strings.TrimSpace(src)
+		kind, name := "annotation", src
+		if i := strings.Index(src, ":"); i >= 0 {
+			kind, name = src[:i], src[i+1:]
+		}
+		if kind != "annotation" && kind != "label" {
+			return nil, fmt.Errorf("Unknown handler source \"%s\"", src)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("Handler source \"%s\" has no name", src)
+		}
+		sources = append(sources, [2]string{kind, name})
+	}
+	return sources, nil
+}
+
+// Defaults holds the handler settings inherited by all handlers.
+type Defaults struct {
+	Timeout time.Duration
+	Status  StatusFilter
+	Env     map[string]string
+	Workdir string
+	Shell   *bool
+
+	StrictTemplates *bool `yaml:"strict_templates" toml:"strict_templates"`
+}
+
+// SpecialHandlers holds the names of the meta handlers.  Empty values use
+// the default names of "default" and "all".
+type SpecialHandlers struct {
+	// Default is run for alerts without a handler annotation
+	Default string
+
+	// All is run for every alert
+	All string
+
+	// Flapping is run in place of the handlers of a flapping alert
+	Flapping string
+}
+
+// defaultHandler returns the name of the handler run for alerts without a
+// handler annotation.
+func (c *Configuration) defaultHandler() string {
+	if c.SpecialHandlers.Default != "" {
+		return c.SpecialHandlers.Default
+	}
+	return "default"
+}
+
+// handlerOf returns the handler string of alert from the first configured
+// handler source the alert has.  By default this is the "handler"
+// annotation.
+func (c *Configuration) handlerOf(a Alert) (string, bool) {
+	sources, err := c.HandlerSource.parse()
+	if err != nil || len(sources) == 0 {
+		sources = [][2]string{{"annotation", "handler"}}
+	}
+	for _, src := range sources {
+		values := a.Annotations
+		if src[0] == "label" {
+			values = a.Labels
+		}
+		if v, ok := values[src[1]]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// receiverHandler returns the name of the handler run for alerts sent to
+// receiver without a handler annotation.
+func (c *Configuration) receiverHandler(receiver string) string {
+	if h, ok := c.Receivers[receiver]; ok {
+		return h
+	}
+	return c.defaultHandler()
+}
+
+// allHandler returns the name of the handler run for every alert.
+func (c *Configuration) allHandler() string {
+	if c.SpecialHandlers.All != "" {
+		return c.SpecialHandlers.All
+	}
+	return "all"
+}
+
+// flappingHandler returns the name of the handler run in place of the
+// handlers of a flapping alert.
+func (c *Configuration) flappingHandler() string {
+	if c.SpecialHandlers.Flapping != "" {
+		return c.SpecialHandlers.Flapping
+	}
+	return "flapping"
+}
+
+// Handler is the definition of a command to execute for an alert.
+type Handler struct {
+	// Command is the go template string of the command to execute
+	Command string
+
+	// Args is set instead of Command when the command is written as a list.
+	// Each element is a go template string rendered into exactly one
+	// argument so label values containing spaces or quotes are passed
+	// through unchanged.
+	Args []string `yaml:"-" toml:"-"`
+
+	// Group is a list of other handlers to run in order instead of a
+	// command.  Each handler in the group receives the same arguments.
+	Group []string
+
+	// Pipeline is a list of other handlers to run in order instead of a
+	// command where each receives the standard output of the previous one
+	// on its standard input.  Each handler receives the same arguments.
+	Pipeline []string
+
+	// Env holds environment variables set for the command in addition to
+	// those of am-event-handler.  The values are go template strings.
+	Env map[string]string
+
+	// Enabled may be set to false to disable the handler without removing
+	// it from the configuration.
+	Enabled *bool
+
+	// Shell runs the rendered command with /bin/sh -c rather than splitting
+	// it into arguments so pipes and redirection may be used.
+	Shell *bool
+
+	// StrictTemplates fails the handler when its templates reference a
+	// missing label or other map key rather than rendering an empty
+	// string.  The default is -strict-templates.
+	StrictTemplates *bool `yaml:"strict_templates" toml:"strict_templates"`
+
+	// Workdir is the working directory of the command.  By default it is
+	// the working directory of am-event-handler.
+	Workdir string
+
+	// Runner selects how the command is run.  "local", the default, runs
+	// it directly, "docker" runs it in a container described by Docker,
+	// "ssh" runs it on the remote host described by SSH, and "systemd"
+	// runs it in a transient systemd unit described by Systemd.
+	Runner string
+
+	// Docker holds the container settings of the docker runner
+	Docker *DockerRunner
+
+	// SSH holds the remote host settings of the ssh runner
+	SSH *SSHRunner `yaml:"ssh" toml:"ssh"`
+
+	// Systemd holds the unit settings of the systemd runner
+	Systemd *SystemdRunner
+
+	// Sandbox, if set, restricts the file system paths and system calls
+	// available to the command.  Local runner on Linux only.
+	Sandbox *Sandbox
+
+	// Stdin selects what is written to the command's standard input.
+	// "alert_json" writes the alert as JSON and "event_json" the whole
+	// notification.  By default standard input is empty.
+	Stdin string
+
+	// StdinTemplate is a go template string whose rendered output is
+	// written to the command's standard input in place of Stdin.
+	StdinTemplate string `yaml:"stdin_template" toml:"stdin_template"`
+
+	// Payload is "tempfile" to write the alert as JSON, or the whole
+	// notification for the event scope, to a temporary file whose path is
+	// passed in AM_PAYLOAD_FILE.  The file is removed after execution.
+	Payload string
+
+	// Scope is "alert", the default, to run the handler for every alert
+	// naming it or "event" to run it once per notification.
+	Scope string
+
+	// Status is the status of the alert, either "firing" or "resolved",
+	// that will trigger the handler execution.  A "*" character selects
+	// any alert status.  Several statuses may be given as a list or
+	// separated by commas.
+	Status StatusFilter
+
+	// Timeout overrides the global -timeout for this handler's command
+	Timeout time.Duration
+
+	// KillGrace overrides the global -kill-grace for this handler's
+	// command
+	KillGrace time.Duration `yaml:"kill_grace" toml:"kill_grace"`
+
+	// MaxOutputBytes limits how much of the command's output is kept.
+	// Output beyond this is discarded.  Zero means unlimited.
+	MaxOutputBytes int `yaml:"max_output_bytes" toml:"max_output_bytes"`
+
+	// MaxMemory is the maximum size in bytes of the address space of the
+	// command.  Zero means unlimited.  Linux only.
+	MaxMemory uint64 `yaml:"max_memory" toml:"max_memory"`
+
+	// MaxCPU is the maximum CPU time the command may consume before it is
+	// killed.  Zero means unlimited.  Linux only.
+	MaxCPU time.Duration `yaml:"max_cpu" toml:"max_cpu"`
+
+	// MaxOpenFiles is the maximum number of files the command may have
+	// open at once.  Zero means unlimited.  Linux only.
+	MaxOpenFiles uint64 `yaml:"max_open_files" toml:"max_open_files"`
+
+	// Nice is the scheduling priority of the command from -20, the
+	// highest, to 19, the lowest.  Zero leaves the priority unchanged.
+	// Linux only.
+	Nice int
+
+	// CgroupMemory is the memory.max in bytes of the command's cgroup.
+	// Zero means unlimited.  Requires -cgroup-root.
+	CgroupMemory uint64 `yaml:"cgroup_memory" toml:"cgroup_memory"`
+
+	// CgroupCPU is the number of CPUs the command's cgroup may use, for
+	// example 0.5 for half of one CPU.  Zero means unlimited.  Requires
+	// -cgroup-root.
+	CgroupCPU float64 `yaml:"cgroup_cpu" toml:"cgroup_cpu"`
+
+	// Windows are the periods of time this handler is active.  Alerts
+	// arriving outside all windows do not run the handler.  No windows
+	// means the handler is always active.
+	Windows []Window
+
+	// MaxConcurrent is the maximum number of copies of this handler that
+	// may run at once.  Further executions wait for a running copy to
+	// finish.  Zero means unlimited.
+	MaxConcurrent int `yaml:"max_concurrent" toml:"max_concurrent"`
+
+	// Pool is the name of the resource pool the handler's commands count
+	// against.  Executions wait while the pool is full.
+	Pool string
+
+	// SerializeOn is a go template string rendering the serialization key
+	// of an execution.  Executions of any handler with the same key run
+	// one at a time while different keys run in parallel.  An empty key
+	// is not serialized.
+	SerializeOn string `yaml:"serialize_on" toml:"serialize_on"`
+
+	// Lockfile is a go template string rendering the path of a file that
+	// is locked with flock while the handler runs, so that it does not
+	// race other programs using the same lock.  Overlap controls whether
+	// a held lock is waited for or the execution skipped.
+	Lockfile string
+
+	// Overlap controls what happens when this handler is asked to run the
+	// exact same command as an execution still in progress, or its
+	// Lockfile is held.  "queue" (the default) waits for the running
+	// command to finish and "skip" does not run the command at all.
+	Overlap string
+
+	// Retries is the number of times a failed command is run again before
+	// giving up.  The delay between attempts starts at one second and
+	// doubles after each attempt.
+	Retries int
+
+	// RetryOn lists the exit codes of failures worth retrying.  Other
+	// failures are permanent and not retried.  When empty every failure is
+	// retried.
+	RetryOn []int `yaml:"retry_on" toml:"retry_on"`
+
+	// Ignore lists exit codes that do not indicate a failure.  Commands
+	// exiting with one of them are reported as successful.
+	Ignore []int
+
+	// CircuitFailures is the number of consecutive failed executions that
+	// open the handler's circuit.  While open the handler is not run.
+	// Zero disables the circuit breaker.
+	CircuitFailures int `yaml:"circuit_failures" toml:"circuit_failures"`
+
+	// CircuitCooldown is how long the circuit stays open before a single
+	// execution is tried again.  The default is five minutes.
+	CircuitCooldown time.Duration `yaml:"circuit_cooldown" toml:"circuit_cooldown"`
+
+	// Cooldown is the minimum time between runs of this handler for the
+	// same alert and status.  Alerts arriving sooner are skipped.  Zero
+	// disables the cooldown.
+	Cooldown time.Duration
+
+	// WaitFor defers running the handler for a firing alert.  The handler
+	// is skipped if the alert is resolved before the wait is over.
+	WaitFor time.Duration `yaml:"wait_for" toml:"wait_for"`
+
+	// CancelOnResolve kills the handler's commands still running for a
+	// firing alert when a resolved notification for it arrives.
+	CancelOnResolve bool `yaml:"cancel_on_resolve" toml:"cancel_on_resolve"`
+
+	// Callback is a URL the result of each execution of the handler is
+	// POST'd to.  The default is -callback-url.
+	Callback string
+}
+
+// UnmarshalYAML allows a handler to be defined as a list of handler names,
+// making it a group, or as a command string as well as the full structure.
+// The command itself may be a string or a list of arguments.
+func (h *Handler) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var group []string
+	if err := unmarshal(&group); err == nil {
+		*h = Handler{Group: group}
+		return nil
+	}
+	var command string
+	if err := unmarshal(&command); err == nil {
+		*h = Handler{Command: command}
+		return nil
+	}
+
+	// A command given as a list is removed from the mapping and stored in
+	// Args as the Command field only accepts a string
+	type plain Handler
+	var fields yaml.MapSlice
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	for i, item := range fields {
+		list, ok := item.Value.([]interface{})
+		if item.Key != "command" || !ok {
+			continue
+		}
+		args := make([]string, len(list))
+		for j, a := range list {
+			args[j] = fmt.Sprint(a)
+		}
+		body, err := yaml.Marshal(append(fields[:i:i], fields[i+1:]...))
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(body, (*plain)(h)); err != nil {
+			return err
+		}
+		h.Args = args
+		return nil
+	}
+
+	return unmarshal((*plain)(h))
+}
+
+// members returns the handlers of a group or pipeline.
+func (h Handler) members() []string {
+	if len(h.Pipeline) > 0 {
+		return h.Pipeline
+	}
+	return h.Group
+}
+
+// templates returns the command templates of the handler.
+func (h Handler) templates() []string {
+	if len(h.Args) > 0 {
+		return h.Args
+	}
+	return []string{h.Command}
+}
+
+// StatusFilter is a comma separated list of alert statuses.  It may be
+// written in the configuration as a string or as a list.
+type StatusFilter string
+
+// UnmarshalYAML accepts a list of statuses as well as a string.
+func (s *StatusFilter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*s = StatusFilter(strings.Join(list, ","))
+		return nil
+	}
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+	*s = StatusFilter(str)
+	return nil
+}
+
+// UnmarshalTOML accepts a list of statuses as well as a string.
+func (s *StatusFilter) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*s = StatusFilter(v)
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("Status must be a string or list of strings")
+			}
+			list[i] = str
+		}
+		*s = StatusFilter(strings.Join(list, ","))
+	default:
+		return fmt.Errorf("Status must be a string or list of strings")
+	}
+	return nil
+}
+
+// statuses returns the individual statuses in the filter.
+func (s StatusFilter) statuses() []string {
+	var list []string
+	for _, status := range strings.Split(string(s), ",") {
+		if status = strings.TrimSpace(status); status != "" {
+			list = append(list, status)
+		}
+	}
+	return list
+}
+
+// match returns true if an alert with the given status passes the filter.
+func (s StatusFilter) match(status string) bool {
+	for _, f := range s.statuses() {
+		if f == "*" || f == status {
+			return true
+		}
+	}
+	return false
+}
+
+// status returns the alert statuses that trigger the handler.
+func (h Handler) status() StatusFilter {
+	if h.Status == "" {
+		// Default value for non-specified status
+		return "firing"
+	}
+	return h.Status
+}
+
+// enabled returns true unless the handler has been disabled.
+func (h Handler) enabled() bool {
+	return h.Enabled == nil || *h.Enabled
+}
+
+// shell returns true if the handler's command is run by the shell.
+func (h Handler) shell() bool {
+	return h.Shell != nil && *h.Shell
+}
+
+// strict returns true if the handler's templates fail on missing map keys.
+func (h Handler) strict() bool {
+	if h.StrictTemplates != nil {
+		return *h.StrictTemplates
+	}
+	return strictTemplates
+}
+
+// timeout returns how long the handler's command may run before it is
+// killed.
+func (h Handler) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return timeout
+}
+
+// killGrace returns how long the handler's command has to exit after
+// SIGTERM before it is killed.
+func (h Handler) killGrace() time.Duration {
+	if h.KillGrace > 0 {
+		return h.KillGrace
+	}
+	return killGrace
+}
+
+// input returns what is written to the standard input of the command run
+// by handler for alert, or nil for nothing.
+func (h Handler) input(handler []string, alert Alert) ([]byte, error) {
+	if h.StdinTemplate != "" {
+		rendered, err := renderHandler(handler, h.StdinTemplate, alert)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(rendered), nil
+	}
+	return encodePayload(h.Stdin, alert)
+}
+
+// containsCode returns true if code is one of codes.
+func containsCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable returns true if the failed execution ending with err should
+// be retried.
+func (h Handler) retryable(err error) bool {
+	if len(h.RetryOn) == 0 {
+		return true
+	}
+	return containsCode(h.RetryOn, exitCode(err))
+}
+
+// ignored returns true if err is the command exiting with one of the exit
+// codes the handler ignores.
+func (h Handler) ignored(err error) bool {
+	code := exitCode(err)
+	return code > 0 && containsCode(h.Ignore, code)
+}
+
+// circuitCooldown returns how long the handler's circuit stays open.
+func (h Handler) circuitCooldown() time.Duration {
+	if h.CircuitCooldown > 0 {
+		return h.CircuitCooldown
+	}
+	return defaultCircuitCooldown
+}
+
+// Error handling
+type EventError struct {
+	code   int
+	object string
+}
+
+func (e EventError) Error() string {
+	switch e.code {
+	case EMISSING:
+		return fmt.Sprintf("Handler %s is not defined or missing from configration",
+			e.object)
+	}
+
+	return "Undefined event error"
+}
+
+// fingerprint returns the Alertmanager supplied fingerprint of the alert.
+// Older Alertmanagers do not send one in which case it is computed from the
+// alert's labels the same way Prometheus does.
+func (a Alert) fingerprint() string {
+	if a.Fingerprint != "" {
+		return a.Fingerprint
+	}
+
+	names := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	for _, k := range names {
+		h.Write([]byte(k))
+		h.Write([]byte{255})
+		h.Write([]byte(a.Labels[k]))
+		h.Write([]byte{255})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// name returns the string used to identify the alert in logs.  This is the
+// value of the label selected by the -name-label flag, falling back to the
+// alertname label and then the alert's fingerprint.
+func (a Alert) name() string {
+	if v := a.Labels[nameLabel]; v != "" {
+		return v
+	}
+	if v := a.Labels["alertname"]; v != "" {
+		return v
+	}
+	return a.fingerprint()
+}
+
+// replace is a helper function for templating to do simple substitution.
+func replace(a, b, c string) string {
+	return strings.Replace(a, b, c, -1)
+}
+
+// getConfig returns the currently active configuration.
+func getConfig() *Configuration {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+// setConfig replaces the active configuration with cfg.
+func setConfig(cfg *Configuration) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	config = cfg
+}
+
+// configurationFiles returns the list of configuration files path refers
+// to.  If path is a directory this is all the *.yaml, *.json, and *.toml
+// files within it in lexical order.
+func configurationFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	for _, ext := range []string{"*.yaml", "*.json", "*.toml"} {
+		matches, err := filepath.Glob(filepath.Join(path, ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// formatOf returns the format of the configuration file: "yaml", "json",
+// or "toml".
+func formatOf(file string) string {
+	if configFormat != "" {
+		return configFormat
+	}
+
+	if isURL(file) {
+		if u, err := url.Parse(file); err == nil {
+			file = u.Path
+		}
+	}
+	switch filepath.Ext(file) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	}
+	return "yaml"
+}
+
+// loadConfiguration reads the configuration from path which may be a file
+// or a directory of files, an HTTP(S) URL, or a Consul KV prefix.  The
+// handlers defined in each file, and the files they include, are merged and
+// a handler may only be defined once.
+func loadConfiguration(path string) (*Configuration, error) {
+	if isURL(path) || isConsul(path) {
+		var cfg *Configuration
+		var err error
+		if isURL(path) {
+			cfg, err = newRemoteConfig(path).fetch()
+		} else {
+			var consul *consulConfig
+			if consul, err = newConsulConfig(path); err == nil {
+				cfg, err = consul.fetch(false)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := finishRemoteConfiguration(path, cfg); err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+
+	files, err := configurationFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Configuration{Handlers: make(map[string]Handler)}
+	source := make(map[string]string)
+	defaults := ""
+	loaded := make(map[string]bool)
+
+	// merge adds the configuration in file, and any files it includes, to
+	// cfg.  Each file is only loaded once.
+	var merge func(file string) error
+	merge = func(file string) error {
+		if abs, err := filepath.Abs(file); err == nil {
+			if loaded[abs] {
+				return nil
+			}
+			loaded[abs] = true
+		}
+
+		c, err := loadConfigurationFile(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		for name, h := range c.Handlers {
+			if prev, ok := source[name]; ok {
+				return fmt.Errorf("Handler %s is defined in both %s and %s",
+					name, prev, file)
+			}
+			source[name] = file
+			cfg.Handlers[name] = h
+		}
+		for receiver, h := range c.Receivers {
+			if prev, ok := cfg.Receivers[receiver]; ok && prev != h {
+				return fmt.Errorf("%s: Conflicting handlers %s and %s for receiver %s",
+					file, prev, h, receiver)
+			}
+			if cfg.Receivers == nil {
+				cfg.Receivers = make(map[string]string)
+			}
+			cfg.Receivers[receiver] = h
+		}
+		for pool, size := range c.Pools {
+			if prev, ok := cfg.Pools[pool]; ok && prev != size {
+				return fmt.Errorf("%s: Conflicting sizes %d and %d for pool %s",
+					file, prev, size, pool)
+			}
+			if cfg.Pools == nil {
+				cfg.Pools = make(map[string]int)
+			}
+			cfg.Pools[pool] = size
+		}
+		if err := mergeSpecial(&cfg.SpecialHandlers.Default, c.SpecialHandlers.Default); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if err := mergeSpecial(&cfg.SpecialHandlers.All, c.SpecialHandlers.All); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if err := mergeSpecial(&cfg.SpecialHandlers.Flapping, c.SpecialHandlers.Flapping); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if len(c.HandlerSource) > 0 {
+			if len(cfg.HandlerSource) > 0 && !reflect.DeepEqual(cfg.HandlerSource, c.HandlerSource) {
+				return fmt.Errorf("%s: Conflicting handler sources %s and %s", file,
+					strings.Join(cfg.HandlerSource, ","), strings.Join(c.HandlerSource, ","))
+			}
+			cfg.HandlerSource = c.HandlerSource
+		}
+		if !reflect.DeepEqual(c.Defaults, Defaults{}) {
+			if defaults != "" {
+				return fmt.Errorf("Defaults are defined in both %s and %s",
+					defaults, file)
+			}
+			defaults = file
+			cfg.Defaults = c.Defaults
+		}
+
+		templates, err := includedFiles(file, c.TemplateFiles)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		cfg.templateFiles = append(cfg.templateFiles, templates...)
+
+		includes, err := includedFiles(file, c.Include)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		for _, inc := range includes {
+			cfg.included = append(cfg.included, inc)
+			if err := merge(inc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, file := range files {
+		if err := merge(file); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.templates, err = loadTemplates(cfg.templateFiles); err != nil {
+		return nil, err
+	}
+
+	if err := finishConfiguration(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// finishConfiguration applies the defaults of cfg to its handlers and
+// validates it.  Every configuration is finished before it is activated,
+// whether it is loaded at start or reloaded.
+func finishConfiguration(cfg *Configuration) error {
+	cfg.applyDefaults()
+	return validateConfiguration(cfg)
+}
+
+// finishRemoteConfiguration finishes cfg fetched from the URL or Consul
+// prefix path, which may not use the options that refer to local files.
+func finishRemoteConfiguration(path string, cfg *Configuration) error {
+	if len(cfg.Include) > 0 {
+		return fmt.Errorf("%s: include is only supported in configuration files", path)
+	}
+	if len(cfg.TemplateFiles) > 0 {
+		return fmt.Errorf("%s: template_files is only supported in configuration files", path)
+	}
+	return finishConfiguration(cfg)
+}
+
+// applyDefaults fills in the settings each handler does not set itself
+// from the defaults section.  Environment variables are merged with the
+// handler's own taking precedence.
+func (c *Configuration) applyDefaults() {
+	d := c.Defaults
+	for name, h := range c.Handlers {
+		if h.Timeout == 0 {
+			h.Timeout = d.Timeout
+		}
+		if h.Status == "" {
+			h.Status = d.Status
+		}
+		if h.Workdir == "" {
+			h.Workdir = d.Workdir
+		}
+		if h.Shell == nil {
+			h.Shell = d.Shell
+		}
+		if h.StrictTemplates == nil {
+			h.StrictTemplates = d.StrictTemplates
+		}
+		if len(d.Env) > 0 {
+			env := make(map[string]string)
+			for k, v := range d.Env {
+				env[k] = v
+			}
+			for k, v := range h.Env {
+				env[k] = v
+			}
+			h.Env = env
+		}
+		c.Handlers[name] = h
+	}
+}
+
+// validateConfiguration checks that the handler sources are valid, that
+// receivers are mapped to defined handlers, and that every handler is well
+// formed: it has either a command or a group and its settings have known
+// values.
+func validateConfiguration(cfg *Configuration) error {
+	if _, err := cfg.HandlerSource.parse(); err != nil {
+		return err
+	}
+
+	for receiver, name := range cfg.Receivers {
+		if _, ok := cfg.Handlers[name]; !ok {
+			return fmt.Errorf("Receiver %s is mapped to undefined handler %s", receiver, name)
+		}
+	}
+	for pool, size := range cfg.Pools {
+		if size < 1 {
+			return fmt.Errorf("Pool %s must have a size of at least 1", pool)
+		}
+	}
+
+	names := make([]string, 0, len(cfg.Handlers))
+	for k := range cfg.Handlers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := cfg.Handlers[name]
+		switch {
+		case strings.TrimSpace(h.Command) == "" && len(h.Args) == 0 && len(h.members()) == 0:
+			return fmt.Errorf("Handler %s has neither a command nor a group", name)
+		case (h.Command != "" || len(h.Args) > 0) && len(h.members()) > 0:
+			return fmt.Errorf("Handler %s has both a command and a group", name)
+		case len(h.Group) > 0 && len(h.Pipeline) > 0:
+			return fmt.Errorf("Handler %s has both a group and a pipeline", name)
+		case len(h.Args) > 0 && h.shell():
+			return fmt.Errorf("Handler %s uses the shell with a command list", name)
+		}
+		for _, status := range h.Status.statuses() {
+			switch status {
+			case "firing", "resolved", "*":
+			default:
+				return fmt.Errorf("Handler %s has unknown status \"%s\"", name, status)
+			}
+		}
+		switch h.Overlap {
+		case "", "queue", "skip":
+		default:
+			return fmt.Errorf("Handler %s has unknown overlap \"%s\"", name, h.Overlap)
+		}
+		if h.Retries < 0 {
+			return fmt.Errorf("Handler %s has negative retries", name)
+		}
+		if h.CgroupCPU < 0 {
+			return fmt.Errorf("Handler %s has a negative cgroup_cpu", name)
+		}
+		if h.Nice < -20 || h.Nice > 19 {
+			return fmt.Errorf("Handler %s has nice %d outside of -20 to 19", name, h.Nice)
+		}
+		for _, code := range h.RetryOn {
+			if containsCode(h.Ignore, code) {
+				return fmt.Errorf("Handler %s both retries and ignores exit code %d", name, code)
+			}
+		}
+		if h.CircuitFailures < 0 || h.CircuitCooldown < 0 {
+			return fmt.Errorf("Handler %s has a negative circuit breaker setting", name)
+		}
+		if _, ok := cfg.Pools[h.Pool]; h.Pool != "" && !ok {
+			return fmt.Errorf("Handler %s is in undefined pool %s", name, h.Pool)
+		}
+		if h.KillGrace < 0 {
+			return fmt.Errorf("Handler %s has a negative kill_grace", name)
+		}
+		if h.Cooldown < 0 {
+			return fmt.Errorf("Handler %s has a negative cooldown", name)
+		}
+		if h.WaitFor < 0 {
+			return fmt.Errorf("Handler %s has a negative wait_for", name)
+		}
+		if h.Callback != "" {
+			if err := checkCallbackURL(h.Callback); err != nil {
+				return fmt.Errorf("Handler %s has an invalid callback: %s", name, err)
+			}
+		}
+		switch h.Stdin {
+		case "", "alert_json", "event_json":
+		default:
+			return fmt.Errorf("Handler %s has unknown stdin \"%s\"", name, h.Stdin)
+		}
+		if h.Stdin != "" && h.StdinTemplate != "" {
+			return fmt.Errorf("Handler %s has both stdin and stdin_template", name)
+		}
+		switch h.Payload {
+		case "":
+		case "tempfile":
+			if h.Runner == "docker" || h.Runner == "ssh" {
+				return fmt.Errorf("Handler %s has a payload file but uses the %s runner", name, h.Runner)
+			}
+		default:
+			return fmt.Errorf("Handler %s has unknown payload \"%s\"", name, h.Payload)
+		}
+		if err := h.checkRunner(); err != nil {
+			return fmt.Errorf("Handler %s has an invalid runner: %s", name, err)
+		}
+		if h.Sandbox != nil && h.Runner != "" && h.Runner != "local" {
+			return fmt.Errorf("Handler %s has a sandbox but uses the %s runner", name, h.Runner)
+		}
+		switch h.Scope {
+		case "", "alert", "event":
+		default:
+			return fmt.Errorf("Handler %s has unknown scope \"%s\"", name, h.Scope)
+		}
+	}
+
+	// Every template is compiled now rather than when an alert arrives
+	var broken []string
+	for _, name := range names {
+		for _, err := range cfg.templateErrors(name) {
+			broken = append(broken, err.Error())
+		}
+	}
+	if len(broken) > 0 {
+		return fmt.Errorf("Invalid templates: %s", strings.Join(broken, "; "))
+	}
+
+	return checkGroups(cfg)
+}
+
+// checkGroups verifies that every member of a handler group exists and that
+// groups do not include themselves.
+func checkGroups(cfg *Configuration) error {
+	// visit walks the members of name, path holds the groups being visited
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		for _, p := range path {
+			if p == name {
+				return fmt.Errorf("Handler group %s includes itself: %s",
+					name, strings.Join(append(path, name), " -> "))
+			}
+		}
+		for _, member := range cfg.Handlers[name].members() {
+			h, ok := cfg.Handlers[member]
+			if !ok {
+				return fmt.Errorf("Handler group %s includes undefined handler %s",
+					name, member)
+			}
+			if len(cfg.Handlers[name].Pipeline) > 0 && len(h.members()) > 0 {
+				return fmt.Errorf("Handler pipeline %s step %s is not a command",
+					name, member)
+			}
+			if err := visit(member, append(path, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for name := range cfg.Handlers {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includedFiles returns the files matching the include patterns of the
+// configuration file.
+func includedFiles(file string, patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("Included file %s does not exist", pattern)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// mergeSpecial sets the special handler name dst to src unless a
+// different name has already been configured.
+func mergeSpecial(dst *string, src string) error {
+	if src == "" {
+		return nil
+	}
+	if *dst != "" && *dst != src {
+		return fmt.Errorf("Conflicting special handler names %s and %s", *dst, src)
+	}
+	*dst = src
+	return nil
+}
+
+// loadConfigurationFile reads YAML, JSON, or TOML data from the specified
+// file name and populates a Configuration object.
+func loadConfigurationFile(file string) (*Configuration, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeConfiguration(body, formatOf(file))
+}
+
+// decodeConfiguration populates a Configuration object from body which is
+// in the given format.  Unknown fields are an error so that typos do not
+// silently produce empty handlers.
+func decodeConfiguration(body []byte, format string) (*Configuration, error) {
+	var err error
+	cfg := new(Configuration)
+	switch format {
+	case "json":
+		// JSON is a subset of YAML so after checking the document is valid
+		// JSON it is decoded as YAML.  This keeps field names and the
+		// parsing of durations the same as for YAML.
+		var v interface{}
+		if err = json.Unmarshal(body, &v); err == nil {
+			err = yaml.UnmarshalStrict(body, cfg)
+		}
+	case "toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(body), cfg)
+		if undecoded := md.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("Unknown field %s", undecoded[0])
+		}
+	case "yaml":
+		err = yaml.UnmarshalStrict(body, cfg)
+	default:
+		err = fmt.Errorf("Unknown configuration format \"%s\"", format)
+	}
+	if err != nil {
+		cfg = nil
+	}
+	return cfg, err
+}
+
+// reloadConfiguration loads the configuration from file and makes it the
+// active configuration.  The active configuration is left untouched if
+// file cannot be loaded.
+func reloadConfiguration(file string) error {
+	atomic.AddInt32(&reloading, 1)
+	defer atomic.AddInt32(&reloading, -1)
+
+	cfg, err := loadConfiguration(file)
+	if err != nil {
+		return err
+	}
+
+	activateConfiguration(cfg)
+	if gen := configMapGeneration(file); gen != "" {
+		log.Printf("Active ConfigMap generation is %s", gen)
+	}
+	return nil
+}
+
+// activateConfiguration makes cfg the active configuration and logs the
+// handlers it defines.
+func activateConfiguration(cfg *Configuration) {
+	setConfig(cfg)
+	for k, v := range cfg.Handlers {
+		log.Printf("Found handler %s => %s", k, strings.Join(v.templates(), " "))
+	}
+}
+
+// parseTemplate parses a handler's command template with the active
+// configuration.
+func parseTemplate(command string) (*template.Template, error) {
+	return getConfig().parseTemplate(command)
+}
+
+// parseTemplate parses a handler's command template, which may use the
+// named templates of c's template_files.
+func (c *Configuration) parseTemplate(command string) (*template.Template, error) {
+	var shared *template.Template
+	if c != nil {
+		shared = c.templates
+	}
+	tmpl, err := newTemplate(shared, "command")
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Parse(command)
+}
+
+// templateErrors parses every template of the handler name and returns
+// the errors found.  The errors of text/template give the position of the
+// problem within the template.
+func (c *Configuration) templateErrors(name string) []error {
+	var errs []error
+	h := c.Handlers[name]
+	for _, command := range h.templates() {
+		if _, err := c.parseTemplate(command); err != nil {
+			errs = append(errs, fmt.Errorf("Handler %s: %s", name, err))
+		}
+	}
+	fields := [][2]string{
+		{"serialize_on", h.SerializeOn},
+		{"lockfile", h.Lockfile},
+		{"stdin_template", h.StdinTemplate},
+	}
+	keys := make([]string, 0, len(h.Env))
+	for k := range h.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fields = append(fields, [2]string{"env " + k, h.Env[k]})
+	}
+	for _, field := range fields {
+		if _, err := c.parseTemplate(field[1]); err != nil {
+			errs = append(errs, fmt.Errorf("Handler %s: %s: %s", name, field[0], err))
+		}
+	}
+	return errs
+}
+
+// checkConfiguration validates every handler in cfg and returns a list of
+// the problems found.
+func checkConfiguration(cfg *Configuration) []error {
+	var errs []error
+
+	names := make([]string, 0, len(cfg.Handlers))
+	for k := range cfg.Handlers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := cfg.Handlers[name]
+		if len(h.members()) > 0 {
+			continue
+		}
+		if strings.TrimSpace(strings.Join(h.templates(), "")) == "" {
+			errs = append(errs, fmt.Errorf("Handler %s: command is empty", name))
+		}
+		errs = append(errs, cfg.templateErrors(name)...)
+		if _, err := inWindow(h.Windows, clock()); err != nil {
+			errs = append(errs, fmt.Errorf("Handler %s: invalid window: %s", name, err))
+		}
+	}
+
+	return errs
+}
+
+// formatHandler is a helper function to handle rendering the handler string
+// templates.
+func formatHandler(handler []string, command string, a Alert) (string, []string, error) {
+	rendered, err := renderSecretsMarked(handler, command, a)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Tokenize here to preserve quoted arguments
+	fields, err := Tokenize(rendered)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(fields) == 0 {
+		return "", nil, nil
+	}
+	return fields[0], fields[1:], nil
+}
+
+// formatArgs renders each of the command templates in args into a single
+// argument without tokenizing.
+func formatArgs(handler []string, args []string, a Alert) (string, []string, error) {
+	fields := make([]string, len(args))
+	for i, arg := range args {
+		rendered, err := renderSecretsMarked(handler, arg, a)
+		if err != nil {
+			return "", nil, err
+		}
+		fields[i] = rendered
+	}
+	return fields[0], fields[1:], nil
+}
+
+// renderHandler executes the command template for the alert and handler
+// arguments.
+func renderHandler(handler []string, command string, a Alert) (string, error) {
+	// We ignore handler[0] as its the handle looked up to find command
+	a.Argv = handler[1:]
+
+	tmpl, err := parseTemplate(command)
+	if err != nil {
+		log.Printf("Error: Template parsing failed for \"%s\" with error: %s",
+			command, err)
+		return "", err
+	}
+
+	// Missing labels and annotations render as an empty string unless
+	// strict templates are requested.
+	strict := strictTemplates
+	if cfg := getConfig(); cfg != nil {
+		if h, ok := cfg.Handlers[handler[0]]; ok {
+			strict = h.strict()
+		}
+	}
+	if strict {
+		tmpl.Option("missingkey=error")
+	} else {
+		tmpl.Option("missingkey=zero")
+	}
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, a)
+	if err != nil {
+		log.Printf("Error: Template execution failed for \"%s\" with error: %s",
+			command, err)
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// executeHandler executes a handler give an executable and a slice of
+// arguments.  STDOUT and STDERR are merged together and returnd in the
+// bytes.Buffer.  The command is killed when ctx is done or the handler's
+// timeout expires.
+func executeHandler(ctx context.Context, command Handler, exe string, args []string) (*bytes.Buffer, error) {
+	return runCommand(ctx, command, exe, args, nil, nil)
+}
+
+// runCommand runs exe like executeHandler connecting its standard input
+// and output to p, if not nil, and adds fields to the structured log
+// record of the execution.
+func runCommand(parent context.Context, command Handler, exe string, args []string,
+	p *pipe, fields logFields) (*bytes.Buffer, error) {
+	var err error
+	markStarted(parent)
+	if debug {
+		log.Printf("DEBUG: Not executing command \"%s\" with args \"%#v\"", exe, unmarkArgs(args))
+		if p != nil {
+			p.ran = true
+		}
+		return nil, nil
+	}
+
+	// Secrets are resolved only now so their values never appear in logs
+	execArgs := make([]string, len(args))
+	for i, a := range args {
+		if execArgs[i], err = resolveSecrets(a); err != nil {
+			return nil, err
+		}
+	}
+	env := os.Environ()
+	for k, v := range command.Env {
+		if v, err = resolveSecrets(v); err != nil {
+			return nil, err
+		}
+		env = append(env, k+"="+v)
+	}
+
+	out := new(bytes.Buffer)
+	capped := &cappedWriter{buf: out, max: command.MaxOutputBytes}
+	ctx, cancel := context.WithTimeout(parent, command.timeout())
+	defer cancel()
+	runExe, runArgs, err := sandboxCommand(command, exe, execArgs)
+	if err != nil {
+		return nil, err
+	}
+	runExe, runArgs, stop := command.runnerCommand(runExe, runArgs)
+	cmd := exec.CommandContext(ctx, runExe, runArgs...)
+	// Kill the whole process group so that processes started by the
+	// command, such as those of a shell script, do not outlive it.  With a
+	// grace period the group is sent SIGTERM first so that scripts can
+	// clean up.
+	grace := command.killGrace()
+	var killTimer *time.Timer
+	cmd.Cancel = func() error {
+		if stop != nil {
+			stop()
+		}
+		if grace <= 0 {
+			return killProcessGroup(cmd)
+		}
+		killTimer = time.AfterFunc(grace, func() {
+			_ = killProcessGroup(cmd) // Ignore error here
+		})
+		return terminateProcessGroup(cmd)
+	}
+	// Don't wait forever for output from processes that escaped the
+	// process group.
+	cmd.WaitDelay = grace + waitDelay
+	cmd.Env = env
+	cmd.Dir = command.Workdir
+	var output io.Writer = capped
+	if stream := outputStreamOf(parent); stream != nil {
+		name, _ := fields["handler"].(string)
+		alertname, _ := fields["alertname"].(string)
+		output = io.MultiWriter(capped, stream.writer(name, alertname))
+	}
+	cmd.Stderr = output
+	cmd.Stdout = output
+	if p != nil {
+		if p.input != nil {
+			cmd.Stdin = bytes.NewReader(p.input)
+		}
+		if p.stdout != nil {
+			cmd.Stdout = io.MultiWriter(output,
+				&cappedWriter{buf: p.stdout, max: command.MaxOutputBytes})
+		}
+	}
+	setProcessGroup(cmd)
+	cg, err := newCgroup(command)
+	if err != nil {
+		return nil, err
+	}
+	defer cg.remove()
+	cg.apply(cmd)
+	started := time.Now()
+	start := started.Unix()
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	err = cmd.Wait()
+	if killTimer != nil {
+		// Kill whatever the command left behind when it exited
+		killTimer.Stop()
+		_ = killProcessGroup(cmd) // Ignore error here
+	}
+	switch {
+	case parent.Err() != nil:
+		err = fmt.Errorf("Command execution was cancelled and killed: %s", context.Cause(parent))
+		out = nil
+	case ctx.Err() != nil:
+		err = fmt.Errorf("Command execution timed out and was killed.")
+		out = nil
+	case err == exec.ErrWaitDelay:
+		// The command succeeded but left processes holding its output
+		err = nil
+	case command.ignored(err):
+		log.Printf("Command \"%s\" exited with ignored code %d", exe, exitCode(err))
+		if p != nil {
+			p.ignored = true
+		}
+		err = nil
+	case err != nil && cg.oomKilled():
+		err = fmt.Errorf("Command exceeded its cgroup memory limit of %d bytes: %s",
+			command.CgroupMemory, err)
+	default:
+		err = limitError(command, err, out.Bytes())
+	}
+	if p != nil && err == nil {
+		p.ran = true
+	}
+
+	if capped.truncated && out != nil {
+		fmt.Fprintf(out, "\n[Output truncated to %d bytes]\n", command.MaxOutputBytes)
+	}
+
+	end := time.Now().Unix()
+	record := logFields{
+		"command":   exe,
+		"duration":  time.Since(started).Seconds(),
+		"exit_code": cmd.ProcessState.ExitCode(),
+	}
+	for k, v := range fields {
+		record[k] = v
+	}
+	if err != nil {
+		record["error"] = err.Error()
+		logRecord("error", fmt.Sprintf("Command \"%s\" Args \"%#v\" failed in %d seconds: %s",
+			exe, unmarkArgs(args), end-start, err.Error()), record)
+	} else {
+		logRecord("info", fmt.Sprintf("Command \"%s\" Args \"%#v\" ran successfully in %d seconds",
+			exe, unmarkArgs(args), end-start), record)
+	}
+
+	return out, err
+}
+
+// handlers returns the handlers to run for alert, not including the "all"
+// handler.
+func (e *AlertManagerEvent) handlers(cfg *Configuration, alert Alert) [][]string {
+	if len(e.handler) > 0 {
+		return [][]string{e.handler}
+	}
+	annotation, ok := cfg.handlerOf(alert)
+	if !ok {
+		// We didn't find the "handler" annotation
+		log.Printf("%s does not have handler annotation trying default",
+			alert.name())
+		return [][]string{{cfg.receiverHandler(e.Receiver)}}
+	}
+	return SplitHandlers(annotation, handlerSeparator)
+}
+
+// handleEvent does the initial work to handle events from the HTTP body.
+func handleEvent(ctx context.Context, e *AlertManagerEvent) (*eventResult, error) {
+	result := &eventResult{RequestID: e.requestID, DryRun: isDryRun(ctx), Alerts: []alertResult{}}
+	record := newAuditRecord(e)
+	cfg := getConfig()
+
+	// Alerts are handled concurrently with their results and audit
+	// outcomes kept in the order of the alerts in the request.
+	results := make([]alertResult, len(e.Alerts))
+	records := make([]*AuditRecord, len(e.Alerts))
+	slots := make(chan struct{}, alertConcurrency)
+	var wg sync.WaitGroup
+	for i, alert := range e.Alerts {
+		records[i] = newAuditRecord(e)
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, alert Alert) {
+			defer wg.Done()
+			results[i] = e.handleAlert(ctx, cfg, alert, records[i])
+			<-slots
+		}(i, alert)
+	}
+	wg.Wait()
+
+	for i, current := range results {
+		record.Outcomes = append(record.Outcomes, records[i].Outcomes...)
+		result.Errors += current.failures()
+		result.Alerts = append(result.Alerts, current)
+	}
+
+	if audit != nil && !isDryRun(ctx) {
+		audit.Send(record)
+	}
+
+	if result.Errors > 0 {
+		return result, fmt.Errorf("Error(s) executing event(s)")
+	}
+
+	return result, nil
+}
+
+// prepareAlert sets the fields of alert, one of the alerts of e, that
+// are not part of the Alertmanager's JSON before its handlers are run.
+func (e *AlertManagerEvent) prepareAlert(alert Alert) (Alert, error) {
+	alert.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	alert.requestID = e.requestID
+	alert.trace = e.trace
+	alert.event = e
+	alert.Group = e.group()
+
+	buf, err := json.Marshal(alert)
+	if err != nil {
+		return alert, fmt.Errorf("Error marshalling JSON: %s", err.Error())
+	}
+	alert.Json = string(buf)
+	return alert, nil
+}
+
+// isMissing returns true if err is caused by an undefined handler.
+func isMissing(err error) bool {
+	e, ok := err.(EventError)
+	return ok && e.code == EMISSING
+}
+
+// handleAlert runs the handlers for alert, one of the alerts of e, and adds
+// their outcomes to record.
+func (e *AlertManagerEvent) handleAlert(ctx context.Context, cfg *Configuration, alert Alert, record *AuditRecord) alertResult {
+	defaultHandler, allHandler := cfg.receiverHandler(e.Receiver), cfg.allHandler()
+	flappingHandler := cfg.flappingHandler()
+	log.Printf("Processing Alert: %s", alert.name())
+	alertsReceived.inc(alert.name(), alert.Status)
+	result := alertResult{
+		Alertname: alert.name(),
+		Status:    alert.Status,
+		Handlers:  []handlerResult{},
+	}
+
+	if alert.Status == "resolved" && !isDryRun(ctx) && !e.test {
+		resolutions.record(alert.fingerprint(), clock())
+		if n := inflight.cancel(alert.fingerprint()); n > 0 {
+			log.Printf("Cancelling %d handler(s) of resolved alert %s", n, alert.name())
+		}
+	}
+	flapping := isFlapping(isDryRun(ctx) || e.test, alert)
+
+	alert, err := e.prepareAlert(alert)
+	if err != nil {
+		log.Print(err.Error())
+		result.Error = err.Error()
+		return result
+	}
+	handlers := append(e.handlers(cfg, alert), []string{allHandler})
+	if flapping {
+		// Only the "flapping" handler runs until the alert stabilizes
+		log.Printf("Alert %s is flapping, suppressing its handlers", alert.name())
+		for _, h := range handlers {
+			if len(h) == 0 {
+				continue
+			}
+			if _, ok := cfg.Handlers[h[0]]; ok {
+				handlerSkips.inc(h[0], "flapping")
+			}
+		}
+		handlers = [][]string{{flappingHandler}}
+	}
+
+	// Run our handlers or the default if no handler is present.  Following
+	// that run the "all" handler if present.
+	for _, h := range handlers {
+		if len(h) > 0 && cfg.Handlers[h[0]].Scope == "event" && !e.claim(h) {
+			if verboseLogging() {
+				log.Printf("Handler %s already ran for this notification", h[0])
+			}
+			continue
+		}
+		start := time.Now()
+		hctx, capture := withResultCapture(ctx)
+		output, attempts, err := e.runJournaled(hctx, cfg, h, alert)
+		if err != nil && !isMissing(err) && deadLetters != nil && !isDryRun(ctx) {
+			deadLetters.add(e, alert, h, attempts, output, err)
+		}
+		if err != nil {
+			if e, ok := err.(EventError); ok && e.code == EMISSING {
+				if h[0] == defaultHandler || h[0] == allHandler || h[0] == flappingHandler {
+					// Ignore missing handler errors for our special handlers
+					// This means that a missing handler annotation is not
+					// considered an error.
+					continue
+				}
+			}
+			log.Print(err.Error())
+		}
+		record.add(alert, h, err)
+		hr := newHandlerResult(h, start, output, err)
+		hr.Result = capture.get()
+		result.Handlers = append(result.Handlers, hr)
+		if u := cfg.Handlers[h[0]].callback(); u != "" && attempts > 0 && !isDryRun(ctx) {
+			e.sendCallback(u, alert, hr)
+		}
+	}
 
-		// Command is the go template string of the command to execute
-		Command string
+	return result
+}
 
-		// Status is the status of the alert, either "firing" or "resolved",
-		// that will trigger the handler execution.  A "*" character selects
-		// any alert status.
-		Status string
+// runHandler runs handler for alert unless the handler is cooling down
+// from a previous run for the same alert.  A failed command is retried as
+// configured.  It returns the output and error of the last attempt and the
+// number of attempts made.  Handlers with cancel_on_resolve are cancelled,
+// without failing, when a firing alert resolves.
+func runHandler(ctx context.Context, cfg *Configuration, handler []string, alert Alert) (*bytes.Buffer, int, error) {
+	if len(handler) == 0 || !cfg.Handlers[handler[0]].CancelOnResolve || alert.Status != "firing" {
+		return runAttempts(ctx, cfg, handler, alert)
 	}
-}
 
-// Error handling
-type EventError struct {
-	code   int
-	object string
+	ctx, done := inflight.track(ctx, alert.fingerprint())
+	defer done()
+	output, attempts, err := runAttempts(ctx, cfg, handler, alert)
+	if err != nil && context.Cause(ctx) == errAlertResolved {
+		log.Printf("Cancelled handler %s: alert %s resolved", handler[0], alert.name())
+		handlerSkips.inc(handler[0], "resolved")
+		return output, attempts, nil
+	}
+	return output, attempts, err
 }
 
-func (e EventError) Error() string {
-	switch e.code {
-	case EMISSING:
-		return fmt.Sprintf("Handler %s is not defined or missing from configration",
-			e.object)
+// runAttempts runs handler for alert like runHandler.
+func runAttempts(ctx context.Context, cfg *Configuration, handler []string, alert Alert) (*bytes.Buffer, int, error) {
+	if len(handler) > 0 && !isDryRun(ctx) {
+		h := cfg.Handlers[handler[0]]
+		key, now := cooldownKey(handler[0], alert), clock()
+		if !cooldowns.allow(key, h.Cooldown, now) {
+			log.Printf("Skipping handler %s: alert %s was handled less than %s ago",
+				handler[0], alert.name(), h.Cooldown)
+			handlerSkips.inc(handler[0], "cooldown")
+			return nil, 0, nil
+		}
+		if h.Cooldown > 0 {
+			// Executions that were skipped do not cool down
+			var started *int32
+			ctx, started = withStarted(ctx)
+			defer func() {
+				if atomic.LoadInt32(started) == 0 {
+					cooldowns.cancel(key, h.Cooldown, now)
+				}
+			}()
+		}
+
+		// Retries do not wait again
+		firing, err := waitFor(ctx, h, alert)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !firing {
+			log.Printf("Skipping handler %s: alert %s resolved within %s",
+				handler[0], alert.name(), h.WaitFor)
+			handlerSkips.inc(handler[0], "resolved")
+			return nil, 0, nil
+		}
 	}
 
-	return "Undefined event error"
+	output, err := parseHandler(ctx, handler, alert)
+	attempts := 1
+	if len(handler) > 0 && !isMissing(err) {
+		backoff := retryBackoff
+		h := cfg.Handlers[handler[0]]
+		for ; err != nil && attempts <= h.Retries && h.retryable(err); attempts++ {
+			log.Printf("Handler %s failed, retrying in %s: %s", handler[0], backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return output, attempts, err
+			}
+			backoff *= 2
+			output, err = parseHandler(ctx, handler, alert)
+		}
+	}
+	return output, attempts, err
 }
 
-// replace is a helper function for templating to do simple substitution.
-func replace(a, b, c string) string {
-	return strings.Replace(a, b, c, -1)
+// parseHandler parses and error checks the handler string before execution.
+func parseHandler(ctx context.Context, handler []string, alert Alert) (*bytes.Buffer, error) {
+	return runStep(ctx, handler, alert, nil)
 }
 
-// loadConfiguration reads YAML data from the specified file name and populates
-// a Configuration object.
-func loadConfiguration(file string) (*Configuration, error) {
-	fd, err := os.Open(file)
+// runStep runs handler like parseHandler.  When p is not nil the handler
+// is a step of a pipeline: its standard input is taken from p, if set,
+// and its standard output is captured in p.
+func runStep(ctx context.Context, handler []string, alert Alert, p *pipe) (*bytes.Buffer, error) {
+	if len(handler) == 0 {
+		return nil, fmt.Errorf("Empty handler annotation found in alert.")
+	}
+	command, ok := getConfig().Handlers[handler[0]]
+	if !ok {
+		return nil, EventError{EMISSING, handler[0]}
+	}
+	if !command.enabled() {
+		log.Printf("Skipping handler %s: handler is disabled", handler[0])
+		handlerSkips.inc(handler[0], "disabled")
+		return nil, nil
+	}
+	if len(command.Group) > 0 {
+		return runGroup(ctx, handler, command.Group, alert)
+	}
+	if len(command.Pipeline) > 0 {
+		return runPipeline(ctx, handler, command.Pipeline, alert)
+	}
+	if !command.status().match(alert.Status) {
+		log.Printf("Ignoring alert.  Status (%s) which does not match filter (%s)",
+			alert.Status, command.status())
+		handlerSkips.inc(handler[0], "status")
+		return nil, nil
+	}
+	active, err := inWindow(command.Windows, clock())
+	if err != nil {
+		return nil, fmt.Errorf("Invalid window for handler %s: %s", handler[0], err)
+	}
+	if !active {
+		log.Printf("Ignoring alert.  Handler %s is outside of its active windows",
+			handler[0])
+		handlerSkips.inc(handler[0], "window")
+		return nil, nil
+	}
+	script, args, err := renderCommand(handler, command, alert)
 	if err != nil {
 		return nil, err
 	}
-	defer fd.Close()
-
-	body := make([]byte, JsonBody)
-	size := 0
-	size, err = fd.Read(body)
-	if err != nil && err != io.EOF {
+	if command, err = command.renderRunner(handler, alert); err != nil {
 		return nil, err
 	}
-
-	cfg := new(Configuration)
-	err = yaml.Unmarshal(body[:size], cfg)
-	if err != nil {
-		cfg = nil
+	if isDryRun(ctx) {
+		log.Printf("Dry run: not executing command \"%s\" with args \"%#v\"", script, unmarkArgs(args))
+		if p != nil {
+			p.ran = true
+		}
+		return dryRunOutput(script, args), nil
 	}
-	return cfg, err
-}
 
-// formatHandler is a helper function to handle rendering the handler string
-// templates.
-func formatHandler(handler []string, command string, a Alert) (string, []string, error) {
-	funcs := template.FuncMap{"replace": replace}
-	// We ignore handler[0] as its the handle looked up to find command
-	a.Argv = handler[1:]
+	// Only one copy of the exact same command may run at a time
+	key := lockKey(handler[0], script, args)
+	if command.Runner == "ssh" {
+		key = lockKey(handler[0]+"@"+command.SSH.Host, script, args)
+	}
+	if command.Overlap == "skip" {
+		if !locks.tryAcquire(key) {
+			log.Printf("Skipping handler %s: the same command is already running",
+				handler[0])
+			handlerSkips.inc(handler[0], "overlap")
+			return nil, nil
+		}
+	} else if err := locks.acquireContext(ctx, key); err != nil {
+		return nil, fmt.Errorf("Cancelled while waiting on the same command of handler %s: %s",
+			handler[0], err)
+	}
+	defer locks.release(key)
 
-	tmpl, err := template.New("command").Funcs(funcs).Parse(command)
+	// Executions with the same serialization key wait for each other
+	serial, err := renderHandler(handler, command.SerializeOn, alert)
 	if err != nil {
-		log.Printf("Error: Template parsing failed for \"%s\" with error: %s",
-			command, err)
-		return "", nil, err
+		return nil, fmt.Errorf("Could not render serialize_on of handler %s: %s", handler[0], err)
 	}
-	buf := new(bytes.Buffer)
-	err = tmpl.Execute(buf, a)
-	if err != nil {
-		log.Printf("Error: Template execution failed for \"%s\" with error: %s",
-			command, err)
-		return "", nil, err
+	if serial = strings.TrimSpace(serial); serial != "" {
+		serial = "serialize\x00" + serial
+		if err := locks.acquireContext(ctx, serial); err != nil {
+			return nil, fmt.Errorf("Cancelled while waiting on serialize_on of handler %s: %s",
+				handler[0], err)
+		}
+		defer locks.release(serial)
 	}
 
-	// Tokenize here to preserve quoted arguments
-	fields, err := Tokenize(buf.String())
+	// Other programs may hold the handler's lock file
+	path, err := renderHandler(handler, command.Lockfile, alert)
 	if err != nil {
-		return "", nil, err
+		return nil, fmt.Errorf("Could not render lockfile of handler %s: %s", handler[0], err)
+	}
+	if path = strings.TrimSpace(path); path != "" {
+		f, err := lockFile(ctx, path, command.Overlap != "skip")
+		if err != nil {
+			return nil, fmt.Errorf("Could not lock %s for handler %s: %s", path, handler[0], err)
+		}
+		if f == nil {
+			log.Printf("Skipping handler %s: lock file %s is held", handler[0], path)
+			handlerSkips.inc(handler[0], "lockfile")
+			return nil, nil
+		}
+		defer f.Close()
 	}
-	return fields[0], fields[1:], nil
-}
 
-// executeHandler executes a handler give an executable and a slice of
-// arguments.  STDOUT and STDERR are merged together and returnd in the
-// bytes.Buffer.
-func executeHandler(exe string, args []string) (*bytes.Buffer, error) {
-	done := make(chan error, 1)
-	var err error
-	if debug {
-		log.Printf("DEBUG: Not executing command \"%s\" with args \"%#v\"", exe, args)
+	cooldown := command.circuitCooldown()
+	if !circuits.allow(handler[0], command.CircuitFailures, cooldown, clock()) {
+		log.Printf("Skipping handler %s: circuit is open after repeated failures",
+			handler[0])
+		handlerSkips.inc(handler[0], "circuit")
 		return nil, nil
 	}
 
-	out := new(bytes.Buffer)
-	cmd := exec.Command(exe, args...)
-	cmd.Stderr = out
-	cmd.Stdout = out
-	start := time.Now().Unix()
-	if err = cmd.Start(); err != nil {
+	release, err := acquireSlots(ctx, handler[0], command.MaxConcurrent, command.Pool,
+		getConfig().Pools[command.Pool])
+	if err != nil {
 		return nil, err
 	}
+	defer release()
 
-	// This must be a channel to work with select() to implement a timeout
-	go func() {
-		done <- cmd.Wait()
-	}()
-
-	select {
-	case err = <-done:
-	case <-time.After(timeout):
-		_ = cmd.Process.Kill() // Ignore error here
-		err = fmt.Errorf("Command execution timed out and was killed.")
-		out = nil
+	fields := logFields{
+		"handler":    handler[0],
+		"alertname":  alert.name(),
+		"request_id": alert.requestID,
+	}
+	if alert.trace != nil {
+		fields["trace_id"] = alert.trace.traceID
 	}
+	if command.Env, err = renderEnv(handler, command.Env, alert); err != nil {
+		return nil, fmt.Errorf("Could not render env of handler %s: %s", handler[0], err)
+	}
+	command.Env = alert.trace.env(command.Env)
 
-	end := time.Now().Unix()
-	if err != nil {
-		log.Printf("Command \"%s\" Args \"%#v\" failed in %d seconds: %s",
-			exe, args, end-start, err.Error())
+	capture := resultCaptureOf(ctx)
+	if p == nil {
+		p = &pipe{}
+		if capture != nil {
+			p.stdout = new(bytes.Buffer)
+		}
 	} else {
-		log.Printf("Command \"%s\" Args \"%#v\" ran successfully in %d seconds",
-			exe, args, end-start)
+		// The pipeline captures the result of its steps
+		capture = nil
 	}
-
-	return out, err
-}
-
-// handleEvent does the initial work to handle events from the HTTP body.
-func handleEvent(e *AlertManagerEvent) (*bytes.Buffer, error) {
-	errors := 0
-	retText := new(bytes.Buffer)
-	for _, alert := range e.Alerts {
-		log.Printf("Processing Alert: %s", alert.Labels["alertname"])
-		var handler []string
-		alert.Timestamp = time.Now().UTC().Format(time.RFC3339)
-
-		buf, err := json.Marshal(alert)
+	if p.pipeline != "" {
+		fields["pipeline"] = p.pipeline
+	}
+	if p.input == nil {
+		if p.input, err = command.input(handler, alert); err != nil {
+			return nil, fmt.Errorf("Could not encode standard input of handler %s: %s",
+				handler[0], err)
+		}
+	}
+	if command.Payload == "tempfile" {
+		path, err := command.payloadFile(alert)
 		if err != nil {
-			msg := fmt.Sprintf("Error marshalling JSON: %s", err.Error())
-			log.Print(msg)
-			retText.WriteString(msg + "\n")
-			errors++
-			continue
+			return nil, fmt.Errorf("Could not write payload file of handler %s: %s",
+				handler[0], err)
 		}
-		alert.Json = string(buf)
-		if _, ok := alert.Annotations["handler"]; !ok {
-			// We didn't find the "handler" annotation
-			log.Printf("%s does not have handler annotation trying default",
-				alert.Labels["alertname"])
-			handler = []string{"default"}
-		} else {
-			handler = strings.Fields(alert.Annotations["handler"])
-		}
-
-		// Run our handler or the default if no handler is present.  Following
-		// that run the "all" handler if present.
-		for _, h := range [][]string{handler, []string{"all"}} {
-			output, err := parseHandler(h, alert)
-			if err != nil {
-				if e, ok := err.(EventError); ok && e.code == EMISSING {
-					if h[0] == "default" || h[0] == "all" {
-						// Ignore missing handler errors for our special handlers
-						// This means that a missing handler annotation is not
-						// considered an error.
-						continue
-					}
-				}
-				log.Printf(err.Error())
-				retText.WriteString(err.Error() + "\n")
-				errors++
-			}
-			if output != nil && output.Len() > 0 {
-				retText.Write(output.Bytes())
-			}
+		defer os.Remove(path)
+		env := map[string]string{payloadEnv: path}
+		for k, v := range command.Env {
+			env[k] = v
 		}
+		command.Env = env
 	}
 
-	if errors > 0 {
-		return retText, fmt.Errorf("Error(s) executing event(s)")
+	start := time.Now()
+	out, err := runCommand(ctx, command, script, args, p, fields)
+	if capture != nil {
+		capture.set(parseResult(p.stdout.Bytes()))
 	}
-
-	return retText, nil
+	// Commands killed because their alert resolved, for shutdown, or as the
+	// client disconnected have not failed on their own
+	if ctx.Err() == nil {
+		observeExecution(handler[0], start, err)
+		circuits.record(handler[0], command.CircuitFailures, cooldown, clock(), err)
+	}
+	return out, err
 }
 
-// parseHandler parses and error checks the handler string before execution.
-func parseHandler(handler []string, alert Alert) (*bytes.Buffer, error) {
-	if len(handler) == 0 {
-		return nil, fmt.Errorf("Empty handler annotation found in alert.")
-	}
-	command, ok := config.Handlers[handler[0]]
-	if !ok {
-		return nil, EventError{EMISSING, handler[0]}
+// renderEnv renders the templates of the environment variables env for
+// handler and alert.
+func renderEnv(handler []string, env map[string]string, alert Alert) (map[string]string, error) {
+	if len(env) == 0 {
+		return env, nil
 	}
-	if command.Status == "" {
-		// Set default value for non-specified status
-		command.Status = "firing"
+	result := make(map[string]string, len(env))
+	for k, v := range env {
+		rendered, err := renderSecretsMarked(handler, v, alert)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+		result[k] = rendered
 	}
-	if command.Status != "*" && command.Status != alert.Status {
-		log.Printf("Ignoring alert.  Status (%s) which does not match filter (%s)",
-			alert.Status, command.Status)
-		return nil, nil
+	return result, nil
+}
+
+// renderCommand renders the executable and arguments command runs for
+// handler and alert.
+func renderCommand(handler []string, command Handler, alert Alert) (string, []string, error) {
+	var script string
+	var args []string
+	var err error
+	if len(command.Args) > 0 {
+		script, args, err = formatArgs(handler, command.Args, alert)
+	} else if command.shell() {
+		var rendered string
+		rendered, err = renderSecretsMarked(handler, command.Command, alert)
+		script, args = "/bin/sh", []string{"-c", rendered}
+	} else {
+		script, args, err = formatHandler(handler, command.Command, alert)
 	}
-	script, args, err := formatHandler(handler, command.Command, alert)
 	if err != nil {
-		return nil, fmt.Errorf("Could not parse handler arguments: %s", err.Error())
+		return "", nil, fmt.Errorf("Could not parse handler arguments: %s", err.Error())
 	}
 	if script == "" {
 		// Sanity
-		return nil, fmt.Errorf("Script is empty, not running.")
+		return "", nil, fmt.Errorf("Script is empty, not running.")
+	}
+	return script, args, nil
+}
+
+// runGroup runs each handler in group in order with the arguments given to
+// the group handler.  All members are run even if one fails.
+func runGroup(ctx context.Context, handler, group []string, alert Alert) (*bytes.Buffer, error) {
+	var failed []string
+	out := new(bytes.Buffer)
+	ctx = withoutResultCapture(ctx)
+	for _, member := range group {
+		output, err := parseHandler(ctx, append([]string{member}, handler[1:]...), alert)
+		if output != nil {
+			out.Write(output.Bytes())
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", member, err))
+		}
 	}
 
-	return executeHandler(script, args)
+	if len(failed) > 0 {
+		return out, fmt.Errorf("Handler group %s failed: %s", handler[0],
+			strings.Join(failed, "; "))
+	}
+	return out, nil
 }
 
 // unmarshalBody is a helper function to load JSON from an HTTP body into
@@ -314,6 +2229,45 @@ func unmarshalBody(encoded []byte) (*AlertManagerEvent, error) {
 // amWebHook decodes the HTTP request, finds Alertmanager JSON structure
 // and dispatches the alerts.
 func amWebHook(writer http.ResponseWriter, r *http.Request) {
+	webhook(writer, r, nil)
+}
+
+// deprecatedOnce logs the first use of a deprecated webhook path.
+var deprecatedOnce sync.Once
+
+// deprecated wraps the handler of a webhook path kept for compatibility
+// with Alertmanagers configured before /api/v1/webhook.
+func deprecated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deprecatedOnce.Do(func() {
+			log.Printf("Webhook received on deprecated path %s, configure the Alertmanager to use /api/v1/webhook",
+				r.URL.Path)
+		})
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", `</api/v1/webhook>; rel="successor-version"`)
+		handler(w, r)
+	}
+}
+
+// routedWebHook handles requests to /api/v1/webhook/<handler> which run the
+// named handler for every alert regardless of the alert's handler
+// annotation.  Further path elements are passed to the handler as
+// arguments.
+func routedWebHook(writer http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+	path = strings.Trim(strings.TrimPrefix(path, "/webhook/"), "/")
+	if path == "" {
+		w := NewStatusResponseWriter(writer)
+		defer logRequest(w, r)
+		http.Error(w, "No handler in path.", http.StatusNotFound)
+		return
+	}
+	webhook(writer, r, strings.Split(path, "/"))
+}
+
+// webhook processes an AlertManagerEvent POST'd to us.  When handler is
+// not nil it is run for every alert.
+func webhook(writer http.ResponseWriter, r *http.Request, handler []string) {
 	var body []byte
 	var err error
 	var n int
@@ -321,6 +2275,8 @@ func amWebHook(writer http.ResponseWriter, r *http.Request) {
 	// Log the request
 	w := NewStatusResponseWriter(writer)
 	defer logRequest(w, r)
+	id := requestID(r)
+	w.Header().Set("X-Request-Id", id)
 
 	// Filter requests for POST
 	if r.Method != "POST" {
@@ -328,9 +2284,18 @@ func amWebHook(writer http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
 	buf := make([]byte, JsonBody)
 	for err == nil {
 		n, err = r.Body.Read(buf)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			log.Printf("Error: Request body exceeds %d bytes", maxBody)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil && err != io.EOF {
 			log.Printf("Error reading from client: %s", err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -341,7 +2306,7 @@ func amWebHook(writer http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if verbose {
+	if verboseLogging() {
 		log.Printf("Request Body: \"%s\"", string(body))
 	}
 
@@ -351,61 +2316,521 @@ func amWebHook(writer http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error parsing JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	event.handler = handler
+	event.requestID = id
+	event.trace = parseTraceContext(r)
+
+	// Redeliveries of a notification still running or handled recently
+	// are acknowledged without running anything again
+	dryRun := requestDryRun(r)
+	key := ""
+	if !dryRun {
+		key = event.deliveryKey()
+	}
+	if duplicate(key) {
+		log.Printf("Skipping duplicate notification of group %s", event.GroupKey)
+		duplicateDeliveries.inc()
+		blob, _ := json.Marshal(&eventResult{RequestID: id, Duplicate: true,
+			Alerts: []alertResult{}})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(blob, '\n'))
+		return
+	}
 
-	output, err := handleEvent(event)
+	// Dry runs are never queued so that the response shows what would run
+	if async && !dryRun {
+		if err := enqueue(event); err == errQueueFull {
+			deliveries.reset(key)
+			log.Printf("Error: Refusing %d alert(s), queue holds %d", len(event.Alerts),
+				len(queue))
+			w.Header().Set("Retry-After",
+				strconv.Itoa(int(math.Ceil(queueRetryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			deliveries.reset(key)
+			log.Printf("Error: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// Commands are killed if the client disconnects before they finish
+	ctx := r.Context()
+	if dryRun {
+		ctx = withDryRun(ctx)
+	}
+	var stream *outputStream
+	if requestStream(r) {
+		// The status is sent before the handlers have run so errors are
+		// only reported in the final result
+		flusher, _ := writer.(http.Flusher)
+		stream = newOutputStream(w, flusher)
+		ctx = withOutputStream(ctx, stream)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	result, err := handleEvent(ctx, event)
+	if err != nil {
+		// Let the Alertmanager's retry run the failed handlers again
+		deliveries.reset(key)
+	}
+	if stream != nil {
+		stream.write(streamChunk{Result: result})
+		return
+	}
+	blob, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		log.Printf("Error marshalling response: %s", jsonErr)
+		http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 	} else {
 		w.WriteHeader(http.StatusOK)
 	}
-	if output.Len() > 0 {
-		blob := output.Bytes()
-		w.Write(blob)
-		if verbose {
-			log.Printf("Response body: %s", string(blob))
+	w.Write(append(blob, '\n'))
+	if verboseLogging() {
+		log.Printf("Response body: %s", string(blob))
+	}
+}
+
+// handlerInfo describes the effective settings of a configured handler.
+type handlerInfo struct {
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Group   []string `json:"group,omitempty"`
+	Status  string   `json:"status"`
+	Timeout string   `json:"timeout"`
+	Overlap string   `json:"overlap"`
+	Enabled bool     `json:"enabled"`
+
+	Pipeline      []string `json:"pipeline,omitempty"`
+	MaxConcurrent int      `json:"max_concurrent,omitempty"`
+}
+
+// listHandlers returns a JSON document describing every handler in the
+// currently active configuration.
+func listHandlers(writer http.ResponseWriter, r *http.Request) {
+	w := NewStatusResponseWriter(writer)
+	defer logRequest(w, r)
+
+	if r.Method != "GET" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+
+	handlers := make(map[string]handlerInfo)
+	for name, h := range getConfig().Handlers {
+		info := handlerInfo{
+			Command: redactSecrets(h.Command),
+			Args:    redactArgs(h.Args),
+			Group:   h.Group,
+			Status:  string(h.status()),
+			Timeout: h.timeout().String(),
+			Overlap: h.Overlap,
+			Enabled: h.enabled(),
+
+			Pipeline:      h.Pipeline,
+			MaxConcurrent: h.MaxConcurrent,
+		}
+		if info.Overlap == "" {
+			info.Overlap = "queue"
 		}
+		handlers[name] = info
+	}
+
+	blob, err := json.Marshal(handlers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
+
+// webhookRoutes returns the endpoints served by the -bind listeners.  The
+// operational endpoints are included unless -admin-bind is set.
+func webhookRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/webhook", requireAuth(rateLimit(amWebHook)))
+	mux.HandleFunc("/api/v1/webhook/", requireAuth(rateLimit(routedWebHook)))
+	mux.HandleFunc("/", requireAuth(rateLimit(deprecated(amWebHook))))
+	mux.HandleFunc("/webhook/", requireAuth(rateLimit(deprecated(routedWebHook))))
+	mux.HandleFunc("/handlers", requireAuth(rateLimit(listHandlers)))
+	mux.HandleFunc("/api/v1/config", requireAuth(rateLimit(effectiveConfig)))
+	mux.HandleFunc("/api/v1/test", requireAuth(rateLimit(testAlert)))
+	mux.HandleFunc("/api/v1/loglevel", requireAuth(rateLimit(logLevelHandler)))
+	mux.HandleFunc("/api/v1/deadletters", requireAuth(rateLimit(deadLetterHandler)))
+	mux.HandleFunc("/api/v1/deadletters/", requireAuth(rateLimit(deadLetterHandler)))
+	if adminBind == "" {
+		addAdminRoutes(mux)
+	}
+	return mux
+}
+
+// adminRoutes returns the endpoints served by the -admin-bind listener.
+// The pprof endpoints are only served here, never on the webhook port.
+func adminRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	addAdminRoutes(mux)
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
+	return mux
+}
+
+// addAdminRoutes registers the operational endpoints on mux.
+func addAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/ready", ready)
+	mux.HandleFunc("/metrics", metricsHandler)
 }
 
-// run starts the HTTP server
+// run starts an HTTP server for the webhook on bindAddress.
 func run(bindAddress string) {
-	http.HandleFunc("/", amWebHook)
+	serve(bindAddress, webhookRoutes())
+}
 
-	log.Printf("Starting server on %s", bindAddress)
-	err := http.ListenAndServe(bindAddress, nil)
+// runAdmin starts an HTTP server for the operational endpoints on
+// bindAddress.
+func runAdmin(bindAddress string) {
+	serve(bindAddress, adminRoutes())
+}
+
+// newServer returns the HTTP server for handler on address, which uses TLS
+// if tlsConfig is not nil.
+func newServer(address string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		Protocols:         new(http.Protocols),
+		TLSConfig:         tlsConfig,
+		BaseContext:       func(net.Listener) context.Context { return runContext },
+	}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(http2)
+	server.Protocols.SetUnencryptedHTTP2(h2c)
+	return server
+}
+
+// serve serves handler on bindAddress until shutdown.
+func serve(bindAddress string, handler http.Handler) {
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		log.Fatalf("TLS configuration error, aborting: %s", err)
+	}
+	address, secure := splitBind(bindAddress, tlsConfig != nil)
+	if secure && tlsConfig == nil {
+		log.Fatalf("Listening on %s requires -tls-cert and -tls-key", bindAddress)
+	}
+	if !secure {
+		tlsConfig = nil
+	}
+	server := newServer(address, handler, tlsConfig)
+
+	ln, err := listen(address)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if proxyProtocol {
+		ln = &proxyListener{ln}
+	}
+	addServer(server)
+
+	log.Printf("Starting server on %s", bindAddress)
+	if secure {
+		err = server.ServeTLS(ln, "", "")
+	} else {
+		err = server.Serve(ln)
+	}
+	if err == http.ErrServerClosed {
+		// Wait for running requests before returning and exiting
+		<-shutdownDone
+		log.Printf("Shutdown complete")
+		return
+	}
+	log.Fatal(err)
+}
+
+// checkMain validates the configuration file and returns the process exit
+// code.
+func checkMain(configFile string) int {
+	cfg, err := loadConfiguration(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+		return 1
+	}
+
+	errs := checkConfiguration(cfg)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+
+	fmt.Printf("%s: %d handlers OK\n", configFile, len(cfg.Handlers))
+	return 0
 }
 
 func main() {
-	var bindAddress string
+	if len(os.Args) > 1 && os.Args[1] == sandboxArg {
+		sandboxMain(os.Args[2:])
+	}
+
+	var bindAddresses bindList
 	var configFile string
+	var maxConcurrent int
+	var check bool
+	var watch bool
+	var watchInterval time.Duration
+	var auditURL string
+	var auditSpool string
+	var rateLimitRate float64
+	var workers int
+	var deadLetterDir string
+	var journalFile string
+	var queueSize int
+	var verbose bool
+	var logLevelName string
+	var trustedProxyList string
+	var rateLimitBurst int
 	var err error
 
-	flag.StringVar(&bindAddress, "bind", "0.0.0.0:4242",
-		"IP:PORT to listen for HTTP requests.")
-	flag.StringVar(&bindAddress, "b", "0.0.0.0:4242",
-		"IP:PORT to listen for HTTP requests.")
+	flag.Var(&bindAddresses, "bind",
+		"IP:PORT or unix:///path/to/socket to listen for HTTP requests.  May be repeated.  Default is 0.0.0.0:4242.")
+	flag.Var(&bindAddresses, "b",
+		"IP:PORT or unix:///path/to/socket to listen for HTTP requests.  May be repeated.")
+	flag.StringVar(&adminBind, "admin-bind", "",
+		"IP:PORT or unix:///path/to/socket to serve health checks and metrics on instead of -bind.")
+	flag.BoolVar(&enablePprof, "pprof", false,
+		"Serve pprof debugging endpoints under /debug/pprof/ on the -admin-bind listener.")
+	flag.StringVar(&socketMode, "socket-mode", "0660",
+		"Octal permissions of a Unix domain socket -bind address.")
 	flag.StringVar(&configFile, "config", "./config.yaml",
 		"Configuration file.")
 	flag.StringVar(&configFile, "c", "./config.yaml",
 		"Configuration file..")
+	flag.StringVar(&configFormat, "config-format", "",
+		"Configuration file format: yaml, json, or toml.  Default is by file extension.")
+	flag.BoolVar(&check, "check", false,
+		"Validate the configuration file and exit.")
+	flag.BoolVar(&watch, "watch", false,
+		"Reload the configuration file when it changes.")
+	flag.DurationVar(&watchInterval, "watch-interval", time.Second*5,
+		"How often to check the configuration file for changes.")
 	flag.BoolVar(&debug, "debug", false, "Activate debug mode.")
 	flag.BoolVar(&debug, "d", false, "Activate debug mode.")
 	flag.BoolVar(&verbose, "verbose", false, "Verbose logging.")
 	flag.BoolVar(&verbose, "v", false, "Verbose logging.")
+	flag.StringVar(&logLevelName, "log-level", "info",
+		"Log level: error, info, or verbose.  -verbose is the same as verbose.")
 	flag.DurationVar(&timeout, "timeout", time.Second*30, "Command/Handler timeout.")
 	flag.DurationVar(&timeout, "t", time.Second*30, "Command/Handler timeout.")
+	flag.DurationVar(&killGrace, "kill-grace", time.Second*5,
+		"How long a timed out or cancelled command has to exit after SIGTERM before it is killed.")
+	flag.BoolVar(&async, "async", false,
+		"Respond 202 Accepted immediately and queue alerts for a pool of workers.")
+	flag.IntVar(&workers, "workers", 10,
+		"Number of workers running the handlers of queued alerts with -async.")
+	flag.IntVar(&queueSize, "queue-size", 1000,
+		"Number of alerts that may wait for a worker with -async.")
+	flag.IntVar(&queueMaxDepth, "queue-max-depth", 0,
+		"Number of waiting alerts above which -async requests are refused with 503.  0 never refuses.")
+	flag.DurationVar(&queueRetryAfter, "queue-retry-after", time.Second*30,
+		"Retry-After sent with requests refused by -queue-max-depth.")
+	flag.IntVar(&alertConcurrency, "alert-concurrency", 1,
+		"Number of alerts of a request whose handlers run at once.")
+	flag.StringVar(&cgroupRoot, "cgroup-root", "",
+		"Delegated cgroup v2 directory to run each command in a transient cgroup below.")
+	flag.StringVar(&deadLetterDir, "dead-letter-dir", "",
+		"Directory storing handler executions that failed every retry.")
+	flag.StringVar(&alertmanagerURL, "alertmanager-url", "",
+		"Alertmanager queried by handlers with wait_for to confirm an alert is still firing.")
+	flag.IntVar(&flapThreshold, "flap-threshold", 0,
+		"Number of firing/resolved transitions within -flap-window above which an alert's handlers are suppressed.  0 disables.")
+	flag.DurationVar(&flapWindow, "flap-window", time.Minute*10,
+		"Period firing/resolved transitions are counted over for -flap-threshold.")
+	flag.StringVar(&callbackURL, "callback-url", "",
+		"URL the result of each handler execution is POST'd to unless the handler sets a callback.")
+	flag.DurationVar(&dedupWindow, "dedup-window", time.Minute*5,
+		"How long notifications are remembered to skip duplicate deliveries.  0 disables.")
+	flag.StringVar(&journalFile, "journal", "",
+		"File recording handler executions in progress so that those interrupted by a crash are not lost.")
+	flag.BoolVar(&journalReplay, "journal-replay", false,
+		"Run the handler executions left incomplete in the -journal again on start.")
+	flag.StringVar(&queueDir, "queue-dir", "",
+		"Directory queued alerts are written to so they survive a restart with -async.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", time.Second*60,
+		"How long to wait for running handlers when shutting down.")
+	flag.IntVar(&maxConcurrent, "max-concurrent", 0,
+		"Maximum number of commands running at once.  0 is unlimited.")
+	flag.Int64Var(&maxBody, "max-body", 4<<20,
+		"Maximum size in bytes of a webhook request body.  0 is unlimited.")
+	flag.DurationVar(&readTimeout, "read-timeout", time.Second*30,
+		"Maximum time to read an HTTP request.  0 is unlimited.")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", time.Second*10,
+		"Maximum time to read HTTP request headers.  0 is unlimited.")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0,
+		"Maximum time to handle a request and write the response.  0 is unlimited.")
+	flag.BoolVar(&http2, "http2", true,
+		"Enable HTTP/2 on TLS listeners.")
+	flag.BoolVar(&h2c, "h2c", false,
+		"Enable HTTP/2 without TLS (h2c) on cleartext listeners.")
+	flag.DurationVar(&idleTimeout, "idle-timeout", time.Second*120,
+		"Maximum time to keep an idle connection open.  0 is unlimited.")
+	flag.StringVar(&trustedProxyList, "trusted-proxies", "",
+		"Comma separated IPs or networks of proxies whose X-Forwarded-For headers are trusted.")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false,
+		"Expect connections to begin with a PROXY protocol header.")
+	flag.Float64Var(&rateLimitRate, "rate-limit", 0,
+		"Requests per second allowed from each client.  0 is unlimited.")
+	flag.IntVar(&rateLimitBurst, "rate-burst", 10,
+		"Requests a client may make at once before -rate-limit applies.")
+	flag.StringVar(&nameLabel, "name-label", "alertname",
+		"Label used to identify alerts in logs.")
+	flag.StringVar(&handlerSeparator, "handler-separator", ";",
+		"Separator between multiple handlers in the handler annotation.")
+	flag.BoolVar(&strictTemplates, "strict-templates", false,
+		"Fail handlers whose templates reference missing labels or annotations.")
+	flag.StringVar(&logFormat, "log-format", "text",
+		"Log format: text or json.")
+	flag.StringVar(&instanceLabel, "instance-label", "",
+		"Identifier of this deployment added to logs and audit records.")
+	flag.StringVar(&auditURL, "audit-url", "",
+		"URL to POST an audit record of every processed event to.")
+	flag.StringVar(&auditSpool, "audit-spool", "",
+		"Directory to spool undeliverable audit records in.")
+	flag.StringVar(&tlsCertFile, "tls-cert", "",
+		"Certificate file to serve HTTPS with.")
+	flag.StringVar(&tlsKeyFile, "tls-key", "",
+		"Private key file of the -tls-cert certificate.")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "",
+		"CA certificates file.  Clients must present a certificate signed by one of them.")
+	flag.StringVar(&basicAuthUser, "basic-auth-user", "",
+		"User name clients must authenticate as with HTTP Basic authentication.")
+	flag.StringVar(&basicAuthPasswordFile, "basic-auth-password-file", "",
+		"File containing the password of -basic-auth-user.")
+	flag.StringVar(&htpasswdFile, "htpasswd", "",
+		"htpasswd file of users allowed to authenticate with HTTP Basic authentication.")
 
 	flag.Parse()
-	config, err = loadConfiguration(configFile)
+	configureLogging()
+	if verbose {
+		logLevelName = "verbose"
+	}
+	level, err := parseLogLevel(logLevelName)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	setLogLevel(level)
+	if check {
+		os.Exit(checkMain(configFile))
+	}
+	err = reloadConfiguration(configFile)
 	if err != nil {
 		log.Fatalf("Configuration error, aborting: %s", err)
 	}
-	for k, v := range config.Handlers {
-		log.Printf("Found handler %s => %s", k, v)
+	if auth, err = loadBasicAuth(); err != nil {
+		log.Fatalf("Authentication error, aborting: %s", err)
+	}
+	go handleSignals(configFile)
+	if enablePprof && adminBind == "" {
+		log.Fatalf("Error: -pprof requires -admin-bind")
+	}
+	if trustedProxies, err = parseTrustedProxies(trustedProxyList); err != nil {
+		log.Fatalf("Trusted proxies error, aborting: %s", err)
+	}
+	if deadLetterDir != "" {
+		if deadLetters, err = newDeadLetterStore(deadLetterDir); err != nil {
+			log.Fatalf("Dead letter directory error, aborting: %s", err)
+		}
+	}
+	if err := setupCgroups(); err != nil {
+		log.Fatalf("cgroup error, aborting: %s", err)
+	}
+	if alertConcurrency < 1 {
+		log.Fatalf("Error: -alert-concurrency must be at least 1")
+	}
+	if callbackURL != "" {
+		if err := checkCallbackURL(callbackURL); err != nil {
+			log.Fatalf("Error: -callback-url: %s", err)
+		}
+	}
+	if async {
+		if workers < 1 || queueSize < 0 {
+			log.Fatalf("Error: -workers must be at least 1 and -queue-size not negative")
+		}
+		if queueMaxDepth < 0 {
+			log.Fatalf("Error: -queue-max-depth must not be negative")
+		}
+	} else if queueDir != "" {
+		log.Fatalf("Error: -queue-dir requires -async")
+	}
+	var incomplete []journalEntry
+	if journalFile != "" {
+		if journal, incomplete, err = openJournal(journalFile); err != nil {
+			log.Fatalf("Journal error, aborting: %s", err)
+		}
+	} else if journalReplay {
+		log.Fatalf("Error: -journal-replay requires -journal")
+	}
+	if rateLimitRate > 0 {
+		limiter = newRateLimiter(rateLimitRate, rateLimitBurst)
+	}
+	if maxConcurrent > 0 {
+		globalSlots = make(chan struct{}, maxConcurrent)
+	}
+	if !watch && configMapGeneration(configFile) != "" {
+		log.Printf("Configuration is a Kubernetes ConfigMap, watching for changes")
+		watch = true
+	}
+	if watch {
+		go watchConfiguration(configFile, watchInterval, nil)
+	}
+	if auditURL != "" {
+		audit = NewAuditSink(auditURL, auditSpool)
+		if err = audit.Start(); err != nil {
+			log.Fatalf("Audit spool error, aborting: %s", err)
+		}
+	}
+
+	// Recovered jobs run only once the state above is set up so that they
+	// are limited, journaled and audited like new ones.
+	if async {
+		startWorkers(workers, queueSize)
+		if queueDir != "" {
+			if err := recoverQueue(); err != nil {
+				log.Fatalf("Queue directory error, aborting: %s", err)
+			}
+		}
 	}
+	replayJournal(incomplete)
 
-	run(bindAddress)
+	if len(bindAddresses) == 0 {
+		bindAddresses = bindList{"0.0.0.0:4242"}
+	}
+	if adminBind != "" {
+		go runAdmin(adminBind)
+	}
+	for _, address := range bindAddresses[1:] {
+		go run(address)
+	}
+	run(bindAddresses[0])
 }
@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -25,9 +29,16 @@ var bind = "127.0.0.1:4242"
 func init() {
 	var err error
 
+	// Sandboxed commands run the test binary to enter their sandbox
+	if len(os.Args) > 1 && os.Args[1] == sandboxArg {
+		sandboxMain(os.Args[2:])
+	}
+
 	// load test configuration into global config variable
 	debug = true
-	verbose = true
+	setLogLevel(levelVerbose)
+	nameLabel = "alertname"
+	handlerSeparator = ";"
 	timeout = time.Second * 15
 	config, err = loadConfiguration("testdata/config.yaml")
 	if err != nil {
@@ -129,10 +140,7 @@ func TestExecution(t *testing.T) {
 }
 
 func TestDefaultHandler(t *testing.T) {
-	config.Handlers["default"] = struct {
-		Command string
-		Status  string
-	}{
+	config.Handlers["default"] = Handler{
 		Command: "/bin/bash -c \"touch testdata/testDefault\"",
 		Status:  "*",
 	}
@@ -141,10 +149,7 @@ func TestDefaultHandler(t *testing.T) {
 }
 
 func TestAllHandler(t *testing.T) {
-	config.Handlers["all"] = struct {
-		Command string
-		Status  string
-	}{
+	config.Handlers["all"] = Handler{
 		Command: "/bin/bash -c \"touch testdata/testAll\"",
 		Status:  "*",
 	}
@@ -236,3 +241,1047 @@ func TestLargeSize(t *testing.T) {
 		t.Errorf("Bad Status from test: %d", resp.StatusCode)
 	}
 }
+
+func TestNameLabel(t *testing.T) {
+	var tests = map[string]string{
+		"alertname": "5e0cb3c1e3ef4bd0", // Fall back to the fingerprint
+		"rule":      "DiskFull",
+	}
+
+	buf, err := ioutil.ReadFile("testdata/test10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := unmarshalBody(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	defer func() { nameLabel = "alertname" }()
+
+	for label, name := range tests {
+		logs.Reset()
+		nameLabel = label
+		handleEvent(context.Background(), event)
+		if !strings.Contains(logs.String(), "Processing Alert: "+name) {
+			t.Errorf("With -name-label %s expected alert to be logged as %s: %s",
+				label, name, logs.String())
+		}
+	}
+}
+
+func TestStrictTemplates(t *testing.T) {
+	alert := Alert{Labels: map[string]string{"alertname": "TestAlert"}}
+	handler := []string{"test"}
+	command := "/bin/echo {{ .Labels.alertname }} {{ .Labels.nonexistent }}"
+
+	defer func() { strictTemplates = false }()
+
+	strictTemplates = false
+	exe, args, err := formatHandler(handler, command, alert)
+	if err != nil {
+		t.Errorf("Lenient template should not fail: %s", err)
+	} else if exe != "/bin/echo" || !equal(args, []string{"TestAlert"}) {
+		t.Errorf("Lenient template rendered %s %v", exe, args)
+	}
+
+	strictTemplates = true
+	_, _, err = formatHandler(handler, command, alert)
+	if err == nil {
+		t.Errorf("Strict template referencing a missing label should fail")
+	}
+}
+
+func TestHandlerStrictTemplates(t *testing.T) {
+	alert := Alert{Labels: map[string]string{"alertname": "TestAlert"}}
+	command := "/bin/echo {{ .Labels.nonexistent }}"
+	on, off := true, false
+
+	config.Handlers["strict"] = Handler{Command: command, StrictTemplates: &on}
+	config.Handlers["lenient"] = Handler{Command: command, StrictTemplates: &off}
+	defer delete(config.Handlers, "strict")
+	defer delete(config.Handlers, "lenient")
+
+	if _, _, err := formatHandler([]string{"strict"}, command, alert); err == nil {
+		t.Errorf("Strict handler referencing a missing label should fail")
+	}
+
+	strictTemplates = true
+	defer func() { strictTemplates = false }()
+	if _, _, err := formatHandler([]string{"lenient"}, command, alert); err != nil {
+		t.Errorf("Lenient handler should override -strict-templates: %s", err)
+	}
+
+	// Handlers without the setting inherit it from the defaults
+	cfg := &Configuration{
+		Defaults: Defaults{StrictTemplates: &off},
+		Handlers: map[string]Handler{"inherit": {Command: command}},
+	}
+	cfg.applyDefaults()
+	if cfg.Handlers["inherit"].strict() {
+		t.Errorf("Handler did not inherit strict_templates from the defaults")
+	}
+}
+
+func TestListHandlers(t *testing.T) {
+	orig := getConfig()
+	defer setConfig(orig)
+
+	// Reload with a configuration containing a new handler
+	cfg, err := loadConfiguration("testdata/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Handlers["reloaded"] = Handler{
+		Command: "/bin/true",
+		Status:  "resolved",
+		Timeout: 90 * time.Second,
+	}
+	setConfig(cfg)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/handlers", bind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Bad Status from /handlers: %d", resp.StatusCode)
+	}
+
+	handlers := make(map[string]handlerInfo)
+	if err := json.NewDecoder(resp.Body).Decode(&handlers); err != nil {
+		t.Fatal(err)
+	}
+	h, ok := handlers["reloaded"]
+	if !ok {
+		t.Fatalf("Reloaded handler missing from /handlers: %v", handlers)
+	}
+	if h.Status != "resolved" || h.Timeout != "1m30s" {
+		t.Errorf("Unexpected handler settings: %#v", h)
+	}
+	if handlers["test"].Status != "firing" || handlers["touch"].Status != "firing" {
+		t.Errorf("Handler status should default to firing: %v", handlers)
+	}
+	if handlers["test"].Timeout != timeout.String() {
+		t.Errorf("Handler timeout should default to the global timeout: %v", handlers)
+	}
+}
+
+func TestReloadConfiguration(t *testing.T) {
+	orig := getConfig()
+	defer setConfig(orig)
+
+	fd, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.Close()
+
+	// A broken configuration must not replace the active one
+	ioutil.WriteFile(fd.Name(), []byte("handlers: [broken"), 0644)
+	if err := reloadConfiguration(fd.Name()); err == nil {
+		t.Errorf("Reloading a broken configuration should fail")
+	}
+	if getConfig() != orig {
+		t.Errorf("Broken configuration replaced the active configuration")
+	}
+
+	ioutil.WriteFile(fd.Name(), []byte("handlers:\n  new:\n    command: /bin/true\n"), 0644)
+	if err := reloadConfiguration(fd.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := getConfig().Handlers["new"]; !ok {
+		t.Errorf("Reloaded configuration is not active: %v", getConfig().Handlers)
+	}
+}
+
+func TestCheckConfiguration(t *testing.T) {
+	cfg, err := loadConfiguration("testdata/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := checkConfiguration(cfg); len(errs) != 0 {
+		t.Errorf("Test configuration should be valid: %v", errs)
+	}
+
+	cfg.Handlers["badtemplate"] = Handler{Command: "/bin/echo {{ .Labels.foo "}
+	cfg.Handlers["empty"] = Handler{Command: " "}
+	cfg.Handlers["badwindow"] = Handler{
+		Command: "/bin/true",
+		Windows: []Window{{Start: "9am", End: "17:00"}},
+	}
+	errs := checkConfiguration(cfg)
+	if len(errs) != 3 {
+		t.Fatalf("Expected 3 errors, got: %v", errs)
+	}
+	for i, name := range []string{"badtemplate", "badwindow", "empty"} {
+		if !strings.Contains(errs[i].Error(), "Handler "+name+":") {
+			t.Errorf("Error does not name handler %s: %s", name, errs[i])
+		}
+	}
+}
+
+func TestTemplatesCompiledOnLoad(t *testing.T) {
+	fd, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("handlers:\n" +
+		"  good: /bin/echo {{ .Labels.alertname }}\n" +
+		"  broken: \"/bin/echo\\n{{ .Labels.foo \"\n" +
+		"  locked:\n" +
+		"    command: /bin/true\n" +
+		"    lockfile: \"{{ end }}\"\n")
+	fd.Close()
+
+	_, err = loadConfiguration(fd.Name())
+	if err == nil {
+		t.Fatalf("Configuration with broken templates should not load")
+	}
+	for _, want := range []string{"Handler broken: template: command:2:", "Handler locked: lockfile:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error does not contain %q: %s", want, err)
+		}
+	}
+}
+
+func TestLargeConfiguration(t *testing.T) {
+	fd, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+
+	fmt.Fprintf(fd, "handlers:\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(fd, "  handler%03d:\n", i)
+		fmt.Fprintf(fd, "    command: \"/bin/echo {{ .Labels.alertname }} {{ index .Argv 0 }} %d\"\n", i)
+		fmt.Fprintf(fd, "    status: \"*\"\n")
+	}
+	fd.Close()
+
+	info, err := os.Stat(fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() <= JsonBody {
+		t.Fatalf("Test configuration is only %d bytes", info.Size())
+	}
+
+	cfg, err := loadConfiguration(fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Handlers) != 100 {
+		t.Errorf("Expected 100 handlers, found %d", len(cfg.Handlers))
+	}
+	if cfg.Handlers["handler099"].Status != "*" {
+		t.Errorf("Last handler was not loaded: %#v", cfg.Handlers["handler099"])
+	}
+}
+
+func TestConfigurationDirectory(t *testing.T) {
+	cfg, err := loadConfiguration("testdata/conf.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"restartprometheus", "vacuum"} {
+		if _, ok := cfg.Handlers[name]; !ok {
+			t.Errorf("Handler %s missing from merged configuration", name)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "conf.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"a.yaml", "b.yaml"} {
+		err = ioutil.WriteFile(filepath.Join(dir, f),
+			[]byte("handlers:\n  dup:\n    command: /bin/true\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = loadConfiguration(dir)
+	if err == nil || !strings.Contains(err.Error(), "dup") {
+		t.Errorf("Duplicate handler should be reported, got: %v", err)
+	}
+}
+
+func TestConfigurationInclude(t *testing.T) {
+	cfg, err := loadConfiguration("testdata/include/main.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"restart", "notify", "vacuum"} {
+		if _, ok := cfg.Handlers[name]; !ok {
+			t.Errorf("Handler %s missing from included configuration", name)
+		}
+	}
+	if len(cfg.included) == 0 {
+		t.Errorf("Included files are not recorded for watching")
+	}
+
+	dir, err := ioutil.TempDir("", "include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	err = ioutil.WriteFile(file, []byte("include: [missing.yaml]\nhandlers: {}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfiguration(file); err == nil {
+		t.Errorf("Missing included file should be an error")
+	}
+}
+
+func TestHandlerDefaults(t *testing.T) {
+	cfg, err := loadConfiguration("testdata/defaults.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := cfg.Handlers["inherit"]
+	if h.Timeout != 30*time.Second || h.Status != "*" || h.Workdir != "/tmp" ||
+		h.Env["TEAM"] != "sre" {
+		t.Errorf("Handler did not inherit defaults: %#v", h)
+	}
+	h = cfg.Handlers["override"]
+	if h.Timeout != 5*time.Second || h.Status != "firing" || h.Workdir != "/tmp" ||
+		h.Env["TEAM"] != "dba" || h.Env["REGION"] != "us-east-1" {
+		t.Errorf("Handler did not override defaults: %#v", h)
+	}
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	out, err := executeHandler(context.Background(), cfg.Handlers["inherit"], "/bin/bash",
+		[]string{"-c", "echo $TEAM $REGION $(pwd)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "sre us-east-1 /tmp\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
+
+func TestStrictConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = map[string]string{
+		"typo.yaml":     "handlers:\n  restart:\n    comand: /bin/true\n",
+		"status.yaml":   "handlers:\n  restart:\n    command: /bin/true\n    status: fring\n",
+		"empty.yaml":    "handlers:\n  restart:\n    timeout: 5s\n",
+		"toplevel.yaml": "handler:\n  restart: /bin/true\n",
+		"typo.json":     `{"handlers": {"restart": {"staus": "firing", "command": "/bin/true"}}}`,
+		"typo.toml":     "[handlers.restart]\ncomand = \"/bin/true\"\n",
+	}
+	for file, body := range tests {
+		path := filepath.Join(dir, file)
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfiguration(path); err == nil {
+			t.Errorf("%s: invalid configuration was accepted", file)
+		}
+	}
+
+	_, err = loadConfiguration(filepath.Join(dir, "typo.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("Error should include the line number, got: %v", err)
+	}
+}
+
+func TestConfigurationFormats(t *testing.T) {
+	for _, file := range []string{"testdata/config.json", "testdata/config.toml"} {
+		cfg, err := loadConfiguration(file)
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+		h := cfg.Handlers["restartprometheus"]
+		if h.Command != "remctl {{ index .Argv 0 }} prom-restart" || h.Status != "*" ||
+			h.MaxCPU != 10*time.Second {
+			t.Errorf("%s: unexpected handler %#v", file, h)
+		}
+		if cfg.Handlers["test"].Status != "firing" {
+			t.Errorf("%s: unexpected handler %#v", file, cfg.Handlers["test"])
+		}
+	}
+
+	// Forcing the format overrides the file extension
+	configFormat = "json"
+	defer func() { configFormat = "" }()
+	if _, err := loadConfiguration("testdata/config.toml"); err == nil {
+		t.Errorf("Loading TOML as JSON should fail")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	handler := Handler{Command: "/bin/sleep 5", Timeout: 100 * time.Millisecond}
+	if handler.timeout() != 100*time.Millisecond {
+		t.Errorf("Handler timeout should override the global timeout")
+	}
+	if (Handler{}).timeout() != timeout {
+		t.Errorf("Handler without a timeout should use the global timeout")
+	}
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	start := time.Now()
+	_, err := executeHandler(context.Background(), handler, "/bin/sleep", []string{"5"})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Handler should have timed out: %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Handler timeout was not applied, took %s", time.Since(start))
+	}
+}
+
+func TestStdinAlertJSON(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["stdin"] = Handler{Command: "/bin/cat", Stdin: "alert_json"}
+	defer delete(config.Handlers, "stdin")
+
+	alert := Alert{
+		Status:      "firing",
+		Labels:      map[string]string{"alertname": "Stdin"},
+		Annotations: map[string]string{"description": "It's \"quoted\" and\nspans lines"},
+	}
+	alert, err := (&AlertManagerEvent{}).prepareAlert(alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := parseHandler(context.Background(), []string{"stdin"}, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := Alert{}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("Standard input is not the alert JSON: %s: %q", err, out.String())
+	}
+	if got.Annotations["description"] != alert.Annotations["description"] {
+		t.Errorf("Unexpected alert on standard input: %#v", got)
+	}
+
+	cfg := &Configuration{Handlers: map[string]Handler{
+		"bad": {Command: "/bin/cat", Stdin: "alert_yaml"},
+	}}
+	if err := validateConfiguration(cfg); err == nil {
+		t.Errorf("Unknown stdin should be rejected")
+	}
+}
+
+func TestStdinTemplate(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["stdin"] = Handler{
+		Command:       "/bin/cat",
+		StdinTemplate: "{{ .Labels.alertname }} on {{ index .Argv 0 }}\n{{ .Annotations.description }}\n",
+	}
+	defer delete(config.Handlers, "stdin")
+
+	alert := Alert{
+		Status:      "firing",
+		Labels:      map[string]string{"alertname": "Stdin"},
+		Annotations: map[string]string{"description": "It's \"quoted\""},
+	}
+	out, err := parseHandler(context.Background(), []string{"stdin", "db1"}, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Stdin on db1\nIt's \"quoted\"\n"; out.String() != want {
+		t.Errorf("Standard input is %q, want %q", out.String(), want)
+	}
+
+	cfg := &Configuration{Handlers: map[string]Handler{
+		"both": {Command: "/bin/cat", Stdin: "alert_json", StdinTemplate: "{{ .Status }}"},
+	}}
+	if err := validateConfiguration(cfg); err == nil {
+		t.Errorf("Handler with both stdin and stdin_template should be rejected")
+	}
+}
+
+func TestEventScope(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["group"] = Handler{
+		Command: "/bin/bash -c \"cat >> testdata/testEvent\"",
+		Stdin:   "event_json",
+		Scope:   "event",
+	}
+	defer delete(config.Handlers, "group")
+	defer os.Remove("testdata/testEvent")
+
+	event, err := unmarshalBody([]byte(`{"receiver": "team", "status": "firing",
+		"groupKey": 15759275461218033480, "groupLabels": {"job": "node"},
+		"alerts": [
+			{"status": "firing", "labels": {"alertname": "A"}, "annotations": {"handler": "group"}},
+			{"status": "firing", "labels": {"alertname": "B"}, "annotations": {"handler": "group"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handleEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile("testdata/testEvent")
+	if err != nil {
+		t.Fatalf("Handler did not run: %s", err)
+	}
+	got := AlertManagerEvent{}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	if err := decoder.Decode(&got); err != nil {
+		t.Fatalf("Standard input is not the event JSON: %s: %q", err, buf)
+	}
+	if decoder.More() {
+		t.Errorf("Event scoped handler ran more than once: %q", buf)
+	}
+	if got.GroupKey != "15759275461218033480" || len(got.Alerts) != 2 ||
+		got.GroupLabels["job"] != "node" {
+		t.Errorf("Unexpected event on standard input: %#v", got)
+	}
+}
+
+func TestGroupTemplate(t *testing.T) {
+	event, err := unmarshalBody([]byte(`{"receiver": "team", "status": "firing",
+		"groupKey": "{}:{cluster=east}", "externalURL": "http://am:9093",
+		"groupLabels": {"cluster": "east"}, "commonLabels": {"job": "node"},
+		"commonAnnotations": {"runbook": "http://wiki/node"},
+		"alerts": [{"status": "firing", "labels": {"alertname": "A"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert, err := event.prepareAlert(event.Alerts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command := "/bin/echo {{ .Group.Labels.cluster }} {{ .Group.CommonLabels.job }} " +
+		"{{ .Group.CommonAnnotations.runbook }} {{ .Group.Receiver }} {{ .Group.Status }} " +
+		"{{ .Group.ExternalURL }} {{ .Group.Key }}"
+	_, args, err := formatHandler([]string{"test"}, command, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"east", "node", "http://wiki/node", "team", "firing", "http://am:9093", "{}:{cluster=east}"}
+	if !equal(args, want) {
+		t.Errorf("Group fields rendered %q, want %q", args, want)
+	}
+}
+
+func TestExitCodeClasses(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = time.Second }()
+
+	config.Handlers["classes"] = Handler{
+		Command: "/bin/bash -c \"exit {{ index .Argv 0 }}\"",
+		Retries: 2,
+		RetryOn: []int{75},
+		Ignore:  []int{3},
+	}
+	defer delete(config.Handlers, "classes")
+
+	for _, test := range []struct {
+		code     string
+		attempts int
+		failed   bool
+	}{
+		{"3", 1, false},
+		{"1", 1, true},
+		{"75", 3, true},
+	} {
+		_, attempts, err := runHandler(context.Background(), config,
+			[]string{"classes", test.code}, Alert{Status: "firing"})
+		if attempts != test.attempts || (err != nil) != test.failed {
+			t.Errorf("Exit code %s: expected %d attempts and failure %v, got %d attempts: %v",
+				test.code, test.attempts, test.failed, attempts, err)
+		}
+	}
+
+	cfg := &Configuration{Handlers: map[string]Handler{
+		"bad": {Command: "/bin/true", RetryOn: []int{3}, Ignore: []int{3}},
+	}}
+	if err := validateConfiguration(cfg); err == nil {
+		t.Errorf("Exit code both retried and ignored should be rejected")
+	}
+}
+
+func TestAlertConcurrency(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+	alertConcurrency = 4
+	defer func() { alertConcurrency = 1 }()
+
+	config.Handlers["sleepy"] = Handler{Command: "/bin/sleep 0.{{ index .Argv 0 }}"}
+	defer delete(config.Handlers, "sleepy")
+
+	// Later alerts finish first
+	event := &AlertManagerEvent{}
+	for i, name := range []string{"A", "B", "C", "D"} {
+		event.Alerts = append(event.Alerts, Alert{
+			Status:      "firing",
+			Labels:      map[string]string{"alertname": name},
+			Annotations: map[string]string{"handler": fmt.Sprintf("sleepy %d", 4-i)},
+		})
+	}
+
+	start := time.Now()
+	result, err := handleEvent(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Alerts were not handled concurrently, took %s", elapsed)
+	}
+	for i, name := range []string{"A", "B", "C", "D"} {
+		if result.Alerts[i].Alertname != name {
+			t.Errorf("Result %d is for alert %s, expected %s", i, result.Alerts[i].Alertname, name)
+		}
+	}
+}
+
+func TestHandlerCancel(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := executeHandler(ctx, Handler{}, "/bin/sleep", []string{"5"})
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("Handler should have been cancelled: %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Handler was not killed when cancelled, took %s", time.Since(start))
+	}
+}
+
+func TestSpecialHandlerNames(t *testing.T) {
+	config.SpecialHandlers = SpecialHandlers{Default: "fallback", All: "audit"}
+	config.Handlers["fallback"] = Handler{
+		Command: "/bin/bash -c \"touch testdata/testFallback\"",
+		Status:  "*",
+	}
+	config.Handlers["all"] = Handler{
+		Command: "/bin/bash -c \"touch testdata/testAll\"",
+		Status:  "*",
+	}
+	defer func() {
+		config.SpecialHandlers = SpecialHandlers{}
+		delete(config.Handlers, "fallback")
+		delete(config.Handlers, "all")
+	}()
+	defer func() { debug = true }()
+
+	executeTest(t, "testdata/test1", "testdata/testFallback")
+
+	// A handler literally named "all" is no longer run for every alert
+	_ = os.Remove("testdata/testAll")
+	resp, err := postHelper("testdata/test4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Bad Status from test: %d", resp.StatusCode)
+	}
+	if _, err := os.Stat("testdata/testAll"); err == nil {
+		t.Errorf("Handler named all should not run once renamed")
+		_ = os.Remove("testdata/testAll")
+	}
+}
+
+func TestHandlerGroups(t *testing.T) {
+	orig := getConfig()
+	defer setConfig(orig)
+
+	cfg, err := loadConfiguration("testdata/groups.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	files := []string{"testdata/testNotify", "testdata/testTicket"}
+	_, err = parseHandler(context.Background(), []string{"page", "sre"}, Alert{Status: "firing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Errorf("Group member did not run: %s", err)
+		} else if string(buf) != "sre\n" {
+			t.Errorf("Group member did not receive the group's arguments: %q", buf)
+		}
+		_ = os.Remove(f)
+	}
+
+	// Only the ticket handler accepts resolved alerts
+	_, err = parseHandler(context.Background(), []string{"page", "sre"}, Alert{Status: "resolved"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(files[0]); err == nil {
+		t.Errorf("Group member ran for an alert status it does not accept")
+	}
+	if _, err := os.Stat(files[1]); err != nil {
+		t.Errorf("Group member did not run: %s", err)
+	}
+	for _, f := range files {
+		_ = os.Remove(f)
+	}
+
+	cfg.Handlers["loop"] = Handler{Group: []string{"page", "loop"}}
+	if err := checkGroups(cfg); err == nil {
+		t.Errorf("Group including itself should be an error")
+	}
+	cfg.Handlers["loop"] = Handler{Group: []string{"missing"}}
+	if err := checkGroups(cfg); err == nil {
+		t.Errorf("Group including an undefined handler should be an error")
+	}
+}
+
+func TestShellHandler(t *testing.T) {
+	shell := true
+	config.Handlers["shell"] = Handler{
+		Command: "echo {{ index .Argv 0 }} | tr a-z A-Z > testdata/testShell",
+		Shell:   &shell,
+	}
+	defer delete(config.Handlers, "shell")
+	defer os.Remove("testdata/testShell")
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	_, err := parseHandler(context.Background(), []string{"shell", "host1"}, Alert{Status: "firing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile("testdata/testShell")
+	if err != nil {
+		t.Fatalf("Shell handler did not run: %s", err)
+	}
+	if string(buf) != "HOST1\n" {
+		t.Errorf("Unexpected shell handler output: %q", buf)
+	}
+}
+
+func TestTemplatedEnv(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	os.Setenv("AM_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("AM_TEST_SECRET")
+	config.Handlers["env"] = Handler{
+		Args: []string{"/bin/bash", "-c", "echo $TARGET_HOST $TEAM $TOKEN"},
+		Env: map[string]string{
+			"TARGET_HOST": `{{ .Labels.instance | reReplaceAll ":[0-9]+$" "" }}`,
+			"TEAM":        `{{ .Labels.team | default "sre" }}`,
+			"TOKEN":       "secret://env/AM_TEST_SECRET",
+		},
+	}
+	defer delete(config.Handlers, "env")
+
+	alert := Alert{Status: "firing", Labels: map[string]string{"instance": "db1:9100"}}
+	out, err := parseHandler(context.Background(), []string{"env"}, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "db1 sre hunter2\n" {
+		t.Errorf("Unexpected environment: %q", out.String())
+	}
+	if config.Handlers["env"].Env["TEAM"] != `{{ .Labels.team | default "sre" }}` {
+		t.Errorf("Rendering modified the handler's configuration")
+	}
+
+	cfg := &Configuration{Handlers: map[string]Handler{
+		"broken": {Command: "/bin/true", Env: map[string]string{"HOST": "{{ .Labels.instance"}},
+	}}
+	if err := validateConfiguration(cfg); err == nil || !strings.Contains(err.Error(), "env HOST") {
+		t.Errorf("Broken env template should be rejected naming the variable: %v", err)
+	}
+}
+
+func TestDisabledHandler(t *testing.T) {
+	enabled := false
+	config.Handlers["disabled"] = Handler{
+		Command: "/bin/bash -c \"touch testdata/testDisabled\"",
+		Enabled: &enabled,
+	}
+	defer delete(config.Handlers, "disabled")
+	defer os.Remove("testdata/testDisabled")
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	_, err := parseHandler(context.Background(), []string{"disabled"}, Alert{Status: "firing"})
+	if err != nil {
+		t.Errorf("Disabled handler should succeed: %s", err)
+	}
+	if _, err := os.Stat("testdata/testDisabled"); err == nil {
+		t.Errorf("Disabled handler ran its command")
+	}
+}
+
+func TestStatusList(t *testing.T) {
+	var tests = map[string]string{
+		"yaml": "handlers:\n  both:\n    command: /bin/true\n    status: [firing, resolved]\n",
+		"json": `{"handlers": {"both": {"command": "/bin/true", "status": ["firing", "resolved"]}}}`,
+		"toml": "[handlers.both]\ncommand = \"/bin/true\"\nstatus = [\"firing\", \"resolved\"]\n",
+	}
+	for format, body := range tests {
+		cfg, err := decodeConfiguration([]byte(body), format)
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+			continue
+		}
+		if s := cfg.Handlers["both"].status(); s != "firing,resolved" {
+			t.Errorf("%s: unexpected status %q", format, s)
+		}
+	}
+
+	var matches = []struct {
+		filter StatusFilter
+		status string
+		match  bool
+	}{
+		{"firing", "firing", true},
+		{"firing", "resolved", false},
+		{"*", "resolved", true},
+		{"firing, resolved", "resolved", true},
+		{"firing,resolved", "suppressed", false},
+	}
+	for _, m := range matches {
+		if m.filter.match(m.status) != m.match {
+			t.Errorf("Filter %q matching %s should be %v", m.filter, m.status, m.match)
+		}
+	}
+}
+
+func TestHandlerSource(t *testing.T) {
+	cfg, err := decodeConfiguration([]byte(
+		"handler_source: [annotation:handler, label:runbook_action]\nhandlers: {}\n"), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		alert   Alert
+		handler string
+		found   bool
+	}{
+		{Alert{Annotations: map[string]string{"handler": "restart"},
+			Labels: map[string]string{"runbook_action": "page"}}, "restart", true},
+		{Alert{Labels: map[string]string{"runbook_action": "page"}}, "page", true},
+		{Alert{Labels: map[string]string{"alertname": "HostDown"}}, "", false},
+	}
+	for _, test := range tests {
+		handler, found := cfg.handlerOf(test.alert)
+		if handler != test.handler || found != test.found {
+			t.Errorf("Expected handler %q (%v) for %v, got %q (%v)",
+				test.handler, test.found, test.alert, handler, found)
+		}
+	}
+
+	cfg.HandlerSource = HandlerSource{"header:handler"}
+	if err := validateConfiguration(cfg); err == nil {
+		t.Errorf("Invalid handler source should be rejected")
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	var tests = map[string]string{
+		"yaml": "handlers:\n  list:\n    command: [printf, \"%s|\", \"{{ .Labels.summary }}\", \"{{ index .Argv 0 }}\"]\n    status: \"*\"\n",
+		"json": `{"handlers": {"list": {"command": ["printf", "%s|", "{{ .Labels.summary }}", "{{ index .Argv 0 }}"], "status": "*"}}}`,
+	}
+	for format, body := range tests {
+		cfg, err := decodeConfiguration([]byte(body), format)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		h := cfg.Handlers["list"]
+		if len(h.Args) != 4 || h.Command != "" || h.Status != "*" {
+			t.Errorf("%s: unexpected handler %#v", format, h)
+		}
+	}
+
+	_, err := decodeConfiguration([]byte("handlers:\n  list:\n    command: [printf]\n    staus: firing\n"), "yaml")
+	if err == nil {
+		t.Errorf("Unknown field next to a command list should be rejected")
+	}
+
+	config.Handlers["list"] = Handler{Args: []string{"printf", "%s|", "{{ .Labels.summary }}", "{{ index .Argv 0 }}"}}
+	defer delete(config.Handlers, "list")
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	alert := Alert{Status: "firing", Labels: map[string]string{"summary": `disk "full" on host`}}
+	out, err := parseHandler(context.Background(), []string{"list", "x"}, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != `disk "full" on host|x|` {
+		t.Errorf("Unexpected arguments: %q", out.String())
+	}
+}
+
+func TestMaxBody(t *testing.T) {
+	maxBody = 64
+	defer func() { maxBody = 0 }()
+
+	resp, err := postHelper("testdata/test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversized body should return 413, got %d", resp.StatusCode)
+	}
+
+	maxBody = 1 << 20
+	resp, err = postHelper("testdata/test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Body within the limit should be accepted, got %d", resp.StatusCode)
+	}
+}
+
+func TestRoutedWebHook(t *testing.T) {
+	config.Handlers["routed"] = Handler{
+		Command: "/bin/bash -c \"echo {{ index .Argv 0 }} > testdata/testRouted\"",
+	}
+	defer delete(config.Handlers, "routed")
+	defer os.Remove("testdata/testRouted")
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	// test1 has no handler annotation
+	body, err := ioutil.ReadFile("testdata/test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/api/v1/webhook/routed/nginx", "/webhook/routed/nginx"} {
+		_ = os.Remove("testdata/testRouted")
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", bind, path),
+			"application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("Bad Status from %s: %d", path, resp.StatusCode)
+		}
+		deprecated := !strings.HasPrefix(path, "/api/v1/")
+		if (resp.Header.Get("Deprecation") != "") != deprecated {
+			t.Errorf("Unexpected Deprecation header from %s: %q", path,
+				resp.Header.Get("Deprecation"))
+		}
+
+		buf, err := ioutil.ReadFile("testdata/testRouted")
+		if err != nil {
+			t.Fatalf("Routed handler did not run for %s: %s", path, err)
+		}
+		if string(buf) != "nginx\n" {
+			t.Errorf("Routed handler did not receive its arguments: %q", buf)
+		}
+	}
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/webhook/undefined", bind),
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("Undefined routed handler should fail, got %d", resp.StatusCode)
+	}
+}
+
+func TestReceiverHandlers(t *testing.T) {
+	config.Handlers["db-default"] = Handler{
+		Command: "/bin/bash -c \"echo {{ .Labels.alertname }} > testdata/testReceiver\"",
+	}
+	config.Receivers = map[string]string{"team-db": "db-default"}
+	defer delete(config.Handlers, "db-default")
+	defer func() { config.Receivers = nil }()
+	defer os.Remove("testdata/testReceiver")
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "ReplicationLag"}}
+	event := &AlertManagerEvent{Receiver: "team-db", Alerts: []Alert{alert}}
+	if _, err := handleEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile("testdata/testReceiver")
+	if err != nil {
+		t.Fatalf("Receiver handler did not run: %s", err)
+	}
+	if string(buf) != "ReplicationLag\n" {
+		t.Errorf("Unexpected receiver handler output: %q", buf)
+	}
+
+	// Other receivers still use the default handler
+	os.Remove("testdata/testReceiver")
+	event.Receiver = "team-web"
+	if _, err := handleEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("testdata/testReceiver"); err == nil {
+		t.Errorf("Receiver handler ran for a different receiver")
+	}
+
+	cfg := &Configuration{
+		Handlers:  map[string]Handler{"test": {Command: "/bin/true"}},
+		Receivers: map[string]string{"team-db": "undefined"},
+	}
+	if err := validateConfiguration(cfg); err == nil {
+		t.Errorf("Receiver mapped to an undefined handler should be rejected")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deploymentLabel is the name of the constant label carrying the value of
+// -instance-label on every metric.
+const deploymentLabel = "deployment"
+
+var (
+	httpRequests = newCounter("am_event_handler_http_requests_total",
+		"HTTP requests by response status code.", "code")
+	alertsReceived = newCounter("am_event_handler_alerts_received_total",
+		"Alerts received from the Alertmanager.", "alert", "status")
+	handlerExecutions = newCounter("am_event_handler_handler_executions_total",
+		"Handler command executions by result.", "handler", "result")
+	handlerSkips = newCounter("am_event_handler_handler_skipped_total",
+		"Handler executions skipped by reason.", "handler", "reason")
+	handlerDuration = newHistogram("am_event_handler_handler_duration_seconds",
+		"Handler command execution time.",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 300}, "handler")
+	queueDepth = &gauge{name: "am_event_handler_queue_length",
+		help: "Alerts waiting for a worker in -async mode.", value: queueLength}
+	queueRejected = newCounter("am_event_handler_queue_rejected_total",
+		"Webhook requests refused because the queue was too deep.")
+	duplicateDeliveries = newCounter("am_event_handler_duplicate_notifications_total",
+		"Notifications skipped as duplicate deliveries.")
+
+	// registry holds every metric in the order they are exposed
+	registry = []metric{httpRequests, alertsReceived, handlerExecutions,
+		handlerSkips, handlerDuration, queueDepth, queueRejected, duplicateDeliveries}
+)
+
+// metric is a family of time series exposed in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// labelString formats names and values as a Prometheus label set including
+// the deployment label.  extra is appended as is.
+func labelString(names, values []string, extra string) string {
+	var pairs []string
+	if instanceLabel != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", deploymentLabel, strconv.Quote(instanceLabel)))
+	}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counter is a monotonically increasing value per set of label values.
+type counter struct {
+	name, help string
+	labels     []string
+
+	lock   sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		series: make(map[string][]string),
+	}
+}
+
+// inc adds one to the series with the given label values.
+func (c *counter) inc(values ...string) {
+	key := strings.Join(values, "\xff")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key]++
+	c.series[key] = values
+}
+
+func (c *counter) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelString(c.labels, c.series[k], ""),
+			formatFloat(c.values[k]))
+	}
+}
+
+// histogram counts observations in buckets per set of label values.
+type histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	lock   sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+// observe records v in the series with the given label values.
+func (h *histogram) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				labelString(h.labels, s.values, fmt.Sprintf("le=\"%s\"", formatFloat(b))),
+				s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			labelString(h.labels, s.values, "le=\"+Inf\""), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, s.values, ""),
+			formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, s.values, ""),
+			s.count)
+	}
+}
+
+// gauge is a single value read when metrics are scraped.
+type gauge struct {
+	name, help string
+	value      func() float64
+}
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	fmt.Fprintf(w, "%s%s %s\n", g.name, labelString(nil, nil, ""), formatFloat(g.value()))
+}
+
+// observeExecution records the result and duration of running handler.
+func observeExecution(handler string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	handlerExecutions.inc(handler, result)
+	handlerDuration.observe(time.Since(start).Seconds(), handler)
+}
+
+// metricsHandler exposes all metrics in the Prometheus text format.  Like
+// the health checks it is not authenticated or logged.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	buf := new(bytes.Buffer)
+	for _, m := range registry {
+		m.write(buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the text exposed by /metrics.
+func scrape(t *testing.T) string {
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", bind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	// The alert has no alertname label so it is named by its fingerprint
+	resp, err := postHelper("testdata/test10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["metrics"] = Handler{Command: "/bin/true"}
+	config.Handlers["metricsWindow"] = Handler{
+		Command: "/bin/true",
+		Windows: []Window{{Days: []string{"tue"}, Start: "00:00", End: "00:00"}},
+	}
+	defer delete(config.Handlers, "metrics")
+	defer delete(config.Handlers, "metricsWindow")
+	clock = func() time.Time { return time.Date(2024, 3, 4, 12, 0, 0, 0, time.Local) } // Monday
+	defer func() { clock = time.Now }()
+
+	alert := Alert{Status: "firing"}
+	if _, err := parseHandler(context.Background(), []string{"metrics"}, alert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseHandler(context.Background(), []string{"metricsWindow"}, alert); err != nil {
+		t.Fatal(err)
+	}
+
+	instanceLabel = "us-east-1"
+	defer func() { instanceLabel = "" }()
+
+	metrics := scrape(t)
+	for _, series := range []string{
+		`am_event_handler_http_requests_total{deployment="us-east-1",code="200"}`,
+		`am_event_handler_alerts_received_total{deployment="us-east-1",alert="5e0cb3c1e3ef4bd0",status="firing"}`,
+		`am_event_handler_handler_executions_total{deployment="us-east-1",handler="metrics",result="success"} 1`,
+		`am_event_handler_handler_duration_seconds_bucket{deployment="us-east-1",handler="metrics",le="+Inf"} 1`,
+		`am_event_handler_handler_duration_seconds_count{deployment="us-east-1",handler="metrics"} 1`,
+		`am_event_handler_handler_skipped_total{deployment="us-east-1",handler="metricsWindow",reason="window"} 1`,
+	} {
+		if !strings.Contains(metrics, series) {
+			t.Errorf("Series missing from /metrics: %s", series)
+		}
+	}
+	if t.Failed() {
+		t.Log(metrics)
+	}
+}
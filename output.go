@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// cappedWriter writes to a bytes.Buffer until the buffer holds max bytes
+// and then silently discards further output so the command is not blocked
+// or failed.  A max of zero or less means unlimited.  It is safe to use
+// for both standard output and error of a command.
+type cappedWriter struct {
+	lock      sync.Mutex
+	buf       *bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.max <= 0 {
+		return w.buf.Write(p)
+	}
+
+	remaining := w.max - w.buf.Len()
+	if len(p) > remaining {
+		w.truncated = true
+		if remaining > 0 {
+			w.buf.Write(p[:remaining])
+		}
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
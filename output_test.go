@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCappedWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := &cappedWriter{buf: buf, max: 10}
+	for _, s := range []string{"1234", "5678", "9012", "3456"} {
+		n, err := w.Write([]byte(s))
+		if n != len(s) || err != nil {
+			t.Errorf("Write should always succeed: %d, %v", n, err)
+		}
+	}
+	if buf.String() != "1234567890" || !w.truncated {
+		t.Errorf("Output not capped at 10 bytes: %q", buf.String())
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	handler := Handler{MaxOutputBytes: 1024}
+	out, err := executeHandler(context.Background(), handler, "/bin/bash", []string{"-c", "yes | head -c 1000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), strings.Repeat("y\n", 512)) {
+		t.Errorf("Output should begin with the first 1024 bytes")
+	}
+	if out.Len() > 1024+64 || !strings.Contains(out.String(), "truncated") {
+		t.Errorf("Output not truncated, %d bytes", out.Len())
+	}
+}
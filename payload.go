@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// payloadEnv is the environment variable holding the path of the payload
+// file of handlers with payload: tempfile.
+const payloadEnv = "AM_PAYLOAD_FILE"
+
+// encodePayload returns the JSON document kind, "alert_json" or
+// "event_json", of alert.  Other kinds are empty.
+func encodePayload(kind string, alert Alert) ([]byte, error) {
+	switch kind {
+	case "alert_json":
+		return []byte(alert.Json), nil
+	case "event_json":
+		if alert.event == nil {
+			return []byte("{}"), nil
+		}
+		return json.Marshal(alert.event)
+	}
+	return nil, nil
+}
+
+// payloadFile writes the payload of the handler, the whole notification
+// for handlers with the event scope and alert otherwise, to a new file
+// only readable by its owner and returns its path.  The caller removes
+// the file.
+func (h Handler) payloadFile(alert Alert) (string, error) {
+	kind := "alert_json"
+	if h.Scope == "event" {
+		kind = "event_json"
+	}
+	blob, err := encodePayload(kind, alert)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "am-event-handler-payload-")
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Write(blob); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
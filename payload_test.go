@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPayloadFile(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	shell := true
+	config.Handlers["payload"] = Handler{
+		Command: `cat "$AM_PAYLOAD_FILE"; echo; echo "$AM_PAYLOAD_FILE"`,
+		Shell:   &shell,
+		Payload: "tempfile",
+	}
+	defer delete(config.Handlers, "payload")
+
+	e := &AlertManagerEvent{}
+	alert, err := e.prepareAlert(Alert{
+		Status: "firing",
+		Labels: map[string]string{"alertname": "Payload", "quote": `it's "quoted"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := parseHandler(context.Background(), []string{"payload"}, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected output: %s", output)
+	}
+	var payload Alert
+	if err := json.Unmarshal([]byte(lines[0]), &payload); err != nil {
+		t.Fatalf("Payload file is not JSON: %s", err)
+	}
+	if payload.Labels["quote"] != `it's "quoted"` {
+		t.Errorf("Payload file has the wrong alert: %s", lines[0])
+	}
+	if _, err := os.Stat(lines[1]); !os.IsNotExist(err) {
+		t.Errorf("Payload file %s was not removed", lines[1])
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+)
+
+// pipe connects a step of a pipeline to the next.
+type pipe struct {
+	// pipeline is the name of the pipeline handler
+	pipeline string
+
+	// input is written to the standard input of the step.  When nil the
+	// step's own stdin setting applies.
+	input []byte
+
+	// stdout captures the standard output of the step, if not nil
+	stdout *bytes.Buffer
+
+	// ran is set when the step's command ran successfully
+	ran bool
+
+	// ignored is set when the step's command exited with an ignored code
+	ignored bool
+}
+
+// runPipeline runs each handler in steps in order with the arguments given
+// to the pipeline handler.  Each step receives the standard output of the
+// previous step on its standard input and, if that is JSON, as .Result in
+// its templates.  The pipeline stops at the first step that fails, is
+// skipped, or exits with one of its ignored exit codes.
+func runPipeline(ctx context.Context, handler, steps []string, alert Alert) (*bytes.Buffer, error) {
+	out := new(bytes.Buffer)
+	var input []byte
+	for i, step := range steps {
+		p := &pipe{pipeline: handler[0], input: input, stdout: new(bytes.Buffer)}
+		output, err := runStep(ctx, append([]string{step}, handler[1:]...), alert, p)
+		result := parseResult(p.stdout.Bytes())
+		resultCaptureOf(ctx).set(result)
+		if output != nil {
+			out.Write(output.Bytes())
+		}
+		if err != nil {
+			return out, fmt.Errorf("Handler pipeline %s failed at step %s: %s",
+				handler[0], step, err)
+		}
+		if i < len(steps)-1 && (!p.ran || p.ignored) {
+			log.Printf("Handler pipeline %s stopped at step %s", handler[0], step)
+			return out, nil
+		}
+		// Copy so that an empty output is still written to the next step
+		input = append([]byte{}, p.stdout.Bytes()...)
+		alert.Result = templateResult(result)
+	}
+	return out, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["enrich"] = Handler{Command: "/bin/echo {{ index .Argv 0 }}"}
+	config.Handlers["decide"] = Handler{
+		Command: "/bin/bash -c \"read host; test $host = skip && exit 3; echo $host-decided; echo noise >&2\"",
+		Ignore:  []int{3},
+	}
+	config.Handlers["act"] = Handler{Command: "/bin/sed s/^/acted-/"}
+	config.Handlers["remediate"] = Handler{Pipeline: []string{"enrich", "decide", "act"}}
+	defer func() {
+		for _, h := range []string{"enrich", "decide", "act", "remediate"} {
+			delete(config.Handlers, h)
+		}
+	}()
+
+	alert := Alert{Status: "firing"}
+	out, err := parseHandler(context.Background(), []string{"remediate", "db1"}, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "acted-db1-decided\n") || strings.Contains(out.String(), "acted-noise") {
+		t.Errorf("Unexpected pipeline output: %q", out.String())
+	}
+
+	out, err = parseHandler(context.Background(), []string{"remediate", "skip"}, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "acted-") {
+		t.Errorf("Pipeline should stop at an ignored exit code: %q", out.String())
+	}
+
+	config.Handlers["decide"] = Handler{Command: "/bin/false"}
+	_, err = parseHandler(context.Background(), []string{"remediate", "db1"}, alert)
+	if err == nil || !strings.Contains(err.Error(), "failed at step decide") {
+		t.Errorf("Pipeline should fail at the failing step: %v", err)
+	}
+
+	cfg := &Configuration{Handlers: map[string]Handler{
+		"enrich":    {Command: "/bin/true"},
+		"group":     {Group: []string{"enrich"}},
+		"remediate": {Pipeline: []string{"enrich", "group"}},
+	}}
+	if err := validateConfiguration(cfg); err == nil {
+		t.Errorf("Pipeline with a group step should be rejected")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing as process groups are not supported.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcessGroup kills the started command cmd as Windows has no
+// SIGTERM.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// killProcessGroup kills only the started command cmd.  Processes it
+// started keep running.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd the leader of a new process group so that it
+// can be killed along with every process it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateProcessGroup asks the started command cmd and every process in
+// its process group to exit with SIGTERM.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// killProcessGroup kills the started command cmd and every process in its
+// process group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
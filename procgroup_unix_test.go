@@ -0,0 +1,85 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// running returns true if the process pid exists and is not a zombie.
+func running(pid string) bool {
+	stat, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+	if err != nil {
+		return false
+	}
+	// The state follows the command name in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestTimeoutKillsProcessGroup(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("No /proc filesystem")
+	}
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+	defer os.Remove("testdata/grandchild")
+
+	handler := Handler{Timeout: 200 * time.Millisecond}
+	_, err := executeHandler(context.Background(), handler, "/bin/bash",
+		[]string{"-c", "sleep 30 & echo $! > testdata/grandchild; wait"})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Handler should have timed out: %v", err)
+	}
+
+	buf, err := ioutil.ReadFile("testdata/grandchild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := strings.TrimSpace(string(buf))
+	deadline := time.Now().Add(2 * time.Second)
+	for running(pid) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if running(pid) {
+		t.Errorf("Process %s started by the timed out command is still running", pid)
+	}
+}
+
+func TestKillGrace(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+	defer os.Remove("testdata/cleaned")
+
+	// The script's trap cleans up when it is terminated
+	handler := Handler{Timeout: 200 * time.Millisecond, KillGrace: 5 * time.Second}
+	_, err := executeHandler(context.Background(), handler, "/bin/bash",
+		[]string{"-c", "trap 'echo done > testdata/cleaned; exit 1' TERM; sleep 30 & wait"})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Handler should have timed out: %v", err)
+	}
+	if _, err := os.Stat("testdata/cleaned"); err != nil {
+		t.Errorf("Terminated command did not run its cleanup trap: %s", err)
+	}
+
+	// A command ignoring SIGTERM is killed after the grace period
+	handler.KillGrace = 300 * time.Millisecond
+	start := time.Now()
+	_, err = executeHandler(context.Background(), handler, "/bin/bash",
+		[]string{"-c", "trap '' TERM; while :; do sleep 0.05; done"})
+	if err == nil {
+		t.Fatalf("Handler ignoring SIGTERM should have been killed")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Handler ignoring SIGTERM was killed after %s", elapsed)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// trustedProxies are the networks of proxies whose X-Forwarded-For and
+	// Forwarded headers and PROXY protocol headers are believed
+	trustedProxies []*net.IPNet
+
+	// proxyProtocol expects connections to begin with a PROXY protocol
+	// header
+	proxyProtocol bool
+)
+
+// proxySignature starts a PROXY protocol version 2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseTrustedProxies parses a comma separated list of IP addresses and
+// CIDR networks.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy address: %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy network: %s", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trusted returns true if the address, with or without a port, belongs to
+// a trusted proxy.
+func trusted(address string) bool {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the addresses a request passed through according to
+// its Forwarded header, or its X-Forwarded-For header when there is none,
+// starting with the original client.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, stripPort(strings.Trim(kv[1], "\"")))
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, stripPort(strings.TrimSpace(hop)))
+		}
+	}
+	return hops
+}
+
+// stripPort removes the port and IPv6 brackets from a forwarded address.
+func stripPort(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+}
+
+// remoteAddr returns the address of the client that made r.  Forwarding
+// headers are only honored when the request came from a trusted proxy and
+// are followed back through every trusted proxy.
+func remoteAddr(r *http.Request) string {
+	if !trusted(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+	hops := forwardedFor(r)
+	client := r.RemoteAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// Obfuscated or unknown, the last proxy is all we know
+			break
+		}
+		client = hops[i]
+		if !trusted(client) {
+			break
+		}
+	}
+	return client
+}
+
+// proxyListener reads the PROXY protocol header of accepted connections.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn is a connection that begins with a PROXY protocol header.  The
+// header is read on first use so a slow client does not block Accept.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		if len(trustedProxies) > 0 && !trusted(c.Conn.RemoteAddr().String()) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header and returns
+// the source address it carries.  It returns nil for connections the proxy
+// made itself, such as health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxySignature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxySignature) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(start, []byte("PROXY ")) {
+		return nil, fmt.Errorf("missing header")
+	}
+
+	// The longest version 1 header is 107 bytes
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 {
+		return nil, fmt.Errorf("malformed header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the binary version 2 PROXY protocol header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if header[12]&0xf == 0 {
+		// LOCAL
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
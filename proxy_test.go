@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = nil }()
+
+	tests := []struct {
+		remote  string
+		headers map[string]string
+		expect  string
+	}{
+		{"203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.5:1234"},
+		{"10.1.1.1:1234", nil, "10.1.1.1:1234"},
+		{"10.1.1.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"10.1.1.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"10.1.1.1:1234", map[string]string{"X-Forwarded-For": "10.2.2.2"}, "10.2.2.2"},
+		{"10.1.1.1:1234", map[string]string{"X-Forwarded-For": "garbage"}, "10.1.1.1:1234"},
+		{"192.168.1.1:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=https, for=10.3.3.3`}, "2001:db8::1"},
+		{"192.168.1.1:1234", map[string]string{"Forwarded": "for=unknown"}, "192.168.1.1:1234"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = test.remote
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if got := remoteAddr(r); got != test.expect {
+			t.Errorf("Remote %s with %v: expected %s, got %s", test.remote, test.headers, test.expect, got)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Errorf("Invalid network accepted")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})}
+	go server.Serve(&proxyListener{ln})
+	defer server.Close()
+
+	v2 := append([]byte(nil), proxySignature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12)
+	v2 = append(v2, 198, 51, 100, 7, 127, 0, 0, 1)
+	v2 = binary.BigEndian.AppendUint16(v2, 5555)
+	v2 = binary.BigEndian.AppendUint16(v2, 4242)
+
+	tests := map[string]string{
+		"PROXY TCP4 198.51.100.7 127.0.0.1 5555 4242\r\n": "198.51.100.7:5555",
+		"PROXY TCP6 2001:db8::7 ::1 5555 4242\r\n":        "[2001:db8::7]:5555",
+		string(v2): "198.51.100.7:5555",
+	}
+	for header, expect := range tests {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(header + "GET / HTTP/1.0\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Request with PROXY header %q failed: %s", header, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		conn.Close()
+		if string(body) != expect {
+			t.Errorf("PROXY header %q: expected %s, got %s", header, expect, body)
+		}
+	}
+
+	// A connection without the header is refused
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if buf, _ := ioutil.ReadAll(conn); strings.Contains(string(buf), "200 OK") {
+		t.Errorf("Request without a PROXY header was served")
+	}
+}
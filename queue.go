@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// async makes the webhook respond 202 Accepted as soon as an event is
+	// parsed and queue its alerts for the workers
+	async bool
+
+	// queue holds alerts waiting for a worker.  It is nil until
+	// startWorkers is called.
+	queue chan job
+
+	// pending tracks queued alerts until their handlers have run
+	pending sync.WaitGroup
+
+	// queueMaxDepth is the number of waiting alerts above which requests
+	// are refused rather than queued.  Zero never refuses requests.
+	queueMaxDepth int
+
+	// queueRetryAfter is the Retry-After sent with refused requests
+	queueRetryAfter time.Duration
+
+	// errQueueFull is returned by enqueue when the queue is too deep
+	errQueueFull = errors.New("Queue is full, try again later.")
+)
+
+// job is an alert queued for its handlers to be run by a worker.
+type job struct {
+	event *AlertManagerEvent
+	alert Alert
+
+	// file holds the alert in the queue directory, if any
+	file string
+}
+
+// startWorkers creates a queue holding size alerts and starts n workers
+// running their handlers.
+func startWorkers(n, size int) {
+	queue = make(chan job, size)
+	for i := 0; i < n; i++ {
+		go worker(queue)
+	}
+}
+
+// worker runs the handlers of queued alerts one at a time.  Once shutdown
+// has killed the running handlers alerts are no longer run, and those it
+// interrupted stay in the queue directory to be recovered by the next
+// start.
+func worker(jobs <-chan job) {
+	for j := range jobs {
+		if runContext.Err() != nil {
+			pending.Done()
+			continue
+		}
+		runJob(j)
+		if j.file != "" && runContext.Err() == nil {
+			if err := os.Remove(j.file); err != nil {
+				log.Printf("Error: Could not remove queued alert %s: %s", j.file, err)
+			}
+		}
+		pending.Done()
+	}
+}
+
+// runJob runs the handlers of a queued alert.
+func runJob(j job) {
+	ctx := runContext
+	if j.file != "" {
+		ctx = withQueuedFile(ctx, j.file)
+	}
+	record := newAuditRecord(j.event)
+	result := j.event.handleAlert(ctx, getConfig(), j.alert, record)
+	if audit != nil {
+		audit.Send(record)
+	}
+
+	output := (&eventResult{Alerts: []alertResult{result}}).output()
+	if verboseLogging() && output != "" {
+		log.Printf("Handler output: %s", output)
+	}
+	if n := result.failures(); n > 0 {
+		log.Printf("Error: %d handler(s) failed for alert %s from receiver %s",
+			n, result.Alertname, j.event.Receiver)
+	}
+}
+
+// enqueue queues each alert of e for the workers.  With -queue-dir the
+// alerts are written to disk first.  It blocks while the queue is full.
+// If queuing e would make the queue deeper than queueMaxDepth none of its
+// alerts are queued and errQueueFull is returned.  Concurrent requests may
+// exceed the depth by the size of one request.
+func enqueue(e *AlertManagerEvent) error {
+	if queueMaxDepth > 0 && len(queue)+len(e.Alerts) > queueMaxDepth {
+		queueRejected.inc()
+		return errQueueFull
+	}
+	for _, alert := range e.Alerts {
+		j := job{event: e, alert: alert}
+		if queueDir != "" {
+			var err error
+			if j.file, err = persistJob(j); err != nil {
+				return fmt.Errorf("Could not write queued alert: %s", err)
+			}
+		}
+		pending.Add(1)
+		queue <- j
+	}
+	return nil
+}
+
+// queueLength returns the number of alerts waiting for a worker.
+func queueLength() float64 {
+	return float64(len(queue))
+}
+
+// waitPending waits up to timeout for queued alerts to be handled.  It
+// returns false if some are still waiting or running.
+func waitPending(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
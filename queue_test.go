@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAsync(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	// A single worker runs the alerts one after the other
+	async = true
+	startWorkers(1, 10)
+	defer func() {
+		async = false
+		close(queue)
+		queue = nil
+	}()
+
+	config.Handlers["slow"] = Handler{Command: "/bin/bash -c \"sleep 0.3; touch testdata/async-{{ index .Argv 0 }}\""}
+	defer delete(config.Handlers, "slow")
+	defer os.Remove("testdata/async-1")
+	defer os.Remove("testdata/async-2")
+
+	body := `{"receiver": "test", "status": "firing", "alerts": [
+		{"status": "firing", "labels": {"alertname": "Slow"}, "annotations": {"handler": "slow 1"}},
+		{"status": "firing", "labels": {"alertname": "Slow"}, "annotations": {"handler": "slow 2"}}
+	]}`
+	start := time.Now()
+	resp, err := http.Post("http://"+bind+"/", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected 202 Accepted, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("Response waited for the handler, took %s", elapsed)
+	}
+
+	if !waitPending(5 * time.Second) {
+		t.Fatalf("Queued alerts were not handled")
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Errorf("Alerts ran concurrently with a single worker, took %s", elapsed)
+	}
+	for _, f := range []string{"testdata/async-1", "testdata/async-2"} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("Queued handler did not run: %s", err)
+		}
+	}
+}
+
+func TestQueueBackpressure(t *testing.T) {
+	// No workers are started so queued alerts stay in the queue
+	async = true
+	queue = make(chan job, 10)
+	queueMaxDepth = 2
+	queueRetryAfter = 30 * time.Second
+	defer func() {
+		async = false
+		queue = nil
+		queueMaxDepth = 0
+	}()
+
+	body := `{"receiver": "test", "status": "firing", "alerts": [
+		{"status": "firing", "labels": {"alertname": "Deep"}, "annotations": {"handler": "slow 1"}},
+		{"status": "firing", "labels": {"alertname": "Deep"}, "annotations": {"handler": "slow 2"}}
+	]}`
+	post := func() *http.Response {
+		resp, err := http.Post("http://"+bind+"/", "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := post(); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected 202 Accepted, got %d", resp.StatusCode)
+	}
+	resp := post()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from a full queue, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "30" {
+		t.Errorf("Unexpected Retry-After: %q", resp.Header.Get("Retry-After"))
+	}
+	if len(queue) != 2 {
+		t.Errorf("Refused request queued alerts, queue holds %d", len(queue))
+	}
+
+	// Drain the queue as a worker would
+	for len(queue) > 0 {
+		<-queue
+		pending.Done()
+	}
+}
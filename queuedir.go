@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// queueDir is the directory queued alerts are written to so they
+	// survive a restart.  Empty disables persistence.
+	queueDir string
+
+	// queueSeq makes the names of queued alert files unique
+	queueSeq uint64
+)
+
+// jobRecord is the JSON representation of a queued alert on disk.
+type jobRecord struct {
+	Version     string   `json:"version"`
+	Status      string   `json:"status"`
+	Receiver    string   `json:"receiver"`
+	ExternalURL string   `json:"externalURL"`
+	GroupKey    GroupKey `json:"groupKey,omitempty"`
+	Handler     []string `json:"handler,omitempty"`
+	RequestID   string   `json:"request_id"`
+	Traceparent string   `json:"traceparent,omitempty"`
+	Tracestate  string   `json:"tracestate,omitempty"`
+	Alert       Alert    `json:"alert"`
+
+	GroupLabels       map[string]string `json:"groupLabels,omitempty"`
+	CommonLabels      map[string]string `json:"commonLabels,omitempty"`
+	CommonAnnotations map[string]string `json:"commonAnnotations,omitempty"`
+}
+
+// newJobRecord builds the on disk representation of j.
+func newJobRecord(j job) jobRecord {
+	r := jobRecord{
+		Version:     j.event.Version,
+		Status:      j.event.Status,
+		Receiver:    j.event.Receiver,
+		ExternalURL: j.event.ExternalURL,
+		GroupKey:    j.event.GroupKey,
+		Handler:     j.event.handler,
+		RequestID:   j.event.requestID,
+		Alert:       j.alert,
+
+		GroupLabels:       j.event.GroupLabels,
+		CommonLabels:      j.event.CommonLabels,
+		CommonAnnotations: j.event.CommonAnnotations,
+	}
+	if j.event.trace != nil {
+		r.Traceparent = j.event.trace.traceparent()
+		r.Tracestate = j.event.trace.state
+	}
+	return r
+}
+
+// job rebuilds the queued alert.
+func (r jobRecord) job(file string) job {
+	return job{
+		event: &AlertManagerEvent{
+			Version:     r.Version,
+			Status:      r.Status,
+			Receiver:    r.Receiver,
+			ExternalURL: r.ExternalURL,
+			GroupKey:    r.GroupKey,
+			Alerts:      []Alert{r.Alert},
+			handler:     r.Handler,
+			requestID:   r.RequestID,
+			trace:       newTraceContext(r.Traceparent, r.Tracestate),
+
+			GroupLabels:       r.GroupLabels,
+			CommonLabels:      r.CommonLabels,
+			CommonAnnotations: r.CommonAnnotations,
+		},
+		alert: r.Alert,
+		file:  file,
+	}
+}
+
+// persistJob writes j to the queue directory and returns the file name.
+func persistJob(j job) (string, error) {
+	blob, err := json.Marshal(newJobRecord(j))
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(queueDir, fmt.Sprintf("%020d-%06d.json",
+		time.Now().UnixNano(), atomic.AddUint64(&queueSeq, 1)%1000000))
+	// Write to a temporary file and rename so recoverQueue() never sees a
+	// partially written alert.
+	if err := ioutil.WriteFile(name+".tmp", blob, 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		os.Remove(name + ".tmp")
+		return "", err
+	}
+	return name, nil
+}
+
+// recoverQueue queues the alerts left in the queue directory by a previous
+// run, in the order they were received.  Alerts that were running when the
+// process stopped are run again.
+func recoverQueue() error {
+	if err := os.MkdirAll(queueDir, 0700); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(queueDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	var jobs []job
+	for _, f := range files {
+		blob, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		r := jobRecord{}
+		if err := json.Unmarshal(blob, &r); err != nil {
+			log.Printf("Error: Removing unreadable queued alert %s: %s", f, err)
+			os.Remove(f)
+			continue
+		}
+		jobs = append(jobs, r.job(f))
+	}
+	if len(jobs) > 0 {
+		log.Printf("Recovered %d queued alert(s) from %s", len(jobs), queueDir)
+	}
+
+	// Queue recovered alerts ahead of new ones.  Those that do not fit in
+	// the queue are added as workers make room.
+	pending.Add(len(jobs))
+	for len(jobs) > 0 && len(queue) < cap(queue) {
+		queue <- jobs[0]
+		jobs = jobs[1:]
+	}
+	go func() {
+		for _, j := range jobs {
+			queue <- j
+		}
+	}()
+	return nil
+}
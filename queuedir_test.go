@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueDir(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queueDir = dir
+	defer func() { queueDir = "" }()
+
+	config.Handlers["recovered"] = Handler{
+		Command: "/bin/bash -c \"echo {{ index .Argv 0 }} $TRACEPARENT >> testdata/testRecovered\"",
+	}
+	defer delete(config.Handlers, "recovered")
+	defer os.Remove("testdata/testRecovered")
+
+	// An alert left behind by a crash
+	event := &AlertManagerEvent{
+		Receiver: "test",
+		handler:  []string{"recovered", "crashed"},
+		trace:    newTraceContext("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""),
+	}
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Recovered"}}
+	if _, err := persistJob(job{event: event, alert: alert}); err != nil {
+		t.Fatal(err)
+	}
+
+	startWorkers(1, 10)
+	defer func() {
+		close(queue)
+		queue = nil
+	}()
+	if err := recoverQueue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A newly received alert
+	event = &AlertManagerEvent{
+		Receiver: "test",
+		Alerts:   []Alert{alert},
+		handler:  []string{"recovered", "received"},
+	}
+	if err := enqueue(event); err != nil {
+		t.Fatal(err)
+	}
+	if !waitPending(5 * time.Second) {
+		t.Fatalf("Queued alerts were not handled")
+	}
+
+	buf, err := ioutil.ReadFile("testdata/testRecovered")
+	if err != nil {
+		t.Fatalf("Recovered alert did not run: %s", err)
+	}
+	expect := "crashed 00-4bf92f3577b34da6a3ce929d0e0e4736-"
+	if len(buf) < len(expect) || string(buf[:len(expect)]) != expect {
+		t.Errorf("Recovered alert did not run first with its trace context: %q", buf)
+	}
+	if string(buf[len(buf)-len("received\n"):]) != "received\n" {
+		t.Errorf("Received alert did not run: %q", buf)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 0 {
+		t.Errorf("Handled alerts were not removed from the queue directory: %v", files)
+	}
+}
+
+func TestQueueDirShutdown(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queueDir = dir
+	defer func() { queueDir = "" }()
+
+	// Servers of other tests keep the original context
+	saved := runContext
+	var cancel context.CancelFunc
+	runContext, cancel = context.WithCancel(context.Background())
+	defer func() { runContext = saved }()
+
+	config.Handlers["slow"] = Handler{Command: "/bin/sleep 5"}
+	defer delete(config.Handlers, "slow")
+
+	startWorkers(1, 10)
+	defer func() {
+		close(queue)
+		queue = nil
+	}()
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Slow"}}
+	event := &AlertManagerEvent{
+		Receiver: "test",
+		Alerts:   []Alert{alert, alert, alert},
+		handler:  []string{"slow"},
+	}
+	if err := enqueue(event); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutdown gives up on the running alert with two still queued
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	if !waitPending(5 * time.Second) {
+		t.Fatalf("Workers did not stop after the handlers were killed")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 3 {
+		t.Errorf("Interrupted and pending alerts were removed from the queue directory: %v", files)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limiter rate limits webhook requests per client.  It is nil when rate
+// limiting is disabled.
+var limiter *rateLimiter
+
+// bucket is the token bucket of a single client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets indexed by client.  Each bucket
+// holds up to burst tokens and refills at rate tokens per second.
+type rateLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket for key.  If the bucket is empty it
+// returns false and how long until a token is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, l.wait(b)
+}
+
+// check returns whether the bucket for key holds a token, and if not how
+// long until it does, without taking it.
+func (l *rateLimiter) check(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	return false, l.wait(b)
+}
+
+// refill returns the bucket for key with the tokens added since it was
+// last used.  The caller must hold the lock.
+func (l *rateLimiter) refill(key string, now time.Time) *bucket {
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// wait returns how long until b holds a token.
+func (l *rateLimiter) wait(b *bucket) time.Duration {
+	wait := (1 - b.tokens) / l.rate
+	return time.Duration(wait * float64(time.Second))
+}
+
+// sweep forgets buckets that have refilled completely so idle clients do
+// not use memory.  It runs at most once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientKey identifies the client of r for rate limiting: the Basic
+// authentication user or client certificate name when the request is
+// authenticated, otherwise the remote IP address.
+func clientKey(r *http.Request) string {
+	if auth != nil {
+		if user, _, ok := r.BasicAuth(); ok {
+			return "user:" + user
+		}
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return "ip:" + stripPort(remoteAddr(r))
+}
+
+// authFailureKey identifies the client of r for rate limiting failed
+// authentication attempts, which can only be told apart by IP address.
+func authFailureKey(r *http.Request) string {
+	return "auth:" + stripPort(remoteAddr(r))
+}
+
+// tooManyRequests responds with 429 Too Many Requests asking the client to
+// retry after wait.
+func tooManyRequests(writer http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w := NewStatusResponseWriter(writer)
+	defer logRequest(w, r)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+}
+
+// rateLimit wraps handler so that clients exceeding the rate limit receive
+// 429 Too Many Requests.  Wrap it with requireAuth so only verified users
+// are used as keys.
+func rateLimit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		l := limiter
+		if l == nil {
+			handler(writer, r)
+			return
+		}
+
+		key := clientKey(r)
+		if ok, wait := l.allow(key, time.Now()); !ok {
+			tooManyRequests(writer, r, wait)
+			return
+		}
+		handler(writer, r)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("Request %d within the burst was limited", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatalf("Request beyond the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms for a token, got %s", wait)
+	}
+
+	// Other clients have their own bucket
+	if ok, _ := l.allow("b", now); !ok {
+		t.Errorf("Different client was limited")
+	}
+
+	// Tokens refill at the rate
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("Request was limited after the bucket refilled")
+	}
+
+	// Idle buckets are forgotten
+	l.allow("c", now.Add(time.Hour))
+	if len(l.buckets) != 1 {
+		t.Errorf("Idle buckets were not swept: %d remain", len(l.buckets))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter = newRateLimiter(0.5, 1)
+	defer func() { limiter = nil }()
+
+	handler := rateLimit(func(w http.ResponseWriter, r *http.Request) {})
+	request := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	if w := request("10.0.0.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("First request was limited: %d", w.Code)
+	}
+	w := request("10.0.0.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for a second request, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+	}
+	if w := request("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("Request from another client was limited: %d", w.Code)
+	}
+}
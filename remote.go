@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isURL reports whether path refers to a configuration served over HTTP(S)
+// rather than a local file.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// remoteConfig fetches the configuration from a URL.  It remembers the
+// ETag and Last-Modified headers of the last response so unchanged
+// configurations are not transferred again.
+type remoteConfig struct {
+	URL string
+
+	client       *http.Client
+	etag         string
+	lastModified string
+}
+
+func newRemoteConfig(url string) *remoteConfig {
+	return &remoteConfig{
+		URL:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// fetch retrieves and decodes the configuration.  It returns a nil
+// Configuration and no error when the configuration has not changed since
+// the last fetch.
+func (r *remoteConfig) fetch() (*Configuration, error) {
+	req, err := http.NewRequest("GET", r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	if r.lastModified != "" {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Fetching %s returned status %d", r.URL, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the Content-Type when the URL has no recognizable extension
+	format := formatOf(r.URL)
+	if configFormat == "" && format == "yaml" {
+		contentType := resp.Header.Get("Content-Type")
+		if strings.Contains(contentType, "json") {
+			format = "json"
+		} else if strings.Contains(contentType, "toml") {
+			format = "toml"
+		}
+	}
+	cfg, err := decodeConfiguration(body, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", r.URL, err)
+	}
+
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+	return cfg, nil
+}
+
+// pollConfiguration fetches the configuration from url every interval and
+// activates it when it changes.  It returns when stop is closed.
+func pollConfiguration(url string, interval time.Duration, stop <-chan struct{}) {
+	remote := newRemoteConfig(url)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cfg, err := remote.fetch()
+		if err == nil && cfg != nil {
+			err = finishRemoteConfiguration(url, cfg)
+		}
+		if err != nil {
+			log.Printf("Error: Configuration reload failed, keeping current configuration: %s", err)
+		} else if cfg != nil {
+			log.Printf("Configuration at %s changed, reloading", url)
+			activateConfiguration(cfg)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
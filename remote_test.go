@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemoteConfiguration(t *testing.T) {
+	var lock sync.Mutex
+	version := 1
+	notModified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		etag := "\"v" + string(rune('0'+version)) + "\""
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		if version == 1 {
+			w.Write([]byte(`{"handlers": {"first": {"command": "/bin/true"}}}`))
+		} else {
+			w.Write([]byte(`{"defaults": {"status": "resolved"}, "handlers": {"second": {"command": "/bin/true"}}}`))
+		}
+	}))
+	defer server.Close()
+
+	orig := getConfig()
+	defer setConfig(orig)
+
+	cfg, err := loadConfiguration(server.URL + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Handlers["first"]; !ok {
+		t.Fatalf("Remote configuration not loaded: %v", cfg.Handlers)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfiguration(server.URL+"/config", 10*time.Millisecond, stop)
+
+	// Wait for a conditional request to be answered with 304
+	n := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for n == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		n = notModified
+		lock.Unlock()
+	}
+	if _, ok := getConfig().Handlers["first"]; !ok || n == 0 {
+		t.Fatalf("Remote configuration not polled with conditional requests")
+	}
+
+	lock.Lock()
+	version = 2
+	lock.Unlock()
+	for time.Now().Before(deadline) {
+		if h, ok := getConfig().Handlers["second"]; ok {
+			if h.Status != "resolved" {
+				t.Errorf("Defaults not applied to the reloaded configuration: %#v", h)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Changed remote configuration was not reloaded")
+}
+
+func TestRemoteReloadValidated(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		if requests == 1 {
+			w.Write([]byte(`{"handlers": {"first": {"command": "/bin/true"}}}`))
+		} else {
+			w.Write([]byte(`{"receivers": {"team": "missing"}, "handlers": {"broken": {"command": "/bin/true"}}}`))
+		}
+	}))
+	defer server.Close()
+
+	orig := getConfig()
+	defer setConfig(orig)
+	cfg, err := loadConfiguration(server.URL + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+
+	stop := make(chan struct{})
+	go watchConfiguration(server.URL+"/config", 10*time.Millisecond, stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for n := 0; n < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		n = requests
+		lock.Unlock()
+	}
+	close(stop)
+
+	if _, ok := getConfig().Handlers["first"]; !ok {
+		t.Errorf("Invalid remote configuration was activated: %v", getConfig().Handlers)
+	}
+}
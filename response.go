@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"time"
+)
+
+// maxResponseOutput is the most output in bytes of each handler included
+// in a webhook response.
+const maxResponseOutput = 4096
+
+// handlerResult describes a single handler run for an alert.
+type handlerResult struct {
+	Handler   string          `json:"handler"`
+	Args      []string        `json:"args,omitempty"`
+	ExitCode  int             `json:"exit_code"`
+	Duration  float64         `json:"duration"`
+	Output    string          `json:"output,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+}
+
+// alertResult lists the handlers run for an alert.
+type alertResult struct {
+	Alertname string          `json:"alertname"`
+	Status    string          `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	Handlers  []handlerResult `json:"handlers"`
+}
+
+// eventResult is the JSON document returned by the webhook.
+type eventResult struct {
+	RequestID string        `json:"request_id,omitempty"`
+	DryRun    bool          `json:"dry_run,omitempty"`
+	Duplicate bool          `json:"duplicate,omitempty"`
+	Errors    int           `json:"errors"`
+	Alerts    []alertResult `json:"alerts"`
+}
+
+// newHandlerResult builds the result of running handler, which started at
+// start, from its output and error.
+func newHandlerResult(handler []string, start time.Time, output *bytes.Buffer, err error) handlerResult {
+	r := handlerResult{
+		ExitCode: exitCode(err),
+		Duration: time.Since(start).Seconds(),
+	}
+	if len(handler) > 0 {
+		r.Handler, r.Args = handler[0], handler[1:]
+	}
+	if output != nil {
+		blob := output.Bytes()
+		if len(blob) > maxResponseOutput {
+			blob = blob[:maxResponseOutput]
+			r.Truncated = true
+		}
+		r.Output = string(blob)
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// exitCode returns the exit status of a command that returned err.  Errors
+// other than a non-zero exit, such as a timeout, are -1.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	}
+	return -1
+}
+
+// failures returns the number of errors handling the alert.
+func (a alertResult) failures() int {
+	n := 0
+	if a.Error != "" {
+		n++
+	}
+	for _, h := range a.Handlers {
+		if h.Error != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// output concatenates the output and errors of every handler.
+func (e *eventResult) output() string {
+	buf := new(bytes.Buffer)
+	for _, a := range e.Alerts {
+		if a.Error != "" {
+			buf.WriteString(a.Error + "\n")
+		}
+		for _, h := range a.Handlers {
+			if h.Error != "" {
+				buf.WriteString(h.Error + "\n")
+			}
+			buf.WriteString(h.Output)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResponseBody(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["greet"] = Handler{Command: "/bin/echo hello {{ index .Argv 0 }}"}
+	config.Handlers["fail"] = Handler{Command: "/bin/bash -c \"printf %05000d 0; exit 3\""}
+	defer delete(config.Handlers, "greet")
+	defer delete(config.Handlers, "fail")
+
+	body := `{"receiver": "test", "status": "firing", "alerts": [
+		{"status": "firing", "labels": {"alertname": "One"}, "annotations": {"handler": "greet world"}},
+		{"status": "firing", "labels": {"alertname": "Two"}, "annotations": {"handler": "fail; fail; fail"}}
+	]}`
+	req, _ := http.NewRequest("POST", "http://"+bind+"/", bytes.NewBufferString(body))
+	req.Header.Set("X-Request-Id", "response-test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a failed handler, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Unexpected Content-Type: %s", ct)
+	}
+
+	result := eventResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Response is not valid JSON: %s", err)
+	}
+	if result.RequestID != "response-test" || result.Errors != 3 || len(result.Alerts) != 2 {
+		t.Fatalf("Unexpected response: %#v", result)
+	}
+
+	one := result.Alerts[0]
+	if one.Alertname != "One" || len(one.Handlers) != 1 {
+		t.Fatalf("Unexpected result for alert One: %#v", one)
+	}
+	h := one.Handlers[0]
+	if h.Handler != "greet" || h.ExitCode != 0 || h.Output != "hello world\n" || h.Error != "" {
+		t.Errorf("Unexpected handler result: %#v", h)
+	}
+
+	two := result.Alerts[1]
+	if len(two.Handlers) != 3 {
+		t.Fatalf("Unexpected result for alert Two: %#v", two)
+	}
+	h = two.Handlers[0]
+	if h.Handler != "fail" || h.ExitCode != 3 || h.Error == "" {
+		t.Errorf("Unexpected failed handler result: %#v", h)
+	}
+	if !h.Truncated || len(h.Output) != maxResponseOutput {
+		t.Errorf("Output was not truncated: %d bytes", len(h.Output))
+	}
+	if !strings.HasPrefix(h.Output, "00") {
+		t.Errorf("Unexpected handler output: %q", h.Output)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// resultKey is the context key of the resultCapture of an execution.
+type resultKey struct{}
+
+// resultCapture holds the structured result of an execution: the standard
+// output of its command when that is valid JSON.
+type resultCapture struct {
+	lock   sync.Mutex
+	result json.RawMessage
+}
+
+// withResultCapture returns a context capturing the result of the
+// execution run with it.
+func withResultCapture(ctx context.Context) (context.Context, *resultCapture) {
+	c := &resultCapture{}
+	return context.WithValue(ctx, resultKey{}, c), c
+}
+
+// withoutResultCapture returns a context not capturing results, used for
+// the members of a group which have no single result.
+func withoutResultCapture(ctx context.Context) context.Context {
+	if resultCaptureOf(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, resultKey{}, (*resultCapture)(nil))
+}
+
+// resultCaptureOf returns the resultCapture of ctx, if any.
+func resultCaptureOf(ctx context.Context) *resultCapture {
+	c, _ := ctx.Value(resultKey{}).(*resultCapture)
+	return c
+}
+
+// parseResult returns stdout if it is a JSON document and nil otherwise.
+func parseResult(stdout []byte) json.RawMessage {
+	stdout = bytes.TrimSpace(stdout)
+	if len(stdout) == 0 || !json.Valid(stdout) {
+		return nil
+	}
+	return append(json.RawMessage{}, stdout...)
+}
+
+// set replaces the captured result.
+func (c *resultCapture) set(result json.RawMessage) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.result = result
+}
+
+// get returns the captured result, nil if there is none.
+func (c *resultCapture) get() json.RawMessage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.result
+}
+
+// templateResult decodes a result for use in the templates of the next
+// step of a pipeline.
+func templateResult(result json.RawMessage) interface{} {
+	if result == nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(result, &v); err != nil {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestParseResult(t *testing.T) {
+	for stdout, want := range map[string]string{
+		"{\"ok\": true}\n":            "{\"ok\": true}",
+		"[1, 2]":                      "[1, 2]",
+		"Restarted\n":                 "",
+		"":                            "",
+		"{\"ok\": true}\nRestarted\n": "",
+	} {
+		if got := string(parseResult([]byte(stdout))); got != want {
+			t.Errorf("parseResult(%q) = %q, want %q", stdout, got, want)
+		}
+	}
+}
+
+func TestStructuredResult(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["find-host"] = Handler{Command: `/bin/echo '{"host": "{{ index .Argv 0 }}"}'`}
+	config.Handlers["restart"] = Handler{
+		Args: []string{"/bin/bash", "-c",
+			`echo restarting {{ .Result.host }} >&2; echo '{"restarted": "{{ .Result.host }}"}'`},
+	}
+	config.Handlers["remediate"] = Handler{Pipeline: []string{"find-host", "restart"}}
+	config.Handlers["both"] = Handler{Group: []string{"find-host", "find-host"}}
+	defer func() {
+		for _, h := range []string{"find-host", "restart", "remediate", "both"} {
+			delete(config.Handlers, h)
+		}
+	}()
+
+	e := &AlertManagerEvent{}
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Result"}}
+	var result map[string]string
+
+	r := e.handleAlert(context.Background(), config, alertWith(alert, "find-host db1"), newAuditRecord(e))
+	if len(r.Handlers) != 1 || json.Unmarshal(r.Handlers[0].Result, &result) != nil || result["host"] != "db1" {
+		t.Fatalf("Handler printing JSON has no result: %#v", r.Handlers)
+	}
+
+	// Standard error is not part of the result
+	r = e.handleAlert(context.Background(), config, alertWith(alert, "remediate db2"), newAuditRecord(e))
+	if len(r.Handlers) != 1 || json.Unmarshal(r.Handlers[0].Result, &result) != nil || result["restarted"] != "db2" {
+		t.Errorf("Pipeline did not pass the result to the next step: %#v", r.Handlers)
+	}
+
+	r = e.handleAlert(context.Background(), config, alertWith(alert, "both db3"), newAuditRecord(e))
+	if len(r.Handlers) != 1 || r.Handlers[0].Result != nil {
+		t.Errorf("Group should have no result: %#v", r.Handlers)
+	}
+}
+
+// alertWith returns a copy of alert naming handler in its annotations.
+func alertWith(alert Alert, handler string) Alert {
+	alert.Annotations = map[string]string{"handler": handler}
+	return alert
+}
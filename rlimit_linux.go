@@ -0,0 +1,148 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// memoryErrors are how commands commonly report failing to allocate
+// memory, matched against their lower cased output.
+var memoryErrors = [][]byte{
+	[]byte("cannot allocate"), // ENOMEM and bash
+	[]byte("out of memory"),
+	[]byte("memoryerror"), // Python
+	[]byte("bad_alloc"),   // C++
+}
+
+// resourceLimits are the resource limits of a command.  The re-exec
+// helper applies them to itself right before executing the command so they
+// are in effect from the command's first instruction.
+type resourceLimits struct {
+	Memory    uint64 `json:"memory,omitempty"`
+	CPU       uint64 `json:"cpu,omitempty"`
+	OpenFiles uint64 `json:"open_files,omitempty"`
+	Nice      int    `json:"nice,omitempty"`
+}
+
+// limits returns the resource limits configured for h or nil if it has
+// none.
+func (h Handler) limits() *resourceLimits {
+	if h.MaxMemory == 0 && h.MaxCPU <= 0 && h.MaxOpenFiles == 0 && h.Nice == 0 {
+		return nil
+	}
+	return &resourceLimits{
+		Memory: h.MaxMemory,
+		// Round up to the next whole second as that is the granularity
+		// of RLIMIT_CPU
+		CPU:       cpuSeconds(h.MaxCPU),
+		OpenFiles: h.MaxOpenFiles,
+		Nice:      h.Nice,
+	}
+}
+
+// cpuSeconds rounds d up to whole seconds.
+func cpuSeconds(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64((d + time.Second - 1) / time.Second)
+}
+
+// apply sets the limits on the calling process.  The nice value only
+// applies to the calling thread, which must be the one that executes the
+// command.  The memory limit is set last as it may make the process unable
+// to allocate more memory.
+func (l *resourceLimits) apply() error {
+	if l.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, l.Nice); err != nil {
+			return fmt.Errorf("Could not set nice: %s", err)
+		}
+	}
+	if l.OpenFiles > 0 {
+		lim := &syscall.Rlimit{Cur: l.OpenFiles, Max: l.OpenFiles}
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, lim); err != nil {
+			return fmt.Errorf("Could not set open file limit: %s", err)
+		}
+	}
+	if l.CPU > 0 {
+		// The soft limit sends SIGXCPU, the hard limit a second later
+		// SIGKILL should the command handle that
+		lim := &syscall.Rlimit{Cur: l.CPU, Max: l.CPU + 1}
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, lim); err != nil {
+			return fmt.Errorf("Could not set CPU limit: %s", err)
+		}
+	}
+	if l.Memory > 0 {
+		lim := &syscall.Rlimit{Cur: l.Memory, Max: l.Memory}
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, lim); err != nil {
+			return fmt.Errorf("Could not set memory limit: %s", err)
+		}
+	}
+	return nil
+}
+
+// limitError classifies err returned from running command, reporting
+// failures caused by its CPU or memory limit as such.  output is what the
+// command wrote.
+func limitError(command Handler, err error, output []byte) error {
+	exit, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+	if command.MaxCPU > 0 && cpuExceeded(command, exit) {
+		return fmt.Errorf("Command exceeded its CPU limit of %s: %s", command.MaxCPU, err)
+	}
+	if command.MaxMemory > 0 && memoryExceeded(exit, output) {
+		return fmt.Errorf("Command exceeded its memory limit of %d bytes: %s",
+			command.MaxMemory, err)
+	}
+	return err
+}
+
+// cpuExceeded returns true if the kernel killed the command for reaching
+// its CPU limit.
+func cpuExceeded(command Handler, exit *exec.ExitError) bool {
+	status, ok := exit.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+
+	switch status.Signal() {
+	case syscall.SIGXCPU:
+		// Sent when the command reaches RLIMIT_CPU
+		return true
+	case syscall.SIGKILL:
+		// Sent if it carries on after SIGXCPU, but also by others
+		used := exit.UserTime() + exit.SystemTime()
+		return used >= time.Duration(cpuSeconds(command.MaxCPU))*time.Second
+	}
+	return false
+}
+
+// memoryExceeded returns true if the command failed like programs do when
+// RLIMIT_AS makes their allocations fail: crashing on the failed
+// allocation, being killed or reporting it before exiting.
+func memoryExceeded(exit *exec.ExitError, output []byte) bool {
+	status, ok := exit.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		switch status.Signal() {
+		case syscall.SIGSEGV, syscall.SIGKILL:
+			return true
+		}
+		return false
+	}
+
+	output = bytes.ToLower(output)
+	for _, m := range memoryErrors {
+		if bytes.Contains(output, m) {
+			return true
+		}
+	}
+	return false
+}
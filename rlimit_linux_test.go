@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResourceLimits(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	tests := map[string]Handler{
+		"memory": {
+			Command:   "/bin/bash -c \"x=$(yes | head -c 200000000); echo ${#x}\"",
+			MaxMemory: 64 * 1024 * 1024,
+		},
+		"cpu": {
+			Command: "/bin/bash -c \"while :; do :; done\"",
+			MaxCPU:  time.Second,
+		},
+	}
+
+	for name, handler := range tests {
+		exe, args, err := formatHandler([]string{name}, handler.Command, Alert{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := executeHandler(context.Background(), handler, exe, args)
+		if err == nil {
+			t.Errorf("Handler exceeding its %s limit should fail: %s", name, out)
+			continue
+		}
+		t.Logf("%s: %v: %s", name, err, out)
+		if !strings.Contains(strings.ToLower(err.Error()), name+" limit") {
+			t.Errorf("Handler exceeding its %s limit reported as: %s", name, err)
+		}
+	}
+
+	// Other failures are not blamed on the limits
+	handler := Handler{MaxMemory: 64 * 1024 * 1024, MaxCPU: time.Second}
+	if out, err := executeHandler(context.Background(), handler, "/bin/false", nil); err == nil ||
+		strings.Contains(err.Error(), "limit") {
+		t.Errorf("Failing handler within its limits reported as: %v: %s", err, out)
+	}
+}
+
+func TestNiceAndOpenFiles(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	handler := Handler{MaxOpenFiles: 64, Nice: 5}
+	out, err := executeHandler(context.Background(), handler, "/bin/bash",
+		[]string{"-c", "ulimit -n; cut -d ' ' -f 19 /proc/self/stat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := strings.Fields(out.String()); len(fields) != 2 || fields[0] != "64" || fields[1] != "5" {
+		t.Errorf("Expected 64 open files and nice 5, got: %q", out.String())
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+// checkLimits refuses to run commands with resource limits configured as
+// they are only supported on Linux.
+func checkLimits(command Handler) error {
+	if command.MaxMemory > 0 || command.MaxCPU > 0 || command.MaxOpenFiles > 0 ||
+		command.Nice != 0 {
+		return fmt.Errorf("Resource limits are only supported on Linux")
+	}
+
+	return nil
+}
+
+// limitError returns err unchanged.
+func limitError(command Handler, err error, output []byte) error {
+	return err
+}
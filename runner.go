@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// dockerBinary is the Docker command line client used by the docker
+	// runner
+	dockerBinary = "docker"
+
+	// sshBinary is the OpenSSH client used by the ssh runner
+	sshBinary = "ssh"
+
+	// systemdRunBinary and systemctlBinary are used by the systemd runner
+	systemdRunBinary = "systemd-run"
+	systemctlBinary  = "systemctl"
+
+	// containerSeq numbers the containers and units started for commands
+	containerSeq uint64
+)
+
+// DockerRunner holds the settings of the docker runner.
+type DockerRunner struct {
+	// Image is the container image the command runs in
+	Image string `json:"image"`
+
+	// Volumes are mounted in the container, as with docker run -v
+	Volumes []string `json:"volumes,omitempty"`
+
+	// Network is the network the container is connected to
+	Network string `json:"network,omitempty"`
+
+	// User is the user the command runs as in the container
+	User string `json:"user,omitempty"`
+
+	// Options are further arguments passed to docker run
+	Options []string `json:"options,omitempty"`
+}
+
+// SSHRunner holds the settings of the ssh runner.
+type SSHRunner struct {
+	// Host is a go template string of the host the command runs on.  A
+	// port, as in the instance label, is removed.
+	Host string `json:"host"`
+
+	// User is the remote user
+	User string `json:"user,omitempty"`
+
+	// Port is the SSH port of the host
+	Port int `json:"port,omitempty"`
+
+	// Key is the private key file used to authenticate
+	Key string `json:"key,omitempty"`
+
+	// KnownHosts is the known hosts file used to verify the host key
+	KnownHosts string `json:"known_hosts,omitempty" yaml:"known_hosts" toml:"known_hosts"`
+
+	// Options are further arguments passed to ssh
+	Options []string `json:"options,omitempty"`
+}
+
+// SystemdRunner holds the settings of the systemd runner.
+type SystemdRunner struct {
+	// Mode is "scope", the default, to run the command as a child of
+	// am-event-handler in a transient scope unit or "service" to have
+	// systemd start it in a transient service unit.
+	Mode string `json:"mode,omitempty"`
+
+	// Slice is the slice the unit is placed in
+	Slice string `json:"slice,omitempty"`
+
+	// Properties are unit properties such as MemoryMax=256M
+	Properties []string `json:"properties,omitempty"`
+
+	// User talks to the service manager of the user rather than the
+	// system
+	User bool `json:"user,omitempty"`
+}
+
+// runnerCommand returns the executable and arguments that run exe with
+// args using the handler's runner.  The returned function, if not nil,
+// stops the command when it is killed.
+func (h Handler) runnerCommand(exe string, args []string) (string, []string, func()) {
+	switch h.Runner {
+	case "docker":
+		return h.Docker.command(exe, args, h.Env)
+	case "ssh":
+		return h.SSH.command(exe, args, h.Env)
+	case "systemd":
+		return h.Systemd.command(exe, args, h.Env)
+	}
+	return exe, args, nil
+}
+
+// renderRunner returns the handler with the templates of its runner
+// settings rendered for handler and alert.
+func (h Handler) renderRunner(handler []string, alert Alert) (Handler, error) {
+	if h.Runner != "ssh" {
+		return h, nil
+	}
+	host, err := renderHandler(handler, h.SSH.Host, alert)
+	if err != nil {
+		return h, fmt.Errorf("Could not render the ssh host: %s", err)
+	}
+	host = strings.TrimSpace(host)
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	if host == "" {
+		return h, fmt.Errorf("The ssh host is empty, not running.")
+	}
+	if strings.HasPrefix(host, "-") {
+		// ssh would read it as an option
+		return h, fmt.Errorf("Invalid ssh host %q, not running.", host)
+	}
+
+	ssh := *h.SSH
+	ssh.Host = host
+	h.SSH = &ssh
+	return h, nil
+}
+
+// checkRunner verifies the runner settings of a handler.
+func (h Handler) checkRunner() error {
+	switch h.Runner {
+	case "", "local":
+	case "docker":
+		if h.Docker == nil || h.Docker.Image == "" {
+			return fmt.Errorf("docker runner requires an image")
+		}
+	case "ssh":
+		if h.SSH == nil || h.SSH.Host == "" {
+			return fmt.Errorf("ssh runner requires a host")
+		}
+		if _, err := parseTemplate(h.SSH.Host); err != nil {
+			return fmt.Errorf("ssh host: %s", err)
+		}
+	case "systemd":
+		if h.Systemd != nil {
+			switch h.Systemd.Mode {
+			case "", "scope", "service":
+			default:
+				return fmt.Errorf("unknown systemd mode \"%s\"", h.Systemd.Mode)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown runner \"%s\"", h.Runner)
+	}
+	return nil
+}
+
+// command returns the docker run command line running exe with args in a
+// new container.  The names of the variables in env are passed to the
+// container so their values never appear on the command line.
+func (d *DockerRunner) command(exe string, args []string, env map[string]string) (string, []string, func()) {
+	name := fmt.Sprintf("am-event-handler-%d-%d", os.Getpid(),
+		atomic.AddUint64(&containerSeq, 1))
+	run := []string{"run", "--rm", "-i", "--name", name}
+	if d.Network != "" {
+		run = append(run, "--network", d.Network)
+	}
+	if d.User != "" {
+		run = append(run, "--user", d.User)
+	}
+	for _, v := range d.Volumes {
+		run = append(run, "-v", v)
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		run = append(run, "-e", k)
+	}
+	run = append(run, d.Options...)
+	run = append(run, d.Image, exe)
+	run = append(run, args...)
+
+	// Killing the client does not stop the container
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := exec.CommandContext(ctx, dockerBinary, "kill", name).Run(); err != nil {
+			log.Printf("Error: Could not kill container %s: %s", name, err)
+		}
+	}
+	return dockerBinary, run, stop
+}
+
+// command returns the ssh command line running exe with args on the host.
+// The names of the variables in env are sent with SendEnv, which the
+// server must accept with AcceptEnv.
+func (s *SSHRunner) command(exe string, args []string, env map[string]string) (string, []string, func()) {
+	run := []string{"-T", "-o", "BatchMode=yes"}
+	if s.User != "" {
+		run = append(run, "-l", s.User)
+	}
+	if s.Port != 0 {
+		run = append(run, "-p", strconv.Itoa(s.Port))
+	}
+	if s.Key != "" {
+		run = append(run, "-i", s.Key)
+	}
+	if s.KnownHosts != "" {
+		run = append(run, "-o", "UserKnownHostsFile="+s.KnownHosts)
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		run = append(run, "-o", "SendEnv="+k)
+	}
+	run = append(run, s.Options...)
+
+	// The remote shell splits the command again so quote every word
+	remote := []string{shellQuote(exe)}
+	for _, a := range args {
+		remote = append(remote, shellQuote(a))
+	}
+	run = append(run, "--", s.Host, strings.Join(remote, " "))
+	return sshBinary, run, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@,+%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// command returns the systemd-run command line running exe with args in a
+// transient unit.  In service mode the variables in env are passed to the
+// unit by name so their values never appear on the command line.
+func (s *SystemdRunner) command(exe string, args []string, env map[string]string) (string, []string, func()) {
+	if s == nil {
+		s = &SystemdRunner{}
+	}
+	name := fmt.Sprintf("am-event-handler-%d-%d", os.Getpid(),
+		atomic.AddUint64(&containerSeq, 1))
+	run := []string{"--quiet", "--collect", "--unit", name}
+	if s.User {
+		run = append(run, "--user")
+	}
+	if s.Slice != "" {
+		run = append(run, "--slice", s.Slice)
+	}
+	for _, p := range s.Properties {
+		run = append(run, "--property", p)
+	}
+
+	var stop func()
+	if s.Mode == "service" {
+		run = append(run, "--wait", "--pipe", "--same-dir")
+		keys := make([]string, 0, len(env))
+		for k := range env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			run = append(run, "--setenv", k)
+		}
+
+		// Killing systemd-run does not stop the service
+		stop = func() {
+			ctl := []string{"stop", name + ".service"}
+			if s.User {
+				ctl = append([]string{"--user"}, ctl...)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := exec.CommandContext(ctx, systemctlBinary, ctl...).Run(); err != nil {
+				log.Printf("Error: Could not stop unit %s: %s", name, err)
+			}
+		}
+	} else {
+		run = append(run, "--scope")
+	}
+
+	run = append(run, "--", exe)
+	run = append(run, args...)
+	return systemdRunBinary, run, stop
+}
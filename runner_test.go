@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDocker writes a script standing in for the Docker client to dir.  It
+// prints its arguments and the SECRET variable, sleeps for the number of
+// seconds in the SLEEP variable, and records the containers it is asked
+// to kill in dir/killed.
+func fakeDocker(t *testing.T, dir string) string {
+	script := `#!/bin/sh
+if [ "$1" = kill ]; then
+	echo "$2" >> ` + filepath.Join(dir, "killed") + `
+	exit 0
+fi
+echo "$@"
+echo "SECRET=$SECRET"
+sleep ${SLEEP:-0}
+`
+	path := filepath.Join(dir, "docker")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDockerRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dockerBinary = fakeDocker(t, dir)
+	defer func() { dockerBinary = "docker" }()
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	handler := Handler{
+		Runner: "docker",
+		Docker: &DockerRunner{
+			Image:   "alpine:3",
+			Volumes: []string{"/data:/data:ro"},
+			Network: "host",
+		},
+		Env: map[string]string{"SECRET": "hunter2", "SLEEP": "0"},
+	}
+	out, err := executeHandler(context.Background(), handler, "/bin/echo", []string{"hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "run --rm -i --name am-event-handler-") ||
+		!strings.Contains(out.String(), " --network host -v /data:/data:ro -e SECRET -e SLEEP alpine:3 /bin/echo hello\n") {
+		t.Errorf("Unexpected docker command line: %q", out.String())
+	}
+	if !strings.Contains(out.String(), "SECRET=hunter2\n") {
+		t.Errorf("Environment not passed to docker: %q", out.String())
+	}
+
+	// A killed command kills its container
+	handler.Timeout = 200 * time.Millisecond
+	handler.Env["SLEEP"] = "5"
+	if _, err := executeHandler(context.Background(), handler, "/bin/sleep", []string{"5"}); err == nil {
+		t.Fatalf("Handler should have timed out")
+	}
+	killed, err := ioutil.ReadFile(filepath.Join(dir, "killed"))
+	if err != nil || !strings.HasPrefix(string(killed), "am-event-handler-") {
+		t.Errorf("Container of the timed out command was not killed: %q %v", killed, err)
+	}
+
+	cfg := &Configuration{Handlers: map[string]Handler{
+		"noimage": {Command: "/bin/true", Runner: "docker"},
+	}}
+	if err := validateConfiguration(cfg); err == nil {
+		t.Errorf("Docker runner without an image should be rejected")
+	}
+}
+
+func TestSSHRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake client runs the remote command with the local shell
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\nfor last; do :; done\nexec /bin/sh -c \"$last\"\n"
+	sshBinary = filepath.Join(dir, "ssh")
+	if err := ioutil.WriteFile(sshBinary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { sshBinary = "ssh" }()
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["remote"] = Handler{
+		Args:   []string{"/bin/echo", "{{ .Labels.summary }}"},
+		Runner: "ssh",
+		SSH: &SSHRunner{
+			Host: "{{ .Labels.instance }}",
+			User: "root",
+			Key:  "/etc/am-event-handler/id_ed25519",
+		},
+	}
+	defer delete(config.Handlers, "remote")
+
+	alert := Alert{Status: "firing", Labels: map[string]string{
+		"instance": "node1:9100",
+		"summary":  "it's $HOME; done",
+	}}
+	out, err := parseHandler(context.Background(), []string{"remote"}, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "it's $HOME; done\n" {
+		t.Errorf("Arguments were not quoted for the remote shell: %q", out.String())
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if !strings.HasPrefix(string(args), "-T -o BatchMode=yes -l root -i /etc/am-event-handler/id_ed25519 -- node1 ") {
+		t.Errorf("Unexpected ssh command line: %q", args)
+	}
+
+	// A host starting with a dash would be an option to ssh
+	alert.Labels["instance"] = "-oProxyCommand=touch " + filepath.Join(dir, "pwned")
+	if _, err := parseHandler(context.Background(), []string{"remote"}, alert); err == nil {
+		t.Errorf("Ran the command with an ssh host starting with a dash")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+		t.Errorf("The ssh host was passed as an option")
+	}
+}
+
+func TestSystemdRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake systemd-run records its arguments and runs the command
+	// following "--".  The fake systemctl records the units it stops.
+	run := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") +
+		"\nwhile [ \"$1\" != -- ]; do shift; done\nshift\nexec \"$@\"\n"
+	ctl := "#!/bin/sh\necho \"$@\" >> " + filepath.Join(dir, "stopped") + "\n"
+	systemdRunBinary = filepath.Join(dir, "systemd-run")
+	systemctlBinary = filepath.Join(dir, "systemctl")
+	for path, script := range map[string]string{systemdRunBinary: run, systemctlBinary: ctl} {
+		if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		systemdRunBinary = "systemd-run"
+		systemctlBinary = "systemctl"
+	}()
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	handler := Handler{
+		Runner:  "systemd",
+		Systemd: &SystemdRunner{Slice: "remediation.slice", Properties: []string{"MemoryMax=256M"}},
+	}
+	out, err := executeHandler(context.Background(), handler, "/bin/echo", []string{"hello"})
+	if err != nil || out.String() != "hello\n" {
+		t.Fatalf("Scope unit command failed: %q %v", out, err)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if !strings.HasPrefix(string(args), "--quiet --collect --unit am-event-handler-") ||
+		!strings.HasSuffix(string(args), " --slice remediation.slice --property MemoryMax=256M --scope -- /bin/echo hello\n") {
+		t.Errorf("Unexpected systemd-run command line: %q", args)
+	}
+
+	handler.Systemd.Mode = "service"
+	handler.Env = map[string]string{"TOKEN": "secret"}
+	handler.Timeout = 200 * time.Millisecond
+	if _, err := executeHandler(context.Background(), handler, "/bin/sleep", []string{"5"}); err == nil {
+		t.Fatalf("Handler should have timed out")
+	}
+	args, _ = ioutil.ReadFile(filepath.Join(dir, "args"))
+	if !strings.Contains(string(args), " --wait --pipe --same-dir --setenv TOKEN -- /bin/sleep 5") {
+		t.Errorf("Unexpected systemd-run command line: %q", args)
+	}
+	stopped, _ := ioutil.ReadFile(filepath.Join(dir, "stopped"))
+	if !strings.HasPrefix(string(stopped), "stop am-event-handler-") {
+		t.Errorf("Service of the timed out command was not stopped: %q", stopped)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+// sandboxArg is the first argument of am-event-handler when it is run to
+// enter the sandbox of a command.
+const sandboxArg = "-sandbox-exec"
+
+// Sandbox is the sandbox profile of a handler.  The command may only read
+// and execute files below the Read paths and read and write below the
+// Write paths.  System calls that change mounts, namespaces, or the kernel
+// or that inspect other processes are denied.
+type Sandbox struct {
+	// Read are the paths the command may read and execute.  By default
+	// these are the system directories /bin, /sbin, /usr, /lib, /lib64,
+	// and /etc.
+	Read []string `json:"read,omitempty"`
+
+	// Write are the paths the command may read, write, create, and remove
+	// files below
+	Write []string `json:"write,omitempty"`
+}
@@ -0,0 +1,300 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock system calls and constants from linux/landlock.h.  The system
+// call numbers are the same on every architecture.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	// oPath is O_PATH, missing from the syscall package
+	oPath = 0x200000
+
+	accessExecute  = 1 << 0
+	accessWrite    = 1 << 1
+	accessRead     = 1 << 2
+	accessReadDir  = 1 << 3
+	accessTruncate = 1 << 14
+	accessIoctlDev = 1 << 15
+
+	// accessFile are the rights that apply to files rather than
+	// directories
+	accessFile = accessExecute | accessWrite | accessRead | accessTruncate | accessIoctlDev
+
+	// accessReadOnly are the rights granted below Read paths
+	accessReadOnly = accessExecute | accessRead | accessReadDir
+)
+
+// seccomp constants from linux/seccomp.h and linux/prctl.h
+const (
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+	seccompRetKill    = 0x80000000
+	seccompRetErrno   = 0x00050000
+	seccompRetAllow   = 0x7fff0000
+	seccompDataNr     = 0
+	seccompDataArch   = 4
+	x32SyscallBit     = 0x40000000
+	auditArchX86_64   = 0xc000003e
+	auditArchAarch64  = 0xc00000b7
+)
+
+// sandboxDefaultRead are the paths a sandboxed command may read when its
+// sandbox does not list any.
+var sandboxDefaultRead = []string{"/bin", "/sbin", "/usr", "/lib", "/lib64", "/etc"}
+
+// seccompArch is the audit architecture and the system calls denied to
+// sandboxed commands on an architecture.
+type seccompArch struct {
+	audit  uint32
+	denied []uint32
+}
+
+// seccompArches holds the system calls a sandboxed command may not make:
+// ptrace, mount, umount2, pivot_root, chroot, reboot, kexec_load,
+// kexec_file_load, init_module, finit_module, delete_module, swapon,
+// swapoff, unshare, setns, keyctl, add_key, request_key, perf_event_open,
+// process_vm_readv, process_vm_writev, open_by_handle_at, bpf and
+// userfaultfd.
+var seccompArches = map[string]seccompArch{
+	"amd64": {auditArchX86_64, []uint32{101, 165, 166, 155, 161, 169, 246,
+		320, 175, 313, 176, 167, 168, 272, 308, 250, 248, 249, 298, 310,
+		311, 304, 321, 323}},
+	"arm64": {auditArchAarch64, []uint32{117, 40, 39, 41, 51, 142, 104,
+		294, 105, 273, 106, 224, 225, 97, 268, 219, 217, 218, 241, 270,
+		271, 265, 280, 282}},
+}
+
+// landlockPathBeneath is struct landlock_path_beneath_attr.  The kernel
+// structure is packed so only the first 12 bytes are read.
+type landlockPathBeneath struct {
+	allowed uint64
+	fd      int32
+}
+
+// execProfile is what sandboxExec applies to its own process before
+// executing a command.
+type execProfile struct {
+	Sandbox *Sandbox        `json:"sandbox,omitempty"`
+	Limits  *resourceLimits `json:"limits,omitempty"`
+}
+
+// sandboxCommand returns the command line running exe with args in the
+// sandbox and with the resource limits of command.  am-event-handler runs
+// itself with sandboxArg to restrict its own process before executing exe.
+func sandboxCommand(command Handler, exe string, args []string) (string, []string, error) {
+	profile := execProfile{Sandbox: command.Sandbox, Limits: command.limits()}
+	if profile.Sandbox == nil && profile.Limits == nil {
+		return exe, args, nil
+	}
+	if _, ok := seccompArches[runtime.GOARCH]; !ok && profile.Sandbox != nil {
+		return "", nil, fmt.Errorf("Sandboxes are not supported on %s", runtime.GOARCH)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("Could not find the am-event-handler executable: %s", err)
+	}
+	blob, err := json.Marshal(profile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return self, append([]string{sandboxArg, string(blob), exe}, args...), nil
+}
+
+// sandboxMain restricts the current process to the sandbox and resource
+// limits of the profile given as the first argument and executes the
+// command in the remaining arguments.  It never returns.
+func sandboxMain(args []string) {
+	err := sandboxExec(args)
+	fmt.Fprintf(os.Stderr, "Sandbox error: %s\n", err)
+	os.Exit(126)
+}
+
+func sandboxExec(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Usage: %s PROFILE COMMAND [ARGS...]", sandboxArg)
+	}
+	var profile execProfile
+	if err := json.Unmarshal([]byte(args[0]), &profile); err != nil {
+		return fmt.Errorf("Invalid profile: %s", err)
+	}
+	exe, err := exec.LookPath(args[1])
+	if err != nil {
+		return err
+	}
+
+	// Nothing may allocate once the memory limit is set, as the limit
+	// may be below what the helper already uses, so prepare execve's
+	// arguments first.
+	path, err := syscall.BytePtrFromString(exe)
+	if err != nil {
+		return err
+	}
+	argv, err := syscall.SlicePtrFromStrings(args[1:])
+	if err != nil {
+		return err
+	}
+	envv, err := syscall.SlicePtrFromStrings(os.Environ())
+	if err != nil {
+		return err
+	}
+
+	// Landlock, seccomp, and nice apply to the calling thread, which must
+	// be the one that executes the command.
+	runtime.LockOSThread()
+	if profile.Sandbox != nil {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+			return fmt.Errorf("Could not set no_new_privs: %s", errno)
+		}
+		if err = profile.Sandbox.landlock(); err != nil {
+			return err
+		}
+		if err = seccompFilter(); err != nil {
+			return err
+		}
+	}
+	if profile.Limits != nil {
+		if err = profile.Limits.apply(); err != nil {
+			return err
+		}
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_EXECVE, uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&argv[0])), uintptr(unsafe.Pointer(&envv[0])))
+	return errno
+}
+
+// landlockRights returns the file system rights handled by the running
+// kernel's Landlock ABI.
+func landlockRights() (uint64, error) {
+	abi, _, errno := syscall.RawSyscall(sysLandlockCreateRuleset, 0, 0,
+		landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0, fmt.Errorf("Landlock is not available: %s", errno)
+	}
+	switch {
+	case abi >= 5:
+		return 1<<16 - 1, nil
+	case abi >= 3:
+		return 1<<15 - 1, nil
+	case abi == 2:
+		return 1<<14 - 1, nil
+	}
+	return 1<<13 - 1, nil
+}
+
+// landlock restricts file system access of the current thread to the
+// sandbox's paths.
+func (s Sandbox) landlock() error {
+	handled, err := landlockRights()
+	if err != nil {
+		return err
+	}
+	ruleset, _, errno := syscall.RawSyscall(sysLandlockCreateRuleset,
+		uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno != 0 {
+		return fmt.Errorf("Could not create Landlock ruleset: %s", errno)
+	}
+	defer syscall.Close(int(ruleset))
+
+	read := s.Read
+	if len(read) == 0 {
+		for _, path := range sandboxDefaultRead {
+			if _, err := os.Stat(path); err == nil {
+				read = append(read, path)
+			}
+		}
+	}
+	for _, path := range read {
+		if err = landlockAllow(int(ruleset), path, accessReadOnly&handled); err != nil {
+			return err
+		}
+	}
+	for _, path := range append([]string{"/dev/null"}, s.Write...) {
+		if err = landlockAllow(int(ruleset), path, handled); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno = syscall.RawSyscall(sysLandlockRestrictSelf, ruleset, 0, 0); errno != 0 {
+		return fmt.Errorf("Could not enforce Landlock ruleset: %s", errno)
+	}
+	return nil
+}
+
+// landlockAllow adds a rule to ruleset granting access below path.
+func landlockAllow(ruleset int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Could not open sandbox path %s: %s", path, err)
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("Could not stat sandbox path %s: %s", path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= accessFile
+	}
+
+	attr := landlockPathBeneath{allowed: access, fd: int32(fd)}
+	_, _, errno := syscall.RawSyscall6(sysLandlockAddRule, uintptr(ruleset),
+		landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("Could not allow sandbox path %s: %s", path, errno)
+	}
+	return nil
+}
+
+// seccompFilter denies the system calls of seccompArches to the current
+// thread.  They, and x32 system calls, fail with EPERM.  System calls of
+// other architectures kill the process.
+func seccompFilter() error {
+	arch := seccompArches[runtime.GOARCH]
+	denied := len(arch.denied)
+
+	filter := []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataArch},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, K: arch.audit},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetKill},
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataNr},
+		{Code: syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K, Jt: uint8(denied + 1),
+			K: x32SyscallBit},
+	}
+	for i, nr := range arch.denied {
+		filter = append(filter, syscall.SockFilter{
+			Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K,
+			Jt:   uint8(denied - i), K: nr})
+	}
+	filter = append(filter,
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow},
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K,
+			K: seccompRetErrno | uint32(syscall.EPERM)})
+
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter,
+		uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("Could not install seccomp filter: %s", errno)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSandbox(t *testing.T) {
+	if _, err := landlockRights(); err != nil {
+		t.Skip(err)
+	}
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	if err = ioutil.WriteFile(secret, []byte("hunter2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(dir, "work")
+	if err = os.Mkdir(work, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := Handler{Sandbox: &Sandbox{Write: []string{work}}}
+	run := func(command string) (string, error) {
+		out, err := executeHandler(context.Background(), handler, "/bin/sh",
+			[]string{"-c", command})
+		if out == nil {
+			return "", err
+		}
+		return out.String(), err
+	}
+
+	if out, err := run("echo hello > " + work + "/out && cat " + work + "/out"); err != nil {
+		t.Errorf("Sandboxed command could not use its write path: %s: %s", err, out)
+	} else if strings.TrimSpace(out) != "hello" {
+		t.Errorf("Unexpected output from sandboxed command: %s", out)
+	}
+	if out, err := run("cat " + secret); err == nil || strings.Contains(out, "hunter2") {
+		t.Errorf("Sandboxed command read a file outside its paths: %s", out)
+	}
+	if out, err := run("touch " + dir + "/new"); err == nil {
+		t.Errorf("Sandboxed command wrote outside its paths: %s", out)
+	}
+	if _, err := os.Stat("/usr/bin/unshare"); err == nil {
+		if out, err := run("/usr/bin/unshare --user true"); err == nil {
+			t.Errorf("Sandboxed command could create a namespace: %s", out)
+		}
+	}
+
+	handler.Sandbox = &Sandbox{Read: []string{dir + "/missing"}}
+	if out, err := run("true"); err == nil {
+		t.Errorf("Sandbox with a missing path should fail: %s", out)
+	}
+}
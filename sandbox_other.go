@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// sandboxCommand refuses to run commands with a sandbox or resource limits
+// configured as they are only supported on Linux.
+func sandboxCommand(command Handler, exe string, args []string) (string, []string, error) {
+	if command.Sandbox != nil {
+		return "", nil, fmt.Errorf("Sandboxes are only supported on Linux")
+	}
+	if err := checkLimits(command); err != nil {
+		return "", nil, err
+	}
+	return exe, args, nil
+}
+
+// sandboxMain exits with an error.
+func sandboxMain(args []string) {
+	fmt.Fprintf(os.Stderr, "Sandbox error: Sandboxes are only supported on Linux\n")
+	os.Exit(126)
+}
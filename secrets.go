@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// secretRef matches references to secrets in handler arguments and
+// environment variables.
+var secretRef = regexp.MustCompile(`secret://(file|env|vault)/[^\s\x00]+`)
+
+// secretTemplateRef matches the secret references written in a template,
+// stopping before template actions and quoted strings.
+var secretTemplateRef = regexp.MustCompile("secret://(file|env|vault)/[^\\s\\x00{}\"`]+")
+
+// secretMark separates the secret references of a handler's configuration
+// from alert data in rendered commands.  It follows each reference of the
+// configuration and breaks up "secret://" in the alert data so that only
+// the former are resolved.  Arguments and environment variables can never
+// contain it so it is removed once secrets are resolved.
+const secretMark = "\x00"
+
+// renderSecretsMarked renders command like renderHandler marking the
+// secret references in command itself with secretMark.  References that
+// come from the alert, say a label with the value secret://env/TOKEN, are
+// passed to the command verbatim.
+func renderSecretsMarked(handler []string, command string, a Alert) (string, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	placeholder := "secret-" + hex.EncodeToString(nonce) + "-"
+
+	var refs []string
+	masked := secretTemplateRef.ReplaceAllStringFunc(command, func(ref string) string {
+		refs = append(refs, ref)
+		return fmt.Sprintf("%s%d-", placeholder, len(refs)-1)
+	})
+	rendered, err := renderHandler(handler, masked, a)
+	if err != nil {
+		return "", err
+	}
+
+	rendered = strings.Replace(rendered, "secret://", "secret:"+secretMark+"//", -1)
+	for i, ref := range refs {
+		rendered = strings.Replace(rendered, fmt.Sprintf("%s%d-", placeholder, i),
+			ref+secretMark, -1)
+	}
+	return rendered, nil
+}
+
+// unmarkSecrets removes the marks of renderSecretsMarked from s.
+func unmarkSecrets(s string) string {
+	return strings.Replace(s, secretMark, "", -1)
+}
+
+// unmarkArgs removes the marks of renderSecretsMarked from each of args for
+// logging.
+func unmarkArgs(args []string) []string {
+	result := make([]string, len(args))
+	for i, a := range args {
+		result[i] = unmarkSecrets(a)
+	}
+	return result
+}
+
+// vaultClient is used to read secrets from Vault
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// resolveSecrets replaces every secret reference in s with the value of the
+// secret.  Errors name the reference but never include a secret value.
+func resolveSecrets(s string) (string, error) {
+	var err error
+	result := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+		value, e := resolveSecret(ref)
+		if e != nil && err == nil {
+			err = e
+		}
+		return value
+	})
+	return unmarkSecrets(result), err
+}
+
+// resolveSecret returns the value of a single secret reference:
+//
+//	secret://file/path/to/file   contents of /path/to/file
+//	secret://env/NAME            environment variable NAME
+//	secret://vault/path#key      key from the Vault secret at path
+func resolveSecret(ref string) (string, error) {
+	spec := strings.TrimPrefix(ref, "secret://")
+	i := strings.Index(spec, "/")
+	kind, path := spec[:i], spec[i+1:]
+
+	switch kind {
+	case "file":
+		buf, err := ioutil.ReadFile("/" + path)
+		if err != nil {
+			return "", fmt.Errorf("Secret %s: %s", ref, err)
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	case "env":
+		value, ok := os.LookupEnv(path)
+		if !ok {
+			return "", fmt.Errorf("Secret %s: environment variable is not set", ref)
+		}
+		return value, nil
+	case "vault":
+		value, err := readVault(path)
+		if err != nil {
+			return "", fmt.Errorf("Secret %s: %s", ref, err)
+		}
+		return value, nil
+	}
+
+	return "", fmt.Errorf("Secret %s: unknown secret type", ref)
+}
+
+// readVault reads a key from a Vault secret given as "path#key" using the
+// VAULT_ADDR and VAULT_TOKEN environment variables.  Both version 1 and
+// version 2 KV secrets engines are supported.
+func readVault(spec string) (string, error) {
+	i := strings.LastIndex(spec, "#")
+	if i < 0 {
+		return "", fmt.Errorf("missing #key")
+	}
+	path, key := spec[:i], spec[i+1:]
+
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Vault returned status %d", resp.StatusCode)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		// KV version 2 nests the secret inside another data object
+		data = inner
+	}
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("key %s not found", key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/pagerduty":
+			w.Write([]byte(`{"data": {"token": "kv1-token"}}`))
+		case "/v1/secret/data/pagerduty":
+			w.Write([]byte(`{"data": {"data": {"token": "kv2-token"}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+
+	fd, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("file-token\n")
+	fd.Close()
+
+	os.Setenv("AM_TEST_SECRET", "env-token")
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "root")
+	defer os.Unsetenv("AM_TEST_SECRET")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	var tests = map[string]string{
+		"--token=secret://env/AM_TEST_SECRET":        "--token=env-token",
+		"secret://file" + fd.Name():                  "file-token",
+		"secret://vault/secret/pagerduty#token":      "kv1-token",
+		"secret://vault/secret/data/pagerduty#token": "kv2-token",
+		"no secrets here":                            "no secrets here",
+	}
+	for ref, expected := range tests {
+		value, err := resolveSecrets(ref)
+		if err != nil {
+			t.Errorf("%s: %s", ref, err)
+		} else if value != expected {
+			t.Errorf("%s resolved to %s, expected %s", ref, value, expected)
+		}
+	}
+
+	for _, ref := range []string{"secret://env/AM_TEST_UNSET", "secret://vault/secret/missing#token"} {
+		if _, err := resolveSecrets(ref); err == nil {
+			t.Errorf("%s should fail to resolve", ref)
+		}
+	}
+}
+
+func TestSecretsNotLogged(t *testing.T) {
+	os.Setenv("AM_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("AM_TEST_SECRET")
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	logs := new(bytes.Buffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	handler := Handler{Env: map[string]string{"TOKEN": "secret://env/AM_TEST_SECRET"}}
+	out, err := executeHandler(context.Background(), handler, "/bin/bash",
+		[]string{"-c", "echo $TOKEN $0", "secret://env/AM_TEST_SECRET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hunter2 hunter2\n" {
+		t.Errorf("Secrets not passed to the command: %q", out.String())
+	}
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("Secret value logged: %s", logs.String())
+	}
+}
+
+func TestAlertSecretsNotResolved(t *testing.T) {
+	os.Setenv("AM_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("AM_TEST_SECRET")
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["leaky"] = Handler{
+		Command: "/bin/bash -c 'echo $0 $1 $TOKEN $LABEL' secret://env/AM_TEST_SECRET {{ .Labels.summary }}",
+		Env: map[string]string{
+			"TOKEN": "secret://env/AM_TEST_SECRET",
+			"LABEL": "{{ .Labels.summary }}",
+		},
+	}
+	defer delete(config.Handlers, "leaky")
+
+	alert := Alert{Status: "firing", Labels: map[string]string{"summary": "secret://env/AM_TEST_SECRET"}}
+	out, err := parseHandler(context.Background(), []string{"leaky"}, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "hunter2 secret://env/AM_TEST_SECRET hunter2 secret://env/AM_TEST_SECRET\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+}
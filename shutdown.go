@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// shutdownTimeout bounds how long shutdown waits for requests, and
+	// the handlers they run, to finish.
+	shutdownTimeout time.Duration
+
+	// servers are the running HTTP servers
+	servers     []*http.Server
+	serversLock sync.Mutex
+
+	// shutdownDone is closed once shutdown has finished
+	shutdownDone = make(chan struct{})
+	shutdownOnce sync.Once
+
+	// runContext is the parent context of every request and queued alert.
+	// It is cancelled when shutdown gives up waiting, killing the
+	// commands still running.
+	runContext, cancelRunning = context.WithCancel(context.Background())
+)
+
+// addServer records a running server so it is stopped by shutdown.
+func addServer(server *http.Server) {
+	serversLock.Lock()
+	defer serversLock.Unlock()
+	servers = append(servers, server)
+}
+
+// shutdownServers stops the servers accepting new requests and waits up to
+// timeout for in-flight requests to complete.
+func shutdownServers(list []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range list {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("Error: Requests still running after %s: %s", timeout, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// shutdown gracefully stops all servers.  It is safe to call more than
+// once.
+func shutdown() {
+	shutdownOnce.Do(func() {
+		atomic.StoreInt32(&shuttingDown, 1)
+		serversLock.Lock()
+		list := append([]*http.Server(nil), servers...)
+		serversLock.Unlock()
+
+		log.Printf("Shutting down, waiting up to %s for running handlers", shutdownTimeout)
+		start := time.Now()
+		shutdownServers(list, shutdownTimeout)
+		if !waitPending(shutdownTimeout - time.Since(start)) {
+			log.Printf("Error: Background handlers still running after %s", shutdownTimeout)
+		}
+		cancelRunning()
+		if audit != nil {
+			audit.Stop()
+		}
+		close(shutdownDone)
+	})
+}
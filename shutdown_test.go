@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownServers(t *testing.T) {
+	started := make(chan struct{}, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		d, _ := time.ParseDuration(r.URL.Query().Get("sleep"))
+		time.Sleep(d)
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	url := "http://" + ln.Addr().String() + "/"
+
+	// An in-flight request completes before shutdown returns
+	result := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url + "?sleep=300ms")
+		if err != nil {
+			result <- 0
+			return
+		}
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+	<-started
+
+	start := time.Now()
+	shutdownServers([]*http.Server{server}, 5*time.Second)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Shutdown did not wait for the running request, took %s", elapsed)
+	}
+	if code := <-result; code != 200 {
+		t.Errorf("In-flight request failed during shutdown: %d", code)
+	}
+
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("New request accepted after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Second)
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	go http.Get("http://" + ln.Addr().String() + "/")
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	shutdownServers([]*http.Server{server}, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown was not bounded by its timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals reloads the configuration from configFile whenever a SIGHUP
+// is received and gracefully shuts down on SIGTERM or SIGINT.  It does not
+// return.
+func handleSignals(configFile string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %s", sig)
+			go shutdown()
+			continue
+		}
+
+		log.Printf("Received SIGHUP, reloading configuration from %s", configFile)
+		if err := reloadConfiguration(configFile); err != nil {
+			log.Printf("Error: Configuration reload failed, keeping current configuration: %s", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// streamKey is the context key of the outputStream of a request.
+type streamKey struct{}
+
+// outputStream writes the output of commands to the HTTP client as it is
+// produced.  Each chunk is a line of JSON naming the handler and alert it
+// belongs to and the final line holds the result of the request.
+type outputStream struct {
+	lock    sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+}
+
+// streamChunk is a line of output written by outputStream.
+type streamChunk struct {
+	Handler   string       `json:"handler,omitempty"`
+	Alertname string       `json:"alertname,omitempty"`
+	Output    string       `json:"output,omitempty"`
+	Result    *eventResult `json:"result,omitempty"`
+}
+
+// newOutputStream returns a stream writing to w, flushing each chunk with
+// flusher if it is not nil.
+func newOutputStream(w io.Writer, flusher http.Flusher) *outputStream {
+	return &outputStream{w: w, flusher: flusher}
+}
+
+// requestStream returns true if the request asks for the output to be
+// streamed with the X-Stream-Output header or the stream query parameter.
+func requestStream(r *http.Request) bool {
+	value := r.Header.Get("X-Stream-Output")
+	if value == "" {
+		value = r.URL.Query().Get("stream")
+	}
+	stream, _ := strconv.ParseBool(value)
+	return stream
+}
+
+// withOutputStream returns a context in which command output is copied to
+// s.
+func withOutputStream(ctx context.Context, s *outputStream) context.Context {
+	return context.WithValue(ctx, streamKey{}, s)
+}
+
+// outputStreamOf returns the stream command output is copied to, if any.
+func outputStreamOf(ctx context.Context) *outputStream {
+	s, _ := ctx.Value(streamKey{}).(*outputStream)
+	return s
+}
+
+// write sends chunk to the client.  Errors are ignored as the client
+// going away cancels the commands.
+func (s *outputStream) write(chunk streamChunk) {
+	blob, err := json.Marshal(chunk)
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.w.Write(append(blob, '\n'))
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// writer returns an io.Writer streaming the output of handler run for the
+// alert named alertname.
+func (s *outputStream) writer(handler, alertname string) io.Writer {
+	return &streamWriter{stream: s, handler: handler, alertname: alertname}
+}
+
+// streamWriter is an io.Writer sending each write as a chunk.
+type streamWriter struct {
+	stream             *outputStream
+	handler, alertname string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.stream.write(streamChunk{Handler: w.handler, Alertname: w.alertname, Output: string(p)})
+	return len(p), nil
+}
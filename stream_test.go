@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStreamOutput(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["progress"] = Handler{Command: "/bin/bash -c \"echo first; sleep 0.5; echo second\""}
+	defer delete(config.Handlers, "progress")
+
+	body := `{"receiver": "test", "status": "firing", "alerts": [
+		{"status": "firing", "labels": {"alertname": "Slow"}, "annotations": {"handler": "progress"}}
+	]}`
+	start := time.Now()
+	resp, err := http.Post("http://"+bind+"/?stream=1", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Unexpected Content-Type: %s", ct)
+	}
+
+	var chunks []streamChunk
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var chunk streamChunk
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			t.Fatalf("Bad chunk %q: %s", scanner.Text(), err)
+		}
+		if len(chunks) == 0 {
+			if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+				t.Errorf("First output was not streamed, took %s", elapsed)
+			}
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 2 output chunks and a result, got %+v", chunks)
+	}
+	if chunks[0].Output != "first\n" || chunks[0].Handler != "progress" || chunks[0].Alertname != "Slow" {
+		t.Errorf("Unexpected first chunk: %+v", chunks[0])
+	}
+	if chunks[1].Output != "second\n" {
+		t.Errorf("Unexpected second chunk: %+v", chunks[1])
+	}
+	result := chunks[2].Result
+	if result == nil || result.Errors != 0 || len(result.Alerts) != 1 ||
+		result.Alerts[0].Handlers[0].Output != "first\nsecond\n" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"text/template"
+)
+
+// loadTemplates parses the named templates defined in files for use by
+// handler templates.  It returns nil if there are no files.
+func loadTemplates(files []string) (*template.Template, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return template.New("template_files").Funcs(templateFuncs).ParseFiles(files...)
+}
+
+// newTemplate returns an empty template named name that may use the named
+// templates in shared, the templates of template_files.
+func newTemplate(shared *template.Template, name string) (*template.Template, error) {
+	if shared != nil {
+		clone, err := shared.Clone()
+		if err != nil {
+			return nil, err
+		}
+		return clone.New(name), nil
+	}
+	return template.New(name).Funcs(templateFuncs), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplateFiles(t *testing.T) {
+	cfg, err := loadConfiguration("testdata/templates/main.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.templateFiles) != 1 {
+		t.Errorf("Template files are not recorded for watching: %v", cfg.templateFiles)
+	}
+
+	orig := getConfig()
+	setConfig(cfg)
+	defer setConfig(orig)
+	alert := Alert{Labels: map[string]string{"instance": "db1:9100"}}
+	exe, args, err := formatHandler([]string{"restart-node"}, cfg.Handlers["restart-node"].Command, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe != "ssh" || !equal(args, []string{"root@db1", "systemctl", "restart", "node_exporter"}) {
+		t.Errorf("Shared template rendered %s %q", exe, args)
+	}
+
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	err = ioutil.WriteFile(file, []byte("template_files: [broken.tmpl]\nhandlers: {}\n"), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte(`{{ define "x" }}{{ .Labels`), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfiguration(file); err == nil {
+		t.Errorf("Broken template file should be an error")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// testAlertRequest is the body of a POST to /api/v1/test.
+type testAlertRequest struct {
+	Status      string            `json:"status"`
+	Receiver    string            `json:"receiver"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+
+	// Handler, when set, is run instead of the handler named by the alert
+	// like a request to /webhook/<handler>.  Arguments are separated by
+	// spaces.
+	Handler string `json:"handler"`
+
+	// Mode is "debug", the default, to only render the commands or "live"
+	// to also run them.
+	Mode string `json:"mode"`
+}
+
+// testCommand is a handler that the test alert resolved to and the
+// command it renders.
+type testCommand struct {
+	Handler string   `json:"handler"`
+	Args    []string `json:"args,omitempty"`
+	Command []string `json:"command,omitempty"`
+	Skipped string   `json:"skipped,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// testAlertResponse is returned by /api/v1/test.
+type testAlertResponse struct {
+	Mode      string        `json:"mode"`
+	Alertname string        `json:"alertname"`
+	Commands  []testCommand `json:"commands"`
+	Result    *eventResult  `json:"result,omitempty"`
+}
+
+// renderTest resolves handler to the commands it would run for alert.
+// Groups and pipelines are expanded into their members.
+func renderTest(cfg *Configuration, handler []string, alert Alert) []testCommand {
+	if len(handler) == 0 {
+		return []testCommand{{Error: "Empty handler annotation found in alert."}}
+	}
+	c := testCommand{Handler: handler[0], Args: handler[1:]}
+	command, ok := cfg.Handlers[handler[0]]
+	switch {
+	case !ok:
+		c.Error = EventError{EMISSING, handler[0]}.Error()
+	case !command.enabled():
+		c.Skipped = "disabled"
+	case len(command.members()) > 0:
+		var commands []testCommand
+		for _, member := range command.members() {
+			commands = append(commands,
+				renderTest(cfg, append([]string{member}, handler[1:]...), alert)...)
+		}
+		return commands
+	case !command.status().match(alert.Status):
+		c.Skipped = "status"
+	default:
+		script, args, err := renderCommand(handler, command, alert)
+		if err != nil {
+			c.Error = err.Error()
+		} else {
+			c.Command = unmarkArgs(append([]string{script}, args...))
+		}
+	}
+	return []testCommand{c}
+}
+
+// testAlert synthesizes an alert from the labels and annotations in the
+// request and returns the commands its handlers render.  In live mode the
+// handlers are also run.
+func testAlert(writer http.ResponseWriter, r *http.Request) {
+	w := NewStatusResponseWriter(writer)
+	defer logRequest(w, r)
+	id := requestID(r)
+	w.Header().Set("X-Request-Id", id)
+
+	if r.Method != "POST" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+	if maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+	req := testAlertRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error parsing JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Status == "" {
+		req.Status = "firing"
+	}
+	if req.Mode == "" {
+		req.Mode = "debug"
+	}
+	if req.Mode != "debug" && req.Mode != "live" {
+		http.Error(w, "Mode must be debug or live.", http.StatusBadRequest)
+		return
+	}
+
+	alert := Alert{
+		Status:      req.Status,
+		Labels:      req.Labels,
+		Annotations: req.Annotations,
+		StartsAt:    time.Now().UTC().Format(time.RFC3339),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		requestID:   id,
+		trace:       parseTraceContext(r),
+	}
+	event := &AlertManagerEvent{
+		Status:    req.Status,
+		Receiver:  req.Receiver,
+		Alerts:    []Alert{alert},
+		handler:   strings.Fields(req.Handler),
+		requestID: id,
+		trace:     alert.trace,
+		test:      true,
+	}
+	if prepared, err := event.prepareAlert(alert); err == nil {
+		alert = prepared
+	}
+
+	cfg := getConfig()
+	resp := testAlertResponse{Mode: req.Mode, Alertname: alert.name()}
+	allHandler := cfg.allHandler()
+	for _, h := range append(event.handlers(cfg, alert), []string{allHandler}) {
+		if _, ok := cfg.Handlers[h[0]]; !ok && (h[0] == allHandler || h[0] == cfg.receiverHandler(req.Receiver)) {
+			// Missing special handlers are not an error
+			continue
+		}
+		resp.Commands = append(resp.Commands, renderTest(cfg, h, alert)...)
+	}
+
+	if req.Mode == "live" {
+		log.Printf("Running test alert %s", alert.name())
+		resp.Result, _ = handleEvent(r.Context(), event)
+	}
+
+	blob, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(blob, '\n'))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func postTestAlert(t *testing.T, body string) (int, testAlertResponse) {
+	resp, err := http.Post("http://"+bind+"/api/v1/test", "application/json",
+		bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	result := testAlertResponse{}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Response is not valid JSON: %s", err)
+		}
+	}
+	return resp.StatusCode, result
+}
+
+func TestTestAlert(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["inject"] = Handler{Command: "/usr/bin/touch testdata/{{ .Labels.host }}-{{ index .Argv 0 }}"}
+	config.Handlers["injectGroup"] = Handler{Group: []string{"inject", "disabledInject"}}
+	config.Handlers["disabledInject"] = Handler{Command: "/bin/false", Enabled: new(bool)}
+	defer delete(config.Handlers, "inject")
+	defer delete(config.Handlers, "injectGroup")
+	defer delete(config.Handlers, "disabledInject")
+	defer os.Remove("testdata/web1-restart")
+
+	code, result := postTestAlert(t, `{"labels": {"alertname": "Injected", "host": "web1"},
+		"annotations": {"handler": "injectGroup restart"}}`)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	if result.Mode != "debug" || result.Alertname != "Injected" || result.Result != nil {
+		t.Errorf("Unexpected response: %#v", result)
+	}
+	if len(result.Commands) != 2 {
+		t.Fatalf("Expected 2 commands from the group, got %#v", result.Commands)
+	}
+	c := result.Commands[0]
+	if c.Handler != "inject" || len(c.Command) != 2 || c.Command[1] != "testdata/web1-restart" {
+		t.Errorf("Unexpected rendered command: %#v", c)
+	}
+	if result.Commands[1].Skipped != "disabled" {
+		t.Errorf("Disabled group member not skipped: %#v", result.Commands[1])
+	}
+	if _, err := os.Stat("testdata/web1-restart"); err == nil {
+		t.Errorf("Handler ran in debug mode")
+	}
+
+	code, result = postTestAlert(t, `{"labels": {"alertname": "Injected", "host": "web1"},
+		"handler": "inject restart", "mode": "live"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	if result.Result == nil || result.Result.Errors != 0 {
+		t.Errorf("Unexpected live result: %#v", result.Result)
+	}
+	if _, err := os.Stat("testdata/web1-restart"); err != nil {
+		t.Errorf("Handler did not run in live mode: %s", err)
+	}
+
+	if code, _ := postTestAlert(t, `{"mode": "sometimes"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid mode, got %d", code)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	// tlsCertFile and tlsKeyFile hold the server's certificate and key.
+	// When set the server uses HTTPS.
+	tlsCertFile string
+	tlsKeyFile  string
+
+	// tlsClientCA is a file of PEM encoded certificates of the authorities
+	// that sign client certificates.  When set clients must present a
+	// certificate signed by one of them.
+	tlsClientCA string
+)
+
+// newTLSConfig builds the server's TLS configuration from the -tls-* flags.
+// It returns nil when TLS is not enabled.
+func newTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		if tlsClientCA != "" {
+			return nil, fmt.Errorf("-tls-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", tlsClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key signed by a test CA.
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate for name signed by parent, or a self
+// signed CA certificate when parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+// write saves the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageAny)
+	server := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth)
+	rogueCA := newTestCert(t, "rogue", nil, x509.ExtKeyUsageAny)
+	rogue := newTestCert(t, "rogue-client", rogueCA, x509.ExtKeyUsageClientAuth)
+
+	tlsClientCA, _ = ca.write(t, dir, "ca")
+	tlsCertFile, tlsKeyFile = server.write(t, dir, "server")
+	defer func() { tlsCertFile, tlsKeyFile, tlsClientCA = "", "", "" }()
+
+	cfg, err := newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = cfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(c *testCert) error {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if c != nil {
+			clientConfig.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{c.der},
+				PrivateKey:  c.key,
+			}}
+		}
+		hc := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		resp, err := hc.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(client); err != nil {
+		t.Errorf("Client with a valid certificate was rejected: %s", err)
+	}
+	if err := get(nil); err == nil {
+		t.Errorf("Client without a certificate was accepted")
+	}
+	if err := get(rogue); err == nil {
+		t.Errorf("Client with a certificate from another CA was accepted")
+	}
+
+	tlsCertFile, tlsKeyFile = "", ""
+	if _, err := newTLSConfig(); err == nil {
+		t.Errorf("-tls-client-ca without a server certificate should be an error")
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageAny)
+	server := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth)
+	tlsCertFile, tlsKeyFile = server.write(t, dir, "server")
+	tlsConfig, err := newTLSConfig()
+	tlsCertFile, tlsKeyFile = "", ""
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2c = true
+	tlsServer := newServer("", webhookRoutes(), tlsConfig)
+	h2cServer := newServer("", webhookRoutes(), nil)
+	h2c = false
+	defer tlsServer.Close()
+	defer h2cServer.Close()
+
+	tlsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2cListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tlsServer.ServeTLS(tlsListener, "", "")
+	go h2cServer.Serve(h2cListener)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	secure := &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}
+	cleartext := &http.Transport{Protocols: new(http.Protocols)}
+	cleartext.Protocols.SetUnencryptedHTTP2(true)
+
+	for url, transport := range map[string]*http.Transport{
+		"https://" + tlsListener.Addr().String() + "/healthz": secure,
+		"http://" + h2cListener.Addr().String() + "/healthz":  cleartext,
+	} {
+		resp, err := (&http.Client{Transport: transport}).Get(url)
+		if err != nil {
+			t.Errorf("Request to %s failed: %s", url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Errorf("Request to %s used %s, not HTTP/2", url, resp.Proto)
+		}
+	}
+}
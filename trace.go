@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// traceparentFormat matches a W3C trace context traceparent header.  Later
+// versions may append fields which are ignored.
+var traceparentFormat = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// traceContext is the W3C trace context a webhook request was made in.
+type traceContext struct {
+	traceID  string
+	parentID string
+	flags    string
+	state    string
+}
+
+// parseTraceContext returns the trace context of r from its traceparent and
+// tracestate headers, or nil when it has none or it is invalid.
+func parseTraceContext(r *http.Request) *traceContext {
+	return newTraceContext(r.Header.Get("traceparent"),
+		strings.Join(r.Header.Values("tracestate"), ","))
+}
+
+// newTraceContext parses the traceparent and tracestate header values.  It
+// returns nil when traceparent is empty or invalid.
+func newTraceContext(traceparent, tracestate string) *traceContext {
+	m := traceparentFormat.FindStringSubmatch(strings.TrimSpace(traceparent))
+	if m == nil || m[1] == "ff" || (m[1] == "00" && m[5] != "") {
+		return nil
+	}
+	if strings.Trim(m[2], "0") == "" || strings.Trim(m[3], "0") == "" {
+		return nil
+	}
+	return &traceContext{
+		traceID:  m[2],
+		parentID: m[3],
+		flags:    m[4],
+		state:    tracestate,
+	}
+}
+
+// traceparent returns the traceparent header of the span the trace context
+// was received from.
+func (t *traceContext) traceparent() string {
+	return "00-" + t.traceID + "-" + t.parentID + "-" + t.flags
+}
+
+// child returns the traceparent of a new span within the trace.
+func (t *traceContext) child() string {
+	span := make([]byte, 8)
+	rand.Read(span)
+	return "00-" + t.traceID + "-" + hex.EncodeToString(span) + "-" + t.flags
+}
+
+// env returns a copy of env with TRACEPARENT and TRACESTATE set so the
+// command runs as a new span in the trace.
+func (t *traceContext) env(env map[string]string) map[string]string {
+	if t == nil {
+		return env
+	}
+	result := map[string]string{"TRACEPARENT": t.child()}
+	if t.state != "" {
+		result["TRACESTATE"] = t.state
+	}
+	for k, v := range env {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceContext(t *testing.T) {
+	tests := map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":       false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":       false,
+		"": false,
+	}
+	for header, valid := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("traceparent", header)
+		if trace := parseTraceContext(r); (trace != nil) != valid {
+			t.Errorf("traceparent %q: expected valid %v, got %#v", header, valid, trace)
+		}
+	}
+}
+
+func TestTraceEnv(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["traced"] = Handler{
+		Command: "/bin/bash -c \"echo $TRACEPARENT $TRACESTATE > testdata/testTrace\"",
+	}
+	defer delete(config.Handlers, "traced")
+	defer os.Remove("testdata/testTrace")
+
+	body, err := ioutil.ReadFile("testdata/test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "http://"+bind+"/api/v1/webhook/traced", bytes.NewReader(body))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "vendor=abc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	buf, err := ioutil.ReadFile("testdata/testTrace")
+	if err != nil {
+		t.Fatalf("Handler did not run: %s", err)
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) != 2 || fields[1] != "vendor=abc" {
+		t.Fatalf("Unexpected trace environment: %q", buf)
+	}
+	parts := strings.Split(fields[0], "-")
+	if len(parts) != 4 || parts[1] != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		parts[2] == "00f067aa0ba902b7" || parts[3] != "01" {
+		t.Errorf("TRACEPARENT is not a child span of the request: %s", fields[0])
+	}
+}
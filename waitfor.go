@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolutionMemory is how long a resolved notification is remembered.
+const resolutionMemory = 24 * time.Hour
+
+var (
+	// resolutions remembers when each alert was last resolved
+	resolutions = newResolutionTracker()
+
+	// alertmanagerURL is the Alertmanager queried by handlers with
+	// wait_for to confirm that an alert is still firing.  Empty relies on
+	// resolved notifications only.
+	alertmanagerURL string
+
+	// alertmanagerClient queries the Alertmanager API
+	alertmanagerClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// resolutionTracker holds the time of the last resolved notification of
+// each alert fingerprint.
+type resolutionTracker struct {
+	lock      sync.Mutex
+	resolved  map[string]time.Time
+	lastSweep time.Time
+}
+
+func newResolutionTracker() *resolutionTracker {
+	return &resolutionTracker{resolved: make(map[string]time.Time)}
+}
+
+// record notes that the alert with fingerprint was resolved at now.
+func (r *resolutionTracker) record(fingerprint string, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.resolved[fingerprint] = now
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+	for key, t := range r.resolved {
+		if now.Sub(t) > resolutionMemory {
+			delete(r.resolved, key)
+		}
+	}
+}
+
+// since returns true if the alert with fingerprint was resolved after t.
+func (r *resolutionTracker) since(fingerprint string, t time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.resolved[fingerprint].After(t)
+}
+
+// waitFor defers running h for a firing alert by its wait_for and returns
+// false if the alert was resolved in the meantime.
+func waitFor(ctx context.Context, h Handler, alert Alert) (bool, error) {
+	if h.WaitFor <= 0 || alert.Status != "firing" || !h.enabled() ||
+		!h.status().match(alert.Status) {
+		return true, nil
+	}
+	return stillFiring(ctx, alert, h.WaitFor)
+}
+
+// stillFiring waits d and returns true unless alert was resolved in the
+// meantime, as told by a resolved notification or, with -alertmanager-url,
+// the Alertmanager.
+func stillFiring(ctx context.Context, alert Alert, d time.Duration) (bool, error) {
+	received := clock()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return false, fmt.Errorf("Cancelled while waiting for alert %s: %s", alert.name(), ctx.Err())
+	}
+
+	if resolutions.since(alert.fingerprint(), received) {
+		return false, nil
+	}
+	if alertmanagerURL == "" {
+		return true, nil
+	}
+	firing, err := queryFiring(alert)
+	if err != nil {
+		// Better to remediate an alert that has gone than to miss one
+		log.Printf("Error: Could not ask the Alertmanager about alert %s, assuming it is firing: %s",
+			alert.name(), err)
+		return true, nil
+	}
+	return firing, nil
+}
+
+// amAlert is an alert as returned by the Alertmanager v2 API.
+type amAlert struct {
+	Labels map[string]string `json:"labels"`
+	EndsAt string            `json:"endsAt"`
+}
+
+// queryFiring asks the Alertmanager whether alert is still active.
+func queryFiring(alert Alert) (bool, error) {
+	query := url.Values{}
+	for k, v := range alert.Labels {
+		query.Add("filter", k+"="+strconv.Quote(v))
+	}
+	u := strings.TrimSuffix(alertmanagerURL, "/") + "/api/v2/alerts?" + query.Encode()
+	resp, err := alertmanagerClient.Get(u)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Alertmanager returned %s", resp.Status)
+	}
+
+	var alerts []amAlert
+	if err := json.NewDecoder(resp.Body).Decode(&alerts); err != nil {
+		return false, err
+	}
+	for _, a := range alerts {
+		if !reflect.DeepEqual(a.Labels, alert.Labels) {
+			continue
+		}
+		ends, err := time.Parse(time.RFC3339, a.EndsAt)
+		if err != nil || ends.After(time.Now()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
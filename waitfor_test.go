@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStillFiring(t *testing.T) {
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Blip", "instance": "a:9100"}}
+
+	firing, err := stillFiring(context.Background(), alert, 10*time.Millisecond)
+	if err != nil || !firing {
+		t.Errorf("Alert without a resolved notification should be firing: %v", err)
+	}
+
+	// Resolved while waiting
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		resolutions.record(alert.fingerprint(), clock())
+	}()
+	defer delete(resolutions.resolved, alert.fingerprint())
+	if firing, err = stillFiring(context.Background(), alert, 100*time.Millisecond); err != nil || firing {
+		t.Errorf("Alert resolved during the wait should not be firing: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = stillFiring(ctx, alert, time.Hour); err == nil {
+		t.Errorf("Cancelled wait should fail")
+	}
+}
+
+func TestQueryFiring(t *testing.T) {
+	active := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/alerts" || len(r.URL.Query()["filter"]) != 2 {
+			t.Errorf("Unexpected Alertmanager query: %s", r.URL)
+		}
+		alerts := []amAlert{
+			{Labels: map[string]string{"alertname": "Blip", "instance": "a:9100", "extra": "x"}},
+		}
+		if active {
+			alerts = append(alerts, amAlert{
+				Labels: map[string]string{"alertname": "Blip", "instance": "a:9100"},
+				EndsAt: time.Now().Add(time.Hour).Format(time.RFC3339),
+			})
+		}
+		json.NewEncoder(w).Encode(alerts)
+	}))
+	defer server.Close()
+	alertmanagerURL = server.URL
+	defer func() { alertmanagerURL = "" }()
+
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Blip", "instance": "a:9100"}}
+	if firing, err := stillFiring(context.Background(), alert, time.Millisecond); err != nil || !firing {
+		t.Errorf("Alert active in the Alertmanager should be firing: %v", err)
+	}
+	active = false
+	if firing, err := stillFiring(context.Background(), alert, time.Millisecond); err != nil || firing {
+		t.Errorf("Alert missing from the Alertmanager should not be firing: %v", err)
+	}
+}
+
+func TestWaitForSkipsHandler(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+
+	config.Handlers["patient"] = Handler{Command: "/bin/false", WaitFor: 100 * time.Millisecond}
+	defer delete(config.Handlers, "patient")
+
+	firing := Alert{Status: "firing", Labels: map[string]string{"alertname": "Patience"}}
+	resolved := Alert{Status: "resolved", Labels: firing.Labels}
+	defer delete(resolutions.resolved, firing.fingerprint())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(20 * time.Millisecond)
+		e := &AlertManagerEvent{Alerts: []Alert{resolved}}
+		e.handleAlert(context.Background(), config, resolved, newAuditRecord(e))
+	}()
+
+	_, _, err := runHandler(context.Background(), config, []string{"patient"}, firing)
+	<-done
+	if err != nil {
+		t.Errorf("Handler for an alert resolved during wait_for should be skipped: %s", err)
+	}
+}
+
+func TestDryRunResolutionNotRecorded(t *testing.T) {
+	resolved := Alert{Status: "resolved", Labels: map[string]string{"alertname": "DryPatience"}}
+	defer delete(resolutions.resolved, resolved.fingerprint())
+
+	before := clock().Add(-time.Second)
+	e := &AlertManagerEvent{Alerts: []Alert{resolved}}
+	e.handleAlert(withDryRun(context.Background()), config, resolved, newAuditRecord(e))
+	if resolutions.since(resolved.fingerprint(), before) {
+		t.Errorf("Dry run resolution should not be recorded")
+	}
+}
+
+func TestWaitForOnce(t *testing.T) {
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+	defer func(d time.Duration) { retryBackoff = d }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	config.Handlers["persistent"] = Handler{
+		Command: "/bin/false",
+		WaitFor: 100 * time.Millisecond,
+		Retries: 3,
+	}
+	defer delete(config.Handlers, "persistent")
+
+	alert := Alert{Status: "firing", Labels: map[string]string{"alertname": "Persistence"}}
+	start := time.Now()
+	_, attempts, err := runHandler(context.Background(), config, []string{"persistent"}, alert)
+	if err == nil || attempts != 4 {
+		t.Errorf("Expected 4 failed attempts, got %d: %v", attempts, err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Retries waited for the alert again, took %s", elapsed)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// changed reports whether the file described by cur differs from prev.
+// Kubernetes updates ConfigMap mounts by swapping a symlink so a different
+// underlying file counts as a change as well as a new size or mtime.
+func changed(prev, cur os.FileInfo) bool {
+	if prev == nil || cur == nil {
+		return prev != cur
+	}
+	return !os.SameFile(prev, cur) || !prev.ModTime().Equal(cur.ModTime()) ||
+		prev.Size() != cur.Size()
+}
+
+// statConfiguration returns the file information of path and, if path is
+// a directory, every configuration file within it.  Files included by the
+// active configuration, and its template files, are checked as well.
+func statConfiguration(path string) ([]os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	if info.IsDir() {
+		if files, err = configurationFiles(path); err != nil {
+			return nil, err
+		}
+	}
+	if cfg := getConfig(); cfg != nil {
+		files = append(files, cfg.included...)
+		files = append(files, cfg.templateFiles...)
+	}
+
+	result := []os.FileInfo{info}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// changedAll reports whether any of the files described by cur differ from
+// prev.
+func changedAll(prev, cur []os.FileInfo) bool {
+	if len(prev) != len(cur) {
+		return true
+	}
+	for i := range prev {
+		if prev[i].Name() != cur[i].Name() || changed(prev[i], cur[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchConfiguration checks file for changes every interval and reloads the
+// configuration when it changes.  If file is a directory the configuration
+// files within it are checked as well.  If file is a URL it is polled and
+// if it is a Consul KV prefix it is watched with blocking queries.  It
+// returns when stop is closed.
+func watchConfiguration(file string, interval time.Duration, stop <-chan struct{}) {
+	if isURL(file) {
+		pollConfiguration(file, interval, stop)
+		return
+	}
+	if isConsul(file) {
+		watchConsul(file, interval, stop)
+		return
+	}
+
+	prev, err := statConfiguration(file)
+	if err != nil {
+		log.Printf("Error: Cannot watch configuration: %s", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		cur, err := statConfiguration(file)
+		if err != nil {
+			// The file may be briefly missing while being replaced
+			if verboseLogging() {
+				log.Printf("Cannot stat configuration: %s", err)
+			}
+			continue
+		}
+		if !changedAll(prev, cur) {
+			continue
+		}
+		prev = cur
+
+		log.Printf("Configuration file %s changed, reloading", file)
+		if err := reloadConfiguration(file); err != nil {
+			log.Printf("Error: Configuration reload failed, keeping current configuration: %s", err)
+		}
+	}
+}
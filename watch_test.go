@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchConfiguration(t *testing.T) {
+	orig := getConfig()
+	defer setConfig(orig)
+
+	fd, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("handlers:\n  old:\n    command: /bin/true\n")
+	fd.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfiguration(fd.Name(), 10*time.Millisecond, stop)
+	time.Sleep(50 * time.Millisecond)
+
+	err = ioutil.WriteFile(fd.Name(), []byte("handlers:\n  watched:\n    command: /bin/true\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := getConfig().Handlers["watched"]; ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Changed configuration was not reloaded")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clock returns the current time.  Tests replace it to control the time
+// handler windows are evaluated against.
+var clock = time.Now
+
+// Window is a recurring period of time during which a handler is active.
+// Start and End are wall clock times in "HH:MM" format evaluated in
+// Timezone, so a window follows daylight saving time changes.  A window
+// whose End is before its Start spans midnight, and in that case Days
+// refers to the day the window starts on.  A window whose Start and End
+// are equal lasts the entire day.
+type Window struct {
+	// Days are the three letter abbreviations of the days of the week the
+	// window is active, e.g. "mon".  Empty means every day.
+	Days []string `json:"days,omitempty"`
+
+	// Start is the time of day the window opens
+	Start string `json:"start"`
+
+	// End is the time of day the window closes
+	End string `json:"end"`
+
+	// Timezone is the IANA name of the time zone, e.g. "America/New_York".
+	// Empty means the local time zone.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// parseTimeOfDay converts "HH:MM" into minutes after midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day \"%s\", expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t falls within the window.
+func (w Window) contains(t time.Time) (bool, error) {
+	loc := time.Local
+	if w.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return false, err
+		}
+	}
+	start, err := parseTimeOfDay(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := parseTimeOfDay(w.End)
+	if err != nil {
+		return false, err
+	}
+
+	t = t.In(loc)
+	minutes := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case start < end:
+		if minutes < start || minutes >= end {
+			return false, nil
+		}
+	case start > end:
+		// The window spans midnight
+		if minutes < end {
+			day = (day + 6) % 7 // Opened yesterday
+		} else if minutes < start {
+			return false, nil
+		}
+	}
+
+	if len(w.Days) == 0 {
+		return true, nil
+	}
+	for _, d := range w.Days {
+		if strings.EqualFold(d, day.String()[:3]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// inWindow reports whether t falls within any of windows.  A handler
+// without windows is always active.
+func inWindow(windows []Window, t time.Time) (bool, error) {
+	if len(windows) == 0 {
+		return true, nil
+	}
+	for _, w := range windows {
+		ok, err := w.contains(t)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
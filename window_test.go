@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWindowContains(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Time zone data not available: %s", err)
+	}
+
+	business := Window{
+		Days:     []string{"mon", "tue", "wed", "thu", "fri"},
+		Start:    "09:00",
+		End:      "17:00",
+		Timezone: "America/New_York",
+	}
+	overnight := Window{
+		Days:     []string{"fri"},
+		Start:    "22:00",
+		End:      "06:00",
+		Timezone: "America/New_York",
+	}
+
+	var tests = []struct {
+		window   Window
+		t        time.Time
+		expected bool
+	}{
+		{business, time.Date(2017, 4, 5, 10, 0, 0, 0, ny), true},  // Wednesday
+		{business, time.Date(2017, 4, 5, 17, 0, 0, 0, ny), false}, // Closed at end
+		{business, time.Date(2017, 4, 5, 14, 0, 0, 0, time.UTC), true},
+		{business, time.Date(2017, 4, 8, 10, 0, 0, 0, ny), false},  // Saturday
+		{overnight, time.Date(2017, 4, 7, 23, 0, 0, 0, ny), true},  // Friday night
+		{overnight, time.Date(2017, 4, 8, 5, 59, 0, 0, ny), true},  // Saturday morning
+		{overnight, time.Date(2017, 4, 8, 23, 0, 0, 0, ny), false}, // Saturday night
+		{overnight, time.Date(2017, 4, 7, 5, 0, 0, 0, ny), false},  // Thursday's window
+		{business, time.Date(2017, 3, 13, 9, 30, 0, 0, ny), true},  // Day after DST start
+		{business, time.Date(2017, 3, 13, 13, 30, 0, 0, time.UTC), true},
+	}
+
+	for _, test := range tests {
+		ok, err := test.window.contains(test.t)
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+			continue
+		}
+		if ok != test.expected {
+			t.Errorf("Window %v contains %s: expected %v", test.window, test.t, test.expected)
+		}
+	}
+}
+
+func TestHandlerWindow(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Time zone data not available: %s", err)
+	}
+
+	// Holodeck safeties are off
+	debug = false
+	defer func() { debug = true }()
+	defer func() { clock = time.Now }()
+	defer delete(config.Handlers, "window")
+
+	config.Handlers["window"] = Handler{
+		Command: "/bin/bash -c \"touch testdata/testWindow\"",
+		Windows: []Window{{
+			Days:     []string{"mon", "tue", "wed", "thu", "fri"},
+			Start:    "09:00",
+			End:      "17:00",
+			Timezone: "America/New_York",
+		}},
+	}
+	alert := Alert{Status: "firing"}
+
+	var tests = map[time.Time]bool{
+		time.Date(2017, 4, 5, 10, 0, 0, 0, ny): true,
+		time.Date(2017, 4, 5, 20, 0, 0, 0, ny): false,
+	}
+	for now, expected := range tests {
+		_ = os.Remove("testdata/testWindow")
+		clock = func() time.Time { return now }
+		if _, err := parseHandler(context.Background(), []string{"window"}, alert); err != nil {
+			t.Fatal(err)
+		}
+		_, err := os.Stat("testdata/testWindow")
+		if expected && err != nil {
+			t.Errorf("Handler should run at %s: %s", now, err)
+		} else if !expected && err == nil {
+			t.Errorf("Handler should not run at %s", now)
+		}
+	}
+	_ = os.Remove("testdata/testWindow")
+}